@@ -0,0 +1,324 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Backend selects the kind of BlockDevice an array creates for its members
+type Backend int
+
+const (
+	// FileBackend stores each member in a disk%d.dat file, synced as
+	// Geometry.Sync says: by default on every write, like a real disk
+	FileBackend Backend = iota
+	// SparseBackend stores each member in a sparse disk%d.dat file that is
+	// only synced on Close, so unwritten blocks take no space
+	SparseBackend
+	// MemoryBackend keeps each member in memory
+	MemoryBackend
+	// SimulatedBackend keeps each member in memory and charges virtual time
+	// for every request with DefaultDiskModel
+	SimulatedBackend
+	// DirectBackend stores each member in a disk%d.dat file opened with
+	// O_DIRECT, so benchmarks measure the device rather than the page cache
+	DirectBackend
+)
+
+// DefaultBackend is the backend in DefaultGeometry, used by NewRAID0() and
+// the other default constructors
+var DefaultBackend = FileBackend
+
+func (b Backend) String() string {
+	switch b {
+	case SparseBackend:
+		return "sparse"
+	case MemoryBackend:
+		return "memory"
+	case SimulatedBackend:
+		return "simulated"
+	case DirectBackend:
+		return "direct"
+	}
+	return "file"
+}
+
+// ParseBackend returns the backend with the given name: file, sparse, memory,
+// simulated or direct
+func ParseBackend(name string) (Backend, error) {
+	for _, b := range []Backend{FileBackend, SparseBackend, MemoryBackend, SimulatedBackend, DirectBackend} {
+		if b.String() == name {
+			return b, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown backend %q", name)
+}
+
+// open creates member disk i of an array with the given geometry
+func (b Backend) open(g Geometry, i int) (BlockDevice, error) {
+	path := filepath.Join(g.Dir, fmt.Sprintf("disk%d.dat", i))
+	switch b {
+	case SparseBackend:
+		return NewSparseDisk(path, g.BlockSize)
+	case MemoryBackend:
+		return NewMemoryDisk(g.BlockSize), nil
+	case SimulatedBackend:
+		// The superblock sits in the block after the data
+		return NewSimulatedDisk(NewMemoryDisk(g.BlockSize), DefaultDiskModel, g.BlockSize, g.DiskBlocks+1), nil
+	}
+
+	var disk *Disk
+	var err error
+	if b == DirectBackend {
+		disk, err = NewDirectDisk(path, g.BlockSize)
+	} else {
+		disk, err = NewDiskWithBlockSize(path, g.BlockSize)
+	}
+	if err != nil {
+		return nil, err
+	}
+	disk.policy = g.Sync
+	return disk, nil
+}
+
+// MemoryDisk is a BlockDevice held in memory. Only blocks that have been
+// written take space; the rest read as zeros.
+type MemoryDisk struct {
+	blockSize int
+	mu        sync.RWMutex
+	blocks    map[int][]byte
+}
+
+// NewMemoryDisk creates an empty in-memory disk
+func NewMemoryDisk(blockSize int) *MemoryDisk {
+	return &MemoryDisk{blockSize: blockSize, blocks: make(map[int][]byte)}
+}
+
+// Read reads len(buffer) bytes starting at a block
+func (d *MemoryDisk) Read(blockNum int, buffer []byte) error {
+	if blockNum < 0 {
+		return fmt.Errorf("%w: block %d", ErrOutOfRange, blockNum)
+	}
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	for n := 0; n < len(buffer); blockNum++ {
+		block, ok := d.blocks[blockNum]
+		if ok {
+			n += copy(buffer[n:], block)
+			continue
+		}
+		end := min(n+d.blockSize, len(buffer))
+		clear(buffer[n:end])
+		n = end
+	}
+	return nil
+}
+
+// Write writes data starting at a block. A final partial block is padded
+// with zeros.
+func (d *MemoryDisk) Write(blockNum int, data []byte) error {
+	if blockNum < 0 {
+		return fmt.Errorf("%w: block %d", ErrOutOfRange, blockNum)
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for n := 0; n < len(data); blockNum++ {
+		block := make([]byte, d.blockSize)
+		n += copy(block, data[n:])
+		d.blocks[blockNum] = block
+	}
+	return nil
+}
+
+// Discard frees count blocks from blockNum, which read as zeros afterwards
+func (d *MemoryDisk) Discard(blockNum, count int) error {
+	if blockNum < 0 {
+		return fmt.Errorf("%w: block %d", ErrOutOfRange, blockNum)
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for i := 0; i < count; i++ {
+		delete(d.blocks, blockNum+i)
+	}
+	return nil
+}
+
+// Close does nothing: the contents stay in memory until Delete
+func (d *MemoryDisk) Close() error {
+	return nil
+}
+
+// Delete frees the disk's contents
+func (d *MemoryDisk) Delete() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	clear(d.blocks)
+	return nil
+}
+
+// SparseDisk is a file-backed BlockDevice that skips the fsync after every
+// write, syncing only on Flush and Close. All-zero blocks written past the
+// end of the file extend it with a hole rather than writing the zeros, so
+// unwritten and zeroed blocks take no space on file systems that support
+// sparse files.
+type SparseDisk struct {
+	file      *os.File
+	path      string
+	blockSize int
+	mu        sync.RWMutex // Shared by writes, exclusive while extending with a hole
+}
+
+// NewSparseDisk creates or opens a sparse disk file
+func NewSparseDisk(path string, blockSize int) (*SparseDisk, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &SparseDisk{file: file, path: path, blockSize: blockSize}, nil
+}
+
+// Read reads len(buffer) bytes starting at a block. Holes and blocks past
+// the end of the file read as zeros.
+func (d *SparseDisk) Read(blockNum int, buffer []byte) error {
+	if blockNum < 0 {
+		return fmt.Errorf("%w: block %d", ErrOutOfRange, blockNum)
+	}
+	n, err := d.file.ReadAt(buffer, int64(blockNum)*int64(d.blockSize))
+	if err != nil && err != io.EOF {
+		return err
+	}
+	clear(buffer[n:])
+	return nil
+}
+
+// Write writes data starting at a block
+func (d *SparseDisk) Write(blockNum int, data []byte) error {
+	if blockNum < 0 {
+		return fmt.Errorf("%w: block %d", ErrOutOfRange, blockNum)
+	}
+	offset := int64(blockNum) * int64(d.blockSize)
+	if isZero(data) {
+		// No other write can extend the file between the size check and
+		// the truncate, so the truncate only ever grows it
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		info, err := d.file.Stat()
+		if err != nil {
+			return err
+		}
+		if offset >= info.Size() {
+			return d.file.Truncate(offset + int64(len(data)))
+		}
+	} else {
+		d.mu.RLock()
+		defer d.mu.RUnlock()
+	}
+	_, err := d.file.WriteAt(data, offset)
+	return err
+}
+
+// Discard punches count blocks from blockNum out of the file, so they read as
+// zeros and take no space
+func (d *SparseDisk) Discard(blockNum, count int) error {
+	if blockNum < 0 {
+		return fmt.Errorf("%w: block %d", ErrOutOfRange, blockNum)
+	}
+	return punchHole(d.file, int64(blockNum)*int64(d.blockSize), int64(count)*int64(d.blockSize))
+}
+
+// Flush syncs the disk file
+func (d *SparseDisk) Flush() error {
+	return d.file.Sync()
+}
+
+// Close syncs and closes the disk file
+func (d *SparseDisk) Close() error {
+	if err := d.file.Sync(); err != nil {
+		d.file.Close()
+		return err
+	}
+	return d.file.Close()
+}
+
+// Delete closes and deletes the disk file
+func (d *SparseDisk) Delete() error {
+	if err := d.file.Close(); err != nil {
+		return err
+	}
+	return os.Remove(d.path)
+}
+
+// isZero reports whether data is all zero bytes
+func isZero(data []byte) bool {
+	for _, b := range data {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// NewRAIDWithDevices creates an array of the given level (0, 1, 4, 5 or 6)
+// whose members are devices, one for each disk in g, instead of disks made
+// by g.Backend. Initialize writes the superblocks to them as usual.
+func NewRAIDWithDevices(level int, g Geometry, devices []BlockDevice) (RAID, error) {
+	if len(devices) != g.NumDisks {
+		return nil, fmt.Errorf("%d devices given for %d disks", len(devices), g.NumDisks)
+	}
+	return newWithDevices(level, g, devices, false)
+}
+
+// newWithDevices creates an array of the given level over devices, leaving
+// the superblocks alone if noSuperblock is set
+func newWithDevices(level int, g Geometry, devices []BlockDevice, noSuperblock bool) (RAID, error) {
+	newDisk := func(i int) (BlockDevice, error) {
+		if i >= len(devices) {
+			return nil, fmt.Errorf("no device given for disk %d", i)
+		}
+		return devices[i], nil
+	}
+
+	switch level {
+	case 0:
+		r, err := NewRAID0WithGeometry(g)
+		if err != nil {
+			return nil, err
+		}
+		r.newDisk, r.noSuperblock = newDisk, noSuperblock
+		return r, nil
+	case 1:
+		r, err := NewRAID1WithGeometry(g)
+		if err != nil {
+			return nil, err
+		}
+		r.newDisk, r.noSuperblock = newDisk, noSuperblock
+		return r, nil
+	case 4:
+		r, err := NewRAID4WithGeometry(g)
+		if err != nil {
+			return nil, err
+		}
+		r.newDisk, r.noSuperblock = newDisk, noSuperblock
+		return r, nil
+	case 5:
+		r, err := NewRAID5WithGeometry(g)
+		if err != nil {
+			return nil, err
+		}
+		r.newDisk, r.noSuperblock = newDisk, noSuperblock
+		return r, nil
+	case 6:
+		r, err := NewRAID6WithGeometry(g)
+		if err != nil {
+			return nil, err
+		}
+		r.newDisk, r.noSuperblock = newDisk, noSuperblock
+		return r, nil
+	}
+	return nil, fmt.Errorf("unknown RAID level %d", level)
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"testing"
+)
+
+// TestMain runs the tests with arrays from the default constructors held in
+// memory, so they leave no disk files in the working directory. Tests that
+// need files set Geometry.Dir and get the file backend from testGeometry.
+func TestMain(m *testing.M) {
+	DefaultBackend = MemoryBackend
+	os.Exit(m.Run())
+}
+
+// testBackend checks reads and writes on one device
+func testBackend(t *testing.T, disk BlockDevice) {
+	t.Helper()
+	buffer := make([]byte, TestBlockSize)
+	if err := disk.Read(7, buffer); err != nil || !bytes.Equal(buffer, make([]byte, TestBlockSize)) {
+		t.Errorf("Unwritten block read as non-zero, err %v", err)
+	}
+	for _, blockNum := range []int{0, 3, 100} {
+		if err := disk.Write(blockNum, blockPattern(blockNum)); err != nil {
+			t.Fatalf("Failed to write block %d: %v", blockNum, err)
+		}
+	}
+	for _, blockNum := range []int{0, 3, 100} {
+		if err := disk.Read(blockNum, buffer); err != nil {
+			t.Fatalf("Failed to read block %d: %v", blockNum, err)
+		}
+		if !bytes.Equal(buffer, blockPattern(blockNum)) {
+			t.Errorf("Block %d read back wrong", blockNum)
+		}
+	}
+
+	// Writes and reads may span blocks
+	two := append(blockPattern(10), blockPattern(11)...)
+	if err := disk.Write(10, two); err != nil {
+		t.Fatalf("Failed to write two blocks: %v", err)
+	}
+	if err := disk.Read(11, buffer); err != nil || !bytes.Equal(buffer, blockPattern(11)) {
+		t.Errorf("Second block of a two-block write read back wrong, err %v", err)
+	}
+	span := make([]byte, 3*TestBlockSize)
+	if err := disk.Read(10, span); err != nil {
+		t.Fatalf("Failed to read three blocks: %v", err)
+	}
+	if !bytes.Equal(span[:2*TestBlockSize], two) || !bytes.Equal(span[2*TestBlockSize:], make([]byte, TestBlockSize)) {
+		t.Errorf("Three-block read returned the wrong bytes")
+	}
+}
+
+// TestMemoryDisk tests the in-memory backend
+func TestMemoryDisk(t *testing.T) {
+	disk := NewMemoryDisk(TestBlockSize)
+	testBackend(t, disk)
+	if len(disk.blocks) != 5 {
+		t.Errorf("Memory disk holds %d blocks, expected only the 5 written", len(disk.blocks))
+	}
+	disk.Delete()
+	if len(disk.blocks) != 0 {
+		t.Errorf("Delete left %d blocks in memory", len(disk.blocks))
+	}
+}
+
+// TestSparseDisk tests the sparse-file backend, including that a far block
+// and zero blocks do not allocate the space before them
+func TestSparseDisk(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sparse.dat")
+	disk, err := NewSparseDisk(path, TestBlockSize)
+	if err != nil {
+		t.Fatalf("Failed to create sparse disk: %v", err)
+	}
+	testBackend(t, disk)
+	if err := disk.Write(1000, make([]byte, TestBlockSize)); err != nil {
+		t.Fatalf("Failed to write zero block: %v", err)
+	}
+	if err := disk.Close(); err != nil {
+		t.Fatalf("Failed to close sparse disk: %v", err)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("Failed to stat sparse disk: %v", err)
+	}
+	if info.Size() != 1001*TestBlockSize {
+		t.Errorf("Sparse disk is %d bytes, expected %d", info.Size(), 1001*TestBlockSize)
+	}
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok && stat.Blocks*512 >= info.Size()/2 {
+		t.Errorf("File system allocated %d of %d bytes, expected holes", stat.Blocks*512, info.Size())
+	}
+}
+
+// TestSparseDiskConcurrentExtend tests that zero blocks extending the file
+// never cut off data written concurrently further along
+func TestSparseDiskConcurrentExtend(t *testing.T) {
+	disk, err := NewSparseDisk(filepath.Join(t.TempDir(), "sparse.dat"), TestBlockSize)
+	if err != nil {
+		t.Fatalf("Failed to create sparse disk: %v", err)
+	}
+	defer disk.Delete()
+
+	// Zero blocks and data blocks alternate, each written by its own goroutine
+	var wg sync.WaitGroup
+	for blockNum := 0; blockNum < 200; blockNum++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			data := make([]byte, TestBlockSize)
+			if blockNum%2 == 1 {
+				data = blockPattern(blockNum)
+			}
+			if err := disk.Write(blockNum, data); err != nil {
+				t.Errorf("Failed to write block %d: %v", blockNum, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	buffer := make([]byte, TestBlockSize)
+	for blockNum := 1; blockNum < 200; blockNum += 2 {
+		if err := disk.Read(blockNum, buffer); err != nil || !bytes.Equal(buffer, blockPattern(blockNum)) {
+			t.Errorf("Block %d was lost, err %v", blockNum, err)
+		}
+	}
+}
+
+// TestBackends tests an array on each backend, and that only the file
+// backends create files
+func TestBackends(t *testing.T) {
+	for _, backend := range []Backend{FileBackend, SparseBackend, MemoryBackend} {
+		t.Run(backend.String(), func(t *testing.T) {
+			g := testGeometry(t, 4, 2)
+			g.Backend = backend
+			raid, err := NewRAID5WithGeometry(g)
+			if err != nil {
+				t.Fatalf("Failed to create RAID5: %v", err)
+			}
+			if err := raid.Initialize(); err != nil {
+				t.Fatalf("Failed to initialize RAID5: %v", err)
+			}
+			writeAndVerify(t, raid, 30)
+			raid.FailDisk(1)
+			verifyBlocks(t, raid, 30)
+
+			files, _ := filepath.Glob(filepath.Join(g.Dir, "*.dat"))
+			want := 4
+			if backend == MemoryBackend {
+				want = 0
+			}
+			if len(files) != want {
+				t.Errorf("%s backend created %d files, expected %d", backend, len(files), want)
+			}
+			raid.CleanUp()
+		})
+	}
+
+	if _, err := ParseBackend("tape"); err == nil {
+		t.Errorf("Expected an unknown backend name to be rejected")
+	}
+}
+
+// TestRAIDWithDevices tests building arrays over devices supplied by the
+// caller
+func TestRAIDWithDevices(t *testing.T) {
+	for _, level := range []int{0, 1, 4, 5, 6} {
+		g := testGeometry(t, 4, 1)
+		g.DiskBlocks = TestRebuildBlocks
+		devices := make([]BlockDevice, g.NumDisks)
+		for i := range devices {
+			devices[i] = NewMemoryDisk(g.BlockSize)
+		}
+		raid, err := NewRAIDWithDevices(level, g, devices)
+		if err != nil {
+			t.Fatalf("Failed to create RAID%d: %v", level, err)
+		}
+		if err := raid.Initialize(); err != nil {
+			t.Fatalf("Failed to initialize RAID%d: %v", level, err)
+		}
+		writeAndVerify(t, raid, 20)
+
+		// The superblock went to the devices given
+		block := make([]byte, g.BlockSize)
+		devices[3].Read(g.DiskBlocks, block)
+		if sb, err := decodeSuperblock(block); err != nil || sb.Level != level || sb.Index != 3 {
+			t.Errorf("RAID%d device 3 has superblock %+v, err %v", level, sb, err)
+		}
+		raid.CleanUp()
+	}
+
+	if _, err := NewRAIDWithDevices(5, testGeometry(t, 4, 1), nil); err == nil {
+		t.Errorf("Expected a device count that does not match the geometry to be rejected")
+	}
+}
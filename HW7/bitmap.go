@@ -0,0 +1,177 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"time"
+)
+
+// BitmapIdle is how long a region of the write-intent bitmap must go without
+// writes before its bit is cleared
+const BitmapIdle = 5 * time.Second
+
+// writeIntent is the in-memory copy of a write-intent bitmap. A region's bit
+// is set on disk before any of its strips are written, and only cleared once
+// the region has been idle, so after a crash the set bits cover every strip
+// that might have been caught half-written.
+type writeIntent struct {
+	dirty     []bool      // Bits as they stand on disk
+	lastWrite []time.Time // When each region was last written
+	idle      time.Duration
+}
+
+func newWriteIntent(regions int) *writeIntent {
+	return &writeIntent{
+		dirty:     make([]bool, regions),
+		lastWrite: make([]time.Time, regions),
+		idle:      BitmapIdle,
+	}
+}
+
+// encode packs the bitmap into bytes, one bit per region. A nil bitmap
+// encodes as nil.
+func (w *writeIntent) encode() []byte {
+	if w == nil {
+		return nil
+	}
+	bitmap := make([]byte, (len(w.dirty)+7)/8)
+	for region, dirty := range w.dirty {
+		if dirty {
+			bitmap[region/8] |= 1 << (region % 8)
+		}
+	}
+	return bitmap
+}
+
+// loadBitmap sets the dirty bits from a bitmap read from disk
+func (w *writeIntent) loadBitmap(bitmap []byte) {
+	for region := range w.dirty {
+		w.dirty[region] = bitmap[region/8]&(1<<(region%8)) != 0
+	}
+}
+
+// bitmapRegions returns the number of regions a bitmap covering g has
+func bitmapRegions(g Geometry, region int) int {
+	return (g.DiskBlocks + region - 1) / region
+}
+
+// readBitmap reads the write-intent bitmap stored with a member's
+// superblock, in the last block of the disk file
+func readBitmap(path string, sb Superblock) ([]byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	g := sb.Geometry
+	bitmap := make([]byte, (bitmapRegions(g, sb.BitmapRegion)+7)/8)
+	_, err = file.ReadAt(bitmap, info.Size()-int64(g.BlockSize))
+	return bitmap, err
+}
+
+// EnableBitmap turns on a write-intent bitmap, so that after a crash only the
+// strips written shortly before it need to be resynced. The bitmap is kept
+// in the superblock block of every member, with each bit covering as many
+// strips as it takes to fit.
+func (m *memberSet) EnableBitmap() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.geometry == nil {
+		return errors.New("array is not initialized")
+	}
+	if m.intent != nil {
+		return nil
+	}
+	g := m.geometry()
+	bits := (g.BlockSize - superblockSize) * 8
+	m.bitmapRegion = (g.DiskBlocks + bits - 1) / bits
+	m.intent = newWriteIntent(bitmapRegions(g, m.bitmapRegion))
+	return m.updateSuperblocks()
+}
+
+// markDirty sets the bitmap bit for a strip's region before the strip is
+// written. Regions that have gone idle are cleared in the same bitmap write.
+// Must be called with mu held.
+func (m *memberSet) markDirty(stripNum int) {
+	if m.intent == nil {
+		return
+	}
+	region := stripNum / m.bitmapRegion
+	now := time.Now()
+	m.intent.lastWrite[region] = now
+	if m.intent.dirty[region] {
+		return
+	}
+
+	for r, dirty := range m.intent.dirty {
+		if dirty && now.Sub(m.intent.lastWrite[r]) >= m.intent.idle {
+			m.intent.dirty[r] = false
+		}
+	}
+	m.intent.dirty[region] = true
+	m.flushBitmap()
+}
+
+// flushBitmap writes the bitmap to every member. Dirty bits must reach the
+// disks before the writes they cover, so members that do not sync every
+// write are flushed. Must be called with mu held.
+func (m *memberSet) flushBitmap() {
+	m.record(m.geometry(), m.disks, m.memberState, m.intent.encode())
+	if m.sync.Mode != SyncAlways {
+		flushDisks(m.disks)
+	}
+}
+
+// DirtyRegions returns the bitmap regions currently marked dirty
+func (m *memberSet) DirtyRegions() []int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var regions []int
+	if m.intent != nil {
+		for region, dirty := range m.intent.dirty {
+			if dirty {
+				regions = append(regions, region)
+			}
+		}
+	}
+	return regions
+}
+
+// clearBitmap marks every region clean, for a clean shutdown. Must be called
+// with mu held.
+func (m *memberSet) clearBitmap() {
+	if m.intent == nil {
+		return
+	}
+	clear(m.intent.dirty)
+	m.flushBitmap()
+}
+
+// resync checks and repairs every strip in the regions marked dirty, as
+// found on disk after a crash, then clears them. Strips being reshaped do not
+// have a single layout to check against, so the bitmap is left for later.
+func (m *memberSet) resync() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.reshaping {
+		return
+	}
+	for region, dirty := range m.intent.dirty {
+		if !dirty {
+			continue
+		}
+		first := region * m.bitmapRegion
+		for stripNum := first; stripNum < first+m.bitmapRegion && stripNum < m.diskBlocks; stripNum++ {
+			m.scrubStrip(stripNum, true)
+		}
+	}
+	m.clearBitmap()
+}
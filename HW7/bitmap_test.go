@@ -0,0 +1,99 @@
+package main
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+// crashArray drops an array without a clean shutdown: the disks are closed
+// but the bitmap is left as it was
+func crashArray(m *memberSet) {
+	m.stopBackground()
+	for _, disk := range m.allDisks() {
+		disk.Close()
+	}
+}
+
+// TestBitmapResyncAfterCrash tests that after a crash only the strips in
+// dirty regions are resynced, which repairs a stripe left half-written
+func TestBitmapResyncAfterCrash(t *testing.T) {
+	raid, dir := createTestArray(t, 4)
+	if err := raid.EnableBitmap(); err != nil {
+		t.Fatalf("Failed to enable bitmap: %v", err)
+	}
+	if raid.bitmapRegion != 1 {
+		t.Fatalf("Expected one strip per bitmap region, got %d", raid.bitmapRegion)
+	}
+
+	// Block 13 is in strip 5 and block 25 in strip 9
+	for _, blockNum := range []int{13, 25} {
+		if err := raid.Write(blockNum, blockPattern(blockNum)); err != nil {
+			t.Fatalf("Failed to write to RAID5 block %d: %v", blockNum, err)
+		}
+	}
+	if regions := raid.DirtyRegions(); !slices.Equal(regions, []int{5, 9}) {
+		t.Errorf("Expected regions 5 and 9 to be dirty, got %v", regions)
+	}
+
+	// Crash between the data and parity writes of strip 5, leaving its
+	// parity stale. Strip 1 was not being written, so its bad parity is not
+	// the resync's to find.
+	corruptBlock(t, &raid.memberSet, raid.getParityDisk(5/2), 5)
+	corruptBlock(t, &raid.memberSet, raid.getParityDisk(1/2), 1)
+	crashArray(&raid.memberSet)
+
+	reopened := openTestArray(t, dir)
+	defer reopened.CleanUp()
+	checkParity(t, &reopened.memberSet, 5)
+	if len(reopened.DirtyRegions()) != 0 {
+		t.Errorf("Expected the bitmap to be clear after resync, got %v", reopened.DirtyRegions())
+	}
+
+	// Only the two dirty strips were read, one block from each member
+	if reads := reopened.IOStats().Reads; reads != 2*4 {
+		t.Errorf("Resync took %d reads, expected %d", reads, 2*4)
+	}
+	report, _ := reopened.Scrub(ScrubOptions{LastStrip: -1})
+	if !slices.Equal(report.Mismatches, []int{1}) {
+		t.Errorf("Expected only strip 1 to be left inconsistent, got %v", report.Mismatches)
+	}
+	verifyBlocks(t, reopened, 30)
+}
+
+// TestBitmapCleanShutdown tests that closing an array clears the bitmap, so
+// reopening it resyncs nothing
+func TestBitmapCleanShutdown(t *testing.T) {
+	raid, dir := createTestArray(t, 3)
+	raid.EnableBitmap()
+	writeAndVerify(t, raid, 10)
+	if len(raid.DirtyRegions()) == 0 {
+		t.Errorf("Expected writes to mark regions dirty")
+	}
+	raid.Close()
+
+	reopened := openTestArray(t, dir)
+	defer reopened.CleanUp()
+	if reads := reopened.IOStats().Reads; reads != 0 {
+		t.Errorf("Reopening after a clean shutdown took %d reads", reads)
+	}
+	if reopened.intent == nil {
+		t.Errorf("Expected the bitmap to stay enabled after reopening")
+	}
+}
+
+// TestBitmapIdleRegions tests that regions are cleared once they stop being
+// written
+func TestBitmapIdleRegions(t *testing.T) {
+	raid, _ := createTestArray(t, 3)
+	defer raid.CleanUp()
+	raid.EnableBitmap()
+	raid.intent.idle = 20 * time.Millisecond
+
+	raid.Write(0, blockPattern(0))
+	time.Sleep(30 * time.Millisecond)
+	raid.Write(10, blockPattern(10))
+	if regions := raid.DirtyRegions(); !slices.Equal(regions, []int{4}) {
+		t.Errorf("Expected only region 4 to be dirty, got %v", regions)
+	}
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"container/list"
+	"io"
+	"slices"
+	"sync"
+	"time"
+)
+
+// CacheFlushInterval is how often a write-back cache writes its dirty blocks
+// to the array in the background
+const CacheFlushInterval = time.Second
+
+// CacheMode selects when writes reach the cached array
+type CacheMode int
+
+const (
+	// WriteThrough writes every block to the array before Write returns
+	WriteThrough CacheMode = iota
+	// WriteBack keeps written blocks in the cache until they are flushed or
+	// evicted
+	WriteBack
+)
+
+func (m CacheMode) String() string {
+	if m == WriteBack {
+		return "write-back"
+	}
+	return "write-through"
+}
+
+// CacheStats counts how a cache has been used
+type CacheStats struct {
+	Hits       int64
+	Misses     int64
+	Evictions  int64
+	Writebacks int64 // Dirty blocks written to the array
+}
+
+// HitRate returns the fraction of reads served from the cache
+func (s CacheStats) HitRate() float64 {
+	if s.Hits+s.Misses == 0 {
+		return 0
+	}
+	return float64(s.Hits) / float64(s.Hits+s.Misses)
+}
+
+// cacheEntry is one cached block
+type cacheEntry struct {
+	blockNum int
+	data     []byte
+	dirty    bool // Written to the cache but not yet to the array
+}
+
+// CachedRAID wraps an array with an LRU cache of blocks. It is a RAID
+// itself, so it can stand in for the array anywhere, including in
+// RunBenchmark.
+type CachedRAID struct {
+	RAID
+	blockSize  int
+	capacity   int // Most blocks held at once
+	mode       CacheMode
+	flushEvery time.Duration
+
+	mu      sync.Mutex
+	lru     *list.List            // Most recently used at the front
+	entries map[int]*list.Element // By block number
+	stats   CacheStats
+
+	stop chan struct{} // Closed to stop the background flusher
+	done sync.WaitGroup
+}
+
+// NewCachedRAID wraps raid with a cache of capacity blocks
+func NewCachedRAID(raid RAID, capacity int, mode CacheMode) *CachedRAID {
+	blockSize := BlockSize
+	if g, ok := raid.(geometer); ok {
+		blockSize = g.Geometry().BlockSize
+	}
+	return &CachedRAID{
+		RAID:       raid,
+		blockSize:  blockSize,
+		capacity:   max(capacity, 1),
+		mode:       mode,
+		flushEvery: CacheFlushInterval,
+		lru:        list.New(),
+		entries:    make(map[int]*list.Element),
+	}
+}
+
+// Initialize initializes the array and, in write-back mode, starts writing
+// dirty blocks back in the background
+func (c *CachedRAID) Initialize() error {
+	if err := c.RAID.Initialize(); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lru.Init()
+	clear(c.entries)
+	c.stats = CacheStats{}
+	if c.mode == WriteBack && c.stop == nil {
+		c.stop = make(chan struct{})
+		c.done.Add(1)
+		go c.flusher(c.stop)
+	}
+	return nil
+}
+
+// flusher writes the dirty blocks back every flushEvery until stop is closed
+func (c *CachedRAID) flusher(stop chan struct{}) {
+	defer c.done.Done()
+	ticker := time.NewTicker(c.flushEvery)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			c.writeBackAll()
+		}
+	}
+}
+
+// stopFlusher stops the background flusher, if it is running
+func (c *CachedRAID) stopFlusher() {
+	c.mu.Lock()
+	stop := c.stop
+	c.stop = nil
+	c.mu.Unlock()
+	if stop != nil {
+		close(stop)
+		c.done.Wait()
+	}
+}
+
+func (c *CachedRAID) Read(blockNum int) ([]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.entries[blockNum]; ok {
+		c.stats.Hits++
+		c.lru.MoveToFront(elem)
+		return slices.Clone(elem.Value.(*cacheEntry).data), nil
+	}
+	c.stats.Misses++
+	data, err := c.RAID.Read(blockNum)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.insert(blockNum, slices.Clone(data), false); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func (c *CachedRAID) Write(blockNum int, data []byte) error {
+	if err := checkData(data, c.blockSize); err != nil {
+		return err
+	}
+	// A write-back block only reaches the array later, so check it here
+	if err := checkBlock(blockNum, c.RAID.GetEffectiveCapacity()); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.mode == WriteThrough {
+		if err := c.RAID.Write(blockNum, data); err != nil {
+			// The cached copy may no longer match the array
+			c.remove(blockNum)
+			return err
+		}
+	}
+	return c.insert(blockNum, slices.Clone(data), c.mode == WriteBack)
+}
+
+// Discard drops any cached copies of the blocks, dirty or not, and discards
+// them on the array
+func (c *CachedRAID) Discard(blockNum, count int) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.RAID.Discard(blockNum, count); err != nil {
+		return err
+	}
+	for i := 0; i < count; i++ {
+		c.remove(blockNum + i)
+	}
+	return nil
+}
+
+// insert caches a block, replacing any older copy, and evicts the least
+// recently used blocks to make room. Must be called with mu held.
+func (c *CachedRAID) insert(blockNum int, data []byte, dirty bool) error {
+	if elem, ok := c.entries[blockNum]; ok {
+		entry := elem.Value.(*cacheEntry)
+		entry.data = data
+		entry.dirty = entry.dirty || dirty
+		c.lru.MoveToFront(elem)
+		return nil
+	}
+
+	for c.lru.Len() >= c.capacity {
+		oldest := c.lru.Back().Value.(*cacheEntry)
+		if oldest.dirty {
+			if err := c.writeBack(oldest); err != nil {
+				return err
+			}
+		}
+		c.remove(oldest.blockNum)
+		c.stats.Evictions++
+	}
+	c.entries[blockNum] = c.lru.PushFront(&cacheEntry{blockNum: blockNum, data: data, dirty: dirty})
+	return nil
+}
+
+// remove drops a block from the cache. Must be called with mu held.
+func (c *CachedRAID) remove(blockNum int) {
+	if elem, ok := c.entries[blockNum]; ok {
+		c.lru.Remove(elem)
+		delete(c.entries, blockNum)
+	}
+}
+
+// writeBack writes a dirty block to the array. Must be called with mu held.
+func (c *CachedRAID) writeBack(entry *cacheEntry) error {
+	if err := c.RAID.Write(entry.blockNum, entry.data); err != nil {
+		return err
+	}
+	entry.dirty = false
+	c.stats.Writebacks++
+	return nil
+}
+
+// Flush writes every dirty block to the array, in block order, then flushes
+// the array so the writes are durable
+func (c *CachedRAID) Flush() error {
+	if err := c.writeBackAll(); err != nil {
+		return err
+	}
+	return c.RAID.Flush()
+}
+
+// writeBackAll writes every dirty block to the array, in block order
+func (c *CachedRAID) writeBackAll() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var dirty []*cacheEntry
+	for _, elem := range c.entries {
+		if entry := elem.Value.(*cacheEntry); entry.dirty {
+			dirty = append(dirty, entry)
+		}
+	}
+	slices.SortFunc(dirty, func(a, b *cacheEntry) int { return a.blockNum - b.blockNum })
+	for _, entry := range dirty {
+		if err := c.writeBack(entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DirtyBlocks returns the number of cached blocks not yet written to the
+// array
+func (c *CachedRAID) DirtyBlocks() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	count := 0
+	for _, elem := range c.entries {
+		if elem.Value.(*cacheEntry).dirty {
+			count++
+		}
+	}
+	return count
+}
+
+// CacheStats returns the hit, miss and writeback counts so far
+func (c *CachedRAID) CacheStats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.stats
+}
+
+// Close flushes the cache and closes the array's disks
+func (c *CachedRAID) Close() error {
+	c.stopFlusher()
+	if err := c.Flush(); err != nil {
+		return err
+	}
+	if closer, ok := c.RAID.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// CleanUp drops the cache without flushing it and cleans up the array
+func (c *CachedRAID) CleanUp() error {
+	c.stopFlusher()
+	c.mu.Lock()
+	c.lru.Init()
+	clear(c.entries)
+	c.mu.Unlock()
+	return c.RAID.CleanUp()
+}
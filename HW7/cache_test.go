@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+// newTestCache returns a cache of capacity blocks over a small initialized
+// RAID5, along with the RAID5 itself. Background flushes happen every
+// flushEvery.
+func newTestCache(t *testing.T, capacity int, mode CacheMode, flushEvery time.Duration) (*CachedRAID, *RAID5) {
+	t.Helper()
+	g := testGeometry(t, 3, 1)
+	g.DiskBlocks = TestRebuildBlocks
+	raid, err := NewRAID5WithGeometry(g)
+	if err != nil {
+		t.Fatalf("Failed to create RAID5: %v", err)
+	}
+	cache := NewCachedRAID(raid, capacity, mode)
+	cache.flushEvery = flushEvery
+	err = cache.Initialize()
+	if err != nil {
+		t.Fatalf("Failed to initialize cache: %v", err)
+	}
+	t.Cleanup(func() { cache.CleanUp() })
+	return cache, raid
+}
+
+// TestCacheLRU tests hits, misses and least-recently-used eviction
+func TestCacheLRU(t *testing.T) {
+	cache, raid := newTestCache(t, 4, WriteThrough, CacheFlushInterval)
+	writeAndVerify(t, cache, 4)
+	if stats := cache.CacheStats(); stats.Hits != 4 || stats.Misses != 0 {
+		t.Errorf("Stats after reading cached blocks are %+v, expected 4 hits", stats)
+	}
+
+	// Reading block 0 again makes block 1 the least recently used
+	before := raid.IOStats().Reads
+	cache.Read(0)
+	if raid.IOStats().Reads != before {
+		t.Errorf("Expected a cache hit to issue no disk reads")
+	}
+	cache.Write(4, blockPattern(4))
+	cache.Read(1)
+	cache.Read(0)
+	stats := cache.CacheStats()
+	if stats.Hits != 6 || stats.Misses != 1 || stats.Evictions != 2 {
+		t.Errorf("Stats are %+v, expected 6 hits, 1 miss and 2 evictions", stats)
+	}
+	if stats.HitRate() != 6.0/7.0 {
+		t.Errorf("Hit rate is %v, expected 6/7", stats.HitRate())
+	}
+	verifyBlocks(t, raid, 5)
+}
+
+// TestCacheWriteBack tests that written blocks only reach the array when
+// flushed or evicted
+func TestCacheWriteBack(t *testing.T) {
+	cache, raid := newTestCache(t, 8, WriteBack, time.Hour)
+
+	for blockNum := 0; blockNum < 8; blockNum++ {
+		cache.Write(blockNum, blockPattern(blockNum))
+	}
+	cache.Write(3, blockPattern(30))
+	if writes := raid.IOStats().Writes; writes != 0 {
+		t.Errorf("Write-back cache issued %d disk writes before a flush", writes)
+	}
+	if dirty := cache.DirtyBlocks(); dirty != 8 {
+		t.Errorf("Cache has %d dirty blocks, expected 8", dirty)
+	}
+
+	// Writing a ninth block evicts block 0, writing it back first
+	cache.Write(8, blockPattern(8))
+	data, _ := raid.Read(0)
+	if !bytes.Equal(data, blockPattern(0)) {
+		t.Errorf("Evicted dirty block 0 was not written back")
+	}
+
+	if err := cache.Flush(); err != nil {
+		t.Fatalf("Failed to flush cache: %v", err)
+	}
+	if stats := cache.CacheStats(); stats.Writebacks != 9 || cache.DirtyBlocks() != 0 {
+		t.Errorf("Stats after flush are %+v with %d dirty, expected 9 writebacks", stats, cache.DirtyBlocks())
+	}
+	data, _ = raid.Read(3)
+	if !bytes.Equal(data, blockPattern(30)) {
+		t.Errorf("Flush did not write the latest copy of block 3")
+	}
+	for stripNum := 0; stripNum < 5; stripNum++ {
+		checkParity(t, &raid.memberSet, stripNum)
+	}
+}
+
+// TestCacheBackgroundFlush tests that dirty blocks are written back without
+// an explicit flush
+func TestCacheBackgroundFlush(t *testing.T) {
+	cache, raid := newTestCache(t, 16, WriteBack, 10*time.Millisecond)
+	cache.Write(5, blockPattern(5))
+	deadline := time.Now().Add(time.Second)
+	for cache.DirtyBlocks() > 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	data, _ := raid.Read(5)
+	if !bytes.Equal(data, blockPattern(5)) {
+		t.Errorf("Background flusher did not write block 5")
+	}
+}
+
+// TestCachedBenchmark tests that RunBenchmark reports cache statistics
+func TestCachedBenchmark(t *testing.T) {
+	g := testGeometry(t, 3, 1)
+	raid, err := NewRAID5WithGeometry(g)
+	if err != nil {
+		t.Fatalf("Failed to create RAID5: %v", err)
+	}
+	stats, err := RunBenchmark(raid, 50, BenchmarkOptions{CacheBlocks: 64, CacheMode: WriteBack})
+	if err != nil {
+		t.Fatalf("Benchmark failed: %v", err)
+	}
+	if stats.Cache.Hits != 50 || stats.Cache.Misses != 0 {
+		t.Errorf("Benchmark cache stats are %+v, expected every read to hit", stats.Cache)
+	}
+}
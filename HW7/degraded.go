@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+)
+
+// xorInto XORs src into dst byte by byte
+func xorInto(dst, src []byte) {
+	for i := range dst {
+		dst[i] ^= src[i]
+	}
+}
+
+// failedDisk returns the single member of a parity stripe that cannot be
+// used, or -1 if all members are healthy. It returns ErrArrayFailed if more
+// than one is unusable.
+func (m *memberSet) failedDisk(stripNum int) (int, error) {
+	missing := -1
+	for i := range m.disks {
+		if !m.isFailed(i, stripNum) {
+			continue
+		}
+		if missing != -1 {
+			return -1, ErrArrayFailed
+		}
+		missing = i
+	}
+	return missing, nil
+}
+
+// readParityBlock reads one data block of a parity stripe. If the data disk
+// has failed, the block is rebuilt by XORing every other block in the stripe,
+// including the parity block.
+func (m *memberSet) readParityBlock(blockSize, stripNum, diskNum int) ([]byte, error) {
+	data := make([]byte, blockSize)
+	if !m.isFailed(diskNum, stripNum) {
+		if err := m.read(diskNum, stripNum, data); err == nil {
+			return data, nil
+		}
+	}
+
+	return m.reconstructBlock(blockSize, stripNum, diskNum)
+}
+
+// reconstructBlock rebuilds the block of the missing disk in a stripe from the
+// surviving blocks and parity
+func (m *memberSet) reconstructBlock(blockSize, stripNum, missing int) ([]byte, error) {
+	// Read the rest of the stripe from every surviving disk at once
+	ops := m.otherMembers(blockSize, missing)
+	if _, err := m.readMembers(stripNum, ops); err != nil {
+		return nil, ErrArrayFailed
+	}
+
+	data := make([]byte, blockSize)
+	for _, op := range ops {
+		xorInto(data, op.data)
+	}
+	return data, nil
+}
+
+// otherMembers returns a read of every member except the given ones, each
+// with its own buffer
+func (m *memberSet) otherMembers(blockSize int, skip ...int) []memberOp {
+	var ops []memberOp
+	for i := range m.disks {
+		if !slices.Contains(skip, i) {
+			ops = append(ops, memberOp{diskNum: i, data: make([]byte, blockSize)})
+		}
+	}
+	return ops
+}
+
+// useSubtractiveParity decides how to update parity for a small write to
+// diskNum, given the member that has failed (-1 for none).
+//
+// A subtractive update reads the old data and old parity, so it always costs
+// 2 reads. An additive update reads every other data block in the stripe,
+// costing numDisks-2 reads. Subtractive wins on wide stripes and is the only
+// option when a peer data disk is gone; additive is the only option when the
+// target data disk is gone.
+func useSubtractiveParity(numDisks, missing, diskNum int) bool {
+	switch missing {
+	case -1:
+		return numDisks-2 > 2
+	case diskNum:
+		return false
+	}
+	return true
+}
+
+// writeParityBlock writes one data block of a parity stripe and keeps the
+// parity block consistent with it. A single failed member is tolerated: if the
+// data disk is gone only the parity is written, so the new data can still be
+// rebuilt from the rest of the stripe later.
+func (m *memberSet) writeParityBlock(blockSize, stripNum, diskNum, parityDisk int, data []byte) error {
+	missing, err := m.failedDisk(stripNum)
+	if err != nil {
+		return err
+	}
+
+	// Parity disk is gone, so the data block is the only thing left to write
+	if missing == parityDisk {
+		if err := m.write(diskNum, stripNum, data); err != nil {
+			return ErrArrayFailed
+		}
+		return nil
+	}
+
+	var ops []memberOp
+	if useSubtractiveParity(len(m.disks), missing, diskNum) {
+		// Subtractive update: new parity = old parity ^ old data ^ new data
+		ops = []memberOp{
+			{diskNum: diskNum, data: make([]byte, blockSize)},
+			{diskNum: parityDisk, data: make([]byte, blockSize)},
+		}
+	} else {
+		// Additive update: compute parity from every other data block
+		ops = m.otherMembers(blockSize, diskNum, parityDisk)
+	}
+	if _, err := m.readMembers(stripNum, ops); err != nil {
+		// If a disk just failed, retry with the new failure state. Any other
+		// error, such as a checksum that cannot be healed, would only recur.
+		if now, failErr := m.failedDisk(stripNum); failErr == nil && now != missing {
+			return m.writeParityBlock(blockSize, stripNum, diskNum, parityDisk, data)
+		}
+		return fmt.Errorf("%w: %w", ErrArrayFailed, err)
+	}
+
+	parity := make([]byte, blockSize)
+	copy(parity, data)
+	for _, op := range ops {
+		xorInto(parity, op.data)
+	}
+
+	// Write data and parity together, skipping the data disk if it has
+	// already failed
+	writes := []memberOp{{diskNum: parityDisk, data: parity}}
+	if missing != diskNum {
+		writes = append(writes, memberOp{diskNum: diskNum, data: data})
+	}
+	m.writeMembers(stripNum, writes)
+
+	// Losing the parity write is only fatal if the data write was lost too
+	if _, err := m.failedDisk(stripNum); err != nil {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+// blockPattern returns test data that is unique to a block number, so a block
+// that lands in the wrong place is caught
+func blockPattern(blockNum int) []byte {
+	data := make([]byte, TestBlockSize)
+	for i := range data {
+		data[i] = byte((i + blockNum*7) % 251)
+	}
+	return data
+}
+
+// parityArray is the part of RAID4 and RAID5 exercised by the degraded tests
+type parityArray interface {
+	RAID
+	FailDisk(diskNum int)
+}
+
+// testDegradedReadWrite fails one disk and checks that old data is rebuilt and
+// new writes are still readable
+func testDegradedReadWrite(t *testing.T, raid parityArray, failDisk int) {
+	err := raid.Initialize()
+	if err != nil {
+		t.Fatalf("Failed to initialize %s: %v", raid.GetName(), err)
+	}
+	defer raid.CleanUp()
+
+	for blockNum := 0; blockNum < 20; blockNum++ {
+		err = raid.Write(blockNum, blockPattern(blockNum))
+		if err != nil {
+			t.Fatalf("Failed to write to %s block %d: %v", raid.GetName(), blockNum, err)
+		}
+	}
+
+	raid.FailDisk(failDisk)
+
+	// Every block must still be readable, rebuilt from parity where needed
+	for blockNum := 0; blockNum < 20; blockNum++ {
+		readData, err := raid.Read(blockNum)
+		if err != nil {
+			t.Fatalf("Failed to read degraded %s block %d: %v", raid.GetName(), blockNum, err)
+		}
+		if !bytes.Equal(readData, blockPattern(blockNum)) {
+			t.Errorf("Data mismatch in degraded %s block %d", raid.GetName(), blockNum)
+		}
+	}
+
+	// Overwrite every block while degraded, then read it all back
+	for blockNum := 0; blockNum < 20; blockNum++ {
+		err = raid.Write(blockNum, blockPattern(blockNum+100))
+		if err != nil {
+			t.Fatalf("Failed to write to degraded %s block %d: %v", raid.GetName(), blockNum, err)
+		}
+	}
+	for blockNum := 0; blockNum < 20; blockNum++ {
+		readData, err := raid.Read(blockNum)
+		if err != nil {
+			t.Fatalf("Failed to read degraded %s block %d: %v", raid.GetName(), blockNum, err)
+		}
+		if !bytes.Equal(readData, blockPattern(blockNum+100)) {
+			t.Errorf("Data mismatch after degraded write to %s block %d", raid.GetName(), blockNum)
+		}
+	}
+}
+
+// TestRAID4DegradedMode tests reads and writes with a failed data or parity disk
+func TestRAID4DegradedMode(t *testing.T) {
+	testDegradedReadWrite(t, NewRAID4(), 1)
+	testDegradedReadWrite(t, NewRAID4(), 4)
+}
+
+// TestRAID5DegradedMode tests reads and writes with a failed disk
+func TestRAID5DegradedMode(t *testing.T) {
+	testDegradedReadWrite(t, NewRAID5(), 2)
+}
+
+// TestRAID5DoubleFailure tests that losing two disks fails the array
+func TestRAID5DoubleFailure(t *testing.T) {
+	raid := NewRAID5()
+	err := raid.Initialize()
+	if err != nil {
+		t.Fatalf("Failed to initialize RAID5: %v", err)
+	}
+	defer raid.CleanUp()
+
+	raid.FailDisk(0)
+	raid.FailDisk(1)
+
+	if err := raid.Write(0, blockPattern(0)); err == nil {
+		t.Errorf("Expected write to fail with two failed disks")
+	}
+	if _, err := raid.Read(0); err == nil {
+		t.Errorf("Expected read to fail with two failed disks")
+	}
+}
+
+// checkParity reads every member of a strip directly and checks that the
+// blocks XOR to zero, which holds exactly when parity is correct
+func checkParity(t *testing.T, m *memberSet, stripNum int) {
+	t.Helper()
+	sum := make([]byte, TestBlockSize)
+	blockData := make([]byte, TestBlockSize)
+	for i, disk := range m.disks {
+		if err := disk.Read(stripNum, blockData); err != nil {
+			t.Fatalf("Failed to read disk %d strip %d: %v", i, stripNum, err)
+		}
+		xorInto(sum, blockData)
+	}
+	if !bytes.Equal(sum, make([]byte, TestBlockSize)) {
+		t.Errorf("Parity mismatch in strip %d", stripNum)
+	}
+}
+
+// TestSubtractiveParity tests that read-modify-write parity updates keep
+// every strip consistent across repeated overwrites
+func TestSubtractiveParity(t *testing.T) {
+	raid := NewRAID5()
+	err := raid.Initialize()
+	if err != nil {
+		t.Fatalf("Failed to initialize RAID5: %v", err)
+	}
+	defer raid.CleanUp()
+
+	for pass := 0; pass < 3; pass++ {
+		for blockNum := 0; blockNum < 20; blockNum++ {
+			if err := raid.Write(blockNum, blockPattern(blockNum+pass)); err != nil {
+				t.Fatalf("Failed to write to RAID5 block %d: %v", blockNum, err)
+			}
+		}
+	}
+	for stripNum := 0; stripNum < 5; stripNum++ {
+		checkParity(t, &raid.memberSet, stripNum)
+	}
+	for blockNum := 0; blockNum < 20; blockNum++ {
+		readData, err := raid.Read(blockNum)
+		if err != nil || !bytes.Equal(readData, blockPattern(blockNum+2)) {
+			t.Errorf("Data mismatch in RAID5 block %d: %v", blockNum, err)
+		}
+	}
+}
+
+// TestSmallWriteIOCount tests that each parity update picks the cheaper of
+// subtractive and additive parity for the stripe width
+func TestSmallWriteIOCount(t *testing.T) {
+	tests := []struct {
+		numDisks int
+		expected IOStats
+	}{
+		{3, IOStats{Reads: 1, Writes: 2}}, // Additive: read the one other data block
+		{4, IOStats{Reads: 2, Writes: 2}}, // Tie, additive: read both other data blocks
+		{5, IOStats{Reads: 2, Writes: 2}}, // Subtractive: old data and old parity
+		{8, IOStats{Reads: 2, Writes: 2}}, // Subtractive instead of 6 reads
+	}
+
+	for _, tt := range tests {
+		geometry := DefaultGeometry()
+		geometry.NumDisks = tt.numDisks
+		raid, err := NewRAID5WithGeometry(geometry)
+		if err != nil {
+			t.Fatalf("Failed to create RAID5: %v", err)
+		}
+		err = raid.Initialize()
+		if err != nil {
+			t.Fatalf("Failed to initialize RAID5: %v", err)
+		}
+
+		before := raid.IOStats()
+		if err := raid.Write(1, blockPattern(1)); err != nil {
+			t.Fatalf("Failed to write to RAID5: %v", err)
+		}
+		after := raid.IOStats()
+		got := IOStats{Reads: after.Reads - before.Reads, Writes: after.Writes - before.Writes}
+		if got != tt.expected {
+			t.Errorf("RAID5 with %d disks: one write took %+v, expected %+v", tt.numDisks, got, tt.expected)
+		}
+		checkParity(t, &raid.memberSet, 0)
+
+		raid.CleanUp()
+	}
+}
+
+// TestParityWriteUnreadable tests that a small write whose parity can
+// neither be read nor healed fails instead of retrying forever
+func TestParityWriteUnreadable(t *testing.T) {
+	raid, err := NewRAID5WithGeometry(integrityGeometry(t, 5))
+	if err != nil {
+		t.Fatalf("Failed to create RAID5: %v", err)
+	}
+	if err := raid.Initialize(); err != nil {
+		t.Fatalf("Failed to initialize RAID5: %v", err)
+	}
+	defer raid.CleanUp()
+	writeAndVerify(t, raid, 8)
+
+	// With a third member gone, the rotten parity block cannot be rebuilt
+	row, diskNum, parityDisk := raid.mapBlock(5)
+	for i := range raid.disks {
+		if i != diskNum && i != parityDisk {
+			raid.FailDisk(i)
+			break
+		}
+	}
+	rotBlock(t, &raid.memberSet, parityDisk, row)
+
+	if err := raid.Write(5, blockPattern(6)); !errors.Is(err, ErrArrayFailed) {
+		t.Errorf("Write over unreadable parity returned %v, expected ErrArrayFailed", err)
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"unsafe"
+)
+
+// directAlign is the alignment O_DIRECT needs for buffers, file offsets and
+// transfer sizes
+const directAlign = 4096
+
+// NewDirectDisk creates or opens a disk file with O_DIRECT, so reads and
+// writes bypass the page cache and every request reaches the device. The
+// block size must be a multiple of 4KB. Not every file system supports
+// O_DIRECT; tmpfs, for one, refuses to open the file.
+func NewDirectDisk(path string, blockSize int) (*Disk, error) {
+	if openDirect == 0 {
+		return nil, errors.New("direct I/O is not supported on this system")
+	}
+	if blockSize%directAlign != 0 {
+		return nil, fmt.Errorf("direct I/O needs a block size that is a multiple of %d", directAlign)
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|openDirect, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &Disk{file: file, path: path, blockSize: blockSize, direct: true}, nil
+}
+
+// alignedBuffer returns a zeroed buffer of at least size bytes, rounded up
+// to whole alignment units, whose memory starts on a directAlign boundary
+func alignedBuffer(size int) []byte {
+	size = (size + directAlign - 1) / directAlign * directAlign
+	buffer := make([]byte, size+directAlign)
+	shift := int(uintptr(unsafe.Pointer(&buffer[0])) % directAlign)
+	if shift != 0 {
+		shift = directAlign - shift
+	}
+	return buffer[shift : shift+size]
+}
+
+// readDirect reads into buffer at offset through an aligned buffer
+func (d *Disk) readDirect(buffer []byte, offset int64) (int, error) {
+	aligned := alignedBuffer(len(buffer))
+	n, err := d.file.ReadAt(aligned, offset)
+	n = min(n, len(buffer))
+	copy(buffer, aligned[:n])
+	return n, err
+}
+
+// writeDirect writes data at offset through an aligned buffer
+func (d *Disk) writeDirect(data []byte, offset int64) error {
+	aligned := alignedBuffer(len(data))
+	copy(aligned, data)
+	_, err := d.file.WriteAt(aligned, offset)
+	return err
+}
@@ -0,0 +1,6 @@
+package main
+
+import "syscall"
+
+// openDirect is the open flag for direct I/O
+const openDirect = syscall.O_DIRECT
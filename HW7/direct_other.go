@@ -0,0 +1,6 @@
+//go:build !linux
+
+package main
+
+// openDirect is zero where the system has no O_DIRECT open flag
+const openDirect = 0
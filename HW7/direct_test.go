@@ -0,0 +1,36 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+// TestDirectDisk tests the O_DIRECT backend, which reads and writes through
+// aligned buffers
+func TestDirectDisk(t *testing.T) {
+	disk, err := NewDirectDisk(filepath.Join(t.TempDir(), "direct.dat"), TestBlockSize)
+	if errors.Is(err, syscall.EINVAL) {
+		t.Skip("File system does not support O_DIRECT")
+	}
+	if err != nil {
+		t.Fatalf("Failed to create direct disk: %v", err)
+	}
+	defer disk.Delete()
+	testBackend(t, disk)
+
+	// A buffer that starts off the alignment boundary still works
+	buffer := make([]byte, TestBlockSize+1)[1:]
+	if err := disk.Write(5, blockPattern(5)); err != nil {
+		t.Fatalf("Failed to write block 5: %v", err)
+	}
+	if err := disk.Read(5, buffer); err != nil || !bytes.Equal(buffer, blockPattern(5)) {
+		t.Errorf("Unaligned read of block 5 returned the wrong bytes, err %v", err)
+	}
+
+	if _, err := NewDirectDisk(filepath.Join(t.TempDir(), "small.dat"), 512); err == nil {
+		t.Errorf("Direct disk accepted a 512-byte block size")
+	}
+}
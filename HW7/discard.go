@@ -0,0 +1,225 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// discardRun is the most strips a parity array discards under one set of
+// strip locks
+const discardRun = 256
+
+// discarder is implemented by devices that can free blocks, which then read
+// as zeros. Discard returns errors.ErrUnsupported if the device cannot free
+// them after all, such as a file on a file system without hole punching.
+type discarder interface {
+	Discard(blockNum, count int) error
+}
+
+// discardDevice discards count blocks from blockNum on a member device.
+// Where the device cannot discard, the blocks are written as zeros instead.
+func discardDevice(disk BlockDevice, blockNum, count, blockSize int) error {
+	err := errors.ErrUnsupported
+	if d, ok := disk.(discarder); ok {
+		err = d.Discard(blockNum, count)
+	}
+	if errors.Is(err, errors.ErrUnsupported) {
+		return writeZeros(disk, blockNum, count, blockSize)
+	}
+	return err
+}
+
+// passDiscard discards blocks on the device a wrapper wraps, returning
+// errors.ErrUnsupported if it cannot discard
+func passDiscard(disk BlockDevice, blockNum, count int) error {
+	if d, ok := disk.(discarder); ok {
+		return d.Discard(blockNum, count)
+	}
+	return errors.ErrUnsupported
+}
+
+// writeZeros writes count zero blocks from blockNum
+func writeZeros(disk BlockDevice, blockNum, count, blockSize int) error {
+	zeros := make([]byte, blockSize)
+	for i := 0; i < count; i++ {
+		if err := disk.Write(blockNum+i, zeros); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Discard punches count blocks from blockNum out of the disk file, so they
+// read as zeros and take no space. The hole is synced as the sync policy
+// says, like a write.
+func (d *Disk) Discard(blockNum, count int) error {
+	if blockNum < 0 {
+		return fmt.Errorf("%w: block %d", ErrOutOfRange, blockNum)
+	}
+	err := punchHole(d.file, int64(blockNum)*int64(d.blockSize), int64(count)*int64(d.blockSize))
+	if err != nil {
+		return err
+	}
+	return d.afterWrite()
+}
+
+// blanker is implemented by devices that can tell whether they hold any data
+type blanker interface {
+	blank() bool
+}
+
+// isBlank reports whether a member is known to hold no data. Devices that
+// cannot tell are taken to hold some.
+func isBlank(disk BlockDevice) bool {
+	b, ok := disk.(blanker)
+	return ok && b.blank()
+}
+
+// blank reports whether the disk file is empty
+func (d *Disk) blank() bool {
+	info, err := d.file.Stat()
+	return err == nil && info.Size() == 0
+}
+
+// blank reports whether the disk file is empty
+func (d *SparseDisk) blank() bool {
+	info, err := d.file.Stat()
+	return err == nil && info.Size() == 0
+}
+
+// blank reports whether no block has been written
+func (d *MemoryDisk) blank() bool {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return len(d.blocks) == 0
+}
+
+// blank reports whether the wrapped disk holds no data
+func (d *IntegrityDisk) blank() bool {
+	return isBlank(d.disk)
+}
+
+// blank reports whether the wrapped disk holds no data
+func (d *SimulatedDisk) blank() bool {
+	return isBlank(d.disk)
+}
+
+// blank reports whether the wrapped disk holds no data
+func (d *FaultyDisk) blank() bool {
+	return isBlank(d.disk)
+}
+
+// markWritten records that a strip may hold data. Must be called with mu
+// held.
+func (m *memberSet) markWritten(stripNum int) {
+	if m.written != nil && stripNum < len(m.written) {
+		m.written[stripNum] = true
+	}
+}
+
+// inUse reports whether a strip may hold data. Strips never written since
+// Initialize, or discarded since, read as zeros on every member. Must be
+// called with mu held.
+func (m *memberSet) inUse(stripNum int) bool {
+	return m.written == nil || stripNum >= len(m.written) || m.written[stripNum]
+}
+
+// unusedRun returns how many strips from stripNum on, up to limit, hold no
+// data. Must be called with mu held.
+func (m *memberSet) unusedRun(stripNum, limit int) int {
+	n := 0
+	for n < limit && stripNum+n < m.diskBlocks && !m.inUse(stripNum+n) {
+		n++
+	}
+	return n
+}
+
+// arrayFailed reports whether more members have failed than the redundancy
+// covers. Must be called with mu held.
+func (m *memberSet) arrayFailed() bool {
+	lost := 0
+	for _, failed := range m.failed {
+		if failed {
+			lost++
+		}
+	}
+	return lost > maxMissing(m.level, len(m.disks))
+}
+
+// discardBlocks discards a run of blocks on an array with dataDisks data
+// chunks of chunkBlocks blocks per stripe. Stripes the run covers completely
+// are discarded on every member, parity included, since the parity of zero
+// blocks is zero. Blocks in partial stripes at either end are written as
+// zeros with writeZero, which keeps the parity right. Must be called between
+// stripes.enter and stripes.exit.
+func (m *memberSet) discardBlocks(blockSize, dataDisks, chunkBlocks, blockNum, count int,
+	writeZero func(blockNum int) error) error {
+	stripeBlocks := dataDisks * chunkBlocks
+	for count > 0 {
+		if blockNum%stripeBlocks != 0 || count < stripeBlocks {
+			if err := writeZero(blockNum); err != nil {
+				return err
+			}
+			blockNum++
+			count--
+			continue
+		}
+
+		// Whole stripes lie on consecutive strips, chunkBlocks each
+		stripes := min(count/stripeBlocks, max(1, discardRun/chunkBlocks))
+		_, _, stripNum := stripeLocation(blockNum, dataDisks, chunkBlocks)
+		strips := stripes * chunkBlocks
+		for i := 0; i < strips; i++ {
+			m.stripes.lock(stripNum + i)
+		}
+		m.mu.Lock()
+		err := m.discardStrips(blockSize, stripNum, strips)
+		m.mu.Unlock()
+		for i := 0; i < strips; i++ {
+			m.stripes.unlock(stripNum + i)
+		}
+		if err != nil {
+			return err
+		}
+
+		blockNum += stripes * stripeBlocks
+		count -= stripes * stripeBlocks
+	}
+	return nil
+}
+
+// discardStrips discards count strips from stripNum on every working member
+// and records them as unused. Members that fail to discard are marked failed.
+// Must be called with mu held and the strips locked.
+func (m *memberSet) discardStrips(blockSize, stripNum, count int) error {
+	disks := make([]BlockDevice, len(m.disks))
+	for i, disk := range m.disks {
+		if !m.failed[i] {
+			disks[i] = disk
+		}
+	}
+
+	errs := make([]error, len(disks))
+	m.unlocked(func() {
+		runParallel(len(disks), func(i int) error {
+			if disks[i] != nil {
+				m.countWrite()
+				errs[i] = discardDevice(disks[i], stripNum, count, blockSize)
+			}
+			return errs[i]
+		})
+	})
+
+	for i, err := range errs {
+		if err != nil && m.disks[i] == disks[i] && !m.failed[i] {
+			m.markFailed(i)
+		}
+	}
+	for i := 0; i < count && m.written != nil; i++ {
+		m.written[stripNum+i] = false
+	}
+	if m.arrayFailed() {
+		return ErrArrayFailed
+	}
+	return nil
+}
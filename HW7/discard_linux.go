@@ -0,0 +1,24 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// fallocate mode bits from linux/falloc.h
+const (
+	fallocKeepSize  = 0x01
+	fallocPunchHole = 0x02
+)
+
+// punchHole deallocates length bytes of a file from offset, leaving a hole
+// that reads as zeros without changing the file's size. It returns
+// errors.ErrUnsupported if the file system cannot punch holes.
+func punchHole(file *os.File, offset, length int64) error {
+	err := syscall.Fallocate(int(file.Fd()), fallocPunchHole|fallocKeepSize, offset, length)
+	if errors.Is(err, syscall.EOPNOTSUPP) || errors.Is(err, syscall.ENOSYS) {
+		return errors.ErrUnsupported
+	}
+	return err
+}
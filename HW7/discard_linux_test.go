@@ -0,0 +1,47 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+// allocatedBlocks returns the 512-byte blocks a file takes on disk
+func allocatedBlocks(t *testing.T, path string) int64 {
+	t.Helper()
+	var stat syscall.Stat_t
+	if err := syscall.Stat(path, &stat); err != nil {
+		t.Fatalf("Failed to stat %s: %v", path, err)
+	}
+	return stat.Blocks
+}
+
+// TestPunchHole tests that discarding blocks of a file-backed disk frees
+// their space
+func TestPunchHole(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "disk.dat")
+	disk, err := NewDiskWithBlockSize(path, TestBlockSize)
+	if err != nil {
+		t.Fatalf("Failed to create disk: %v", err)
+	}
+	defer disk.Delete()
+	disk.SetSyncPolicy(SyncPolicy{Mode: SyncNever})
+
+	for blockNum := 0; blockNum < 64; blockNum++ {
+		disk.Write(blockNum, blockPattern(blockNum))
+	}
+	disk.Flush()
+	before := allocatedBlocks(t, path)
+
+	err = disk.Discard(0, 64)
+	if errors.Is(err, errors.ErrUnsupported) {
+		t.Skip("File system cannot punch holes")
+	}
+	if err != nil {
+		t.Fatalf("Discard failed: %v", err)
+	}
+	if after := allocatedBlocks(t, path); after >= before {
+		t.Errorf("File takes %d blocks after discarding all of it, %d before", after, before)
+	}
+}
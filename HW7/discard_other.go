@@ -0,0 +1,14 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+// punchHole is unsupported where there is no fallocate, so discarded blocks
+// are written as zeros instead
+func punchHole(file *os.File, offset, length int64) error {
+	return errors.ErrUnsupported
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestDeviceDiscard tests that discarded blocks read as zeros on every kind
+// of device and that the blocks around them are untouched
+func TestDeviceDiscard(t *testing.T) {
+	dir := t.TempDir()
+	disk, err := NewDiskWithBlockSize(filepath.Join(dir, "disk.dat"), TestBlockSize)
+	if err != nil {
+		t.Fatalf("Failed to create disk: %v", err)
+	}
+	sparse, err := NewSparseDisk(filepath.Join(dir, "sparse.dat"), TestBlockSize)
+	if err != nil {
+		t.Fatalf("Failed to create sparse disk: %v", err)
+	}
+
+	for _, device := range []BlockDevice{
+		disk,
+		sparse,
+		NewMemoryDisk(TestBlockSize),
+		NewIntegrityDisk(NewMemoryDisk(TestBlockSize), TestBlockSize),
+		NewFaultyDisk(NewMemoryDisk(TestBlockSize)),
+	} {
+		for blockNum := 0; blockNum < 10; blockNum++ {
+			if err := device.Write(blockNum, blockPattern(blockNum)); err != nil {
+				t.Fatalf("%T: failed to write block %d: %v", device, blockNum, err)
+			}
+		}
+		if err := discardDevice(device, 2, 5, TestBlockSize); err != nil {
+			t.Fatalf("%T: discard failed: %v", device, err)
+		}
+
+		buffer := make([]byte, TestBlockSize)
+		for blockNum := 0; blockNum < 10; blockNum++ {
+			want := blockPattern(blockNum)
+			if blockNum >= 2 && blockNum < 7 {
+				want = make([]byte, TestBlockSize)
+			}
+			if err := device.Read(blockNum, buffer); err != nil || !bytes.Equal(buffer, want) {
+				t.Errorf("%T: block %d is wrong after discard, err %v", device, blockNum, err)
+			}
+		}
+		device.Delete()
+	}
+}
+
+// TestArrayDiscard tests that discarded blocks read as zeros on every level,
+// that parity stays right, and that the blocks survive losing a member
+func TestArrayDiscard(t *testing.T) {
+	raid10, err := NewRAID10(2, 2)
+	if err != nil {
+		t.Fatalf("Failed to create RAID10: %v", err)
+	}
+	for _, raid := range []RAID{NewRAID0(), NewRAID1(), NewRAID4(), NewRAID5(), NewRAID6(), raid10} {
+		if err := raid.Initialize(); err != nil {
+			t.Fatalf("Failed to initialize %s: %v", raid.GetName(), err)
+		}
+		writeAndVerify(t, raid, 40)
+
+		// Starts and ends part way through a stripe on every level
+		if err := raid.Discard(3, 30); err != nil {
+			t.Fatalf("%s discard failed: %v", raid.GetName(), err)
+		}
+		verify := func(when string) {
+			for blockNum := 0; blockNum < 40; blockNum++ {
+				want := blockPattern(blockNum)
+				if blockNum >= 3 && blockNum < 33 {
+					want = make([]byte, TestBlockSize)
+				}
+				data, err := raid.Read(blockNum)
+				if err != nil || !bytes.Equal(data, want) {
+					t.Errorf("%s block %d is wrong %s, err %v", raid.GetName(), blockNum, when, err)
+				}
+			}
+		}
+		verify("after discard")
+
+		if scrubber, ok := raid.(interface {
+			Scrub(opts ScrubOptions) (ScrubReport, error)
+		}); ok {
+			report, err := scrubber.Scrub(ScrubOptions{LastStrip: -1})
+			if err != nil || len(report.Mismatches) != 0 {
+				t.Errorf("%s has bad redundancy after discard: %+v, err %v", raid.GetName(), report, err)
+			}
+		}
+		if failer, ok := raid.(interface{ FailDisk(diskNum int) }); ok {
+			failer.FailDisk(0)
+			verify("with member 0 lost")
+		}
+
+		capacity := raid.GetEffectiveCapacity()
+		if err := raid.Discard(capacity-1, 2); !errors.Is(err, ErrOutOfRange) {
+			t.Errorf("%s discard past the end returned %v, expected ErrOutOfRange", raid.GetName(), err)
+		}
+		if err := raid.Discard(0, -1); !errors.Is(err, ErrOutOfRange) {
+			t.Errorf("%s discard of a negative count returned %v, expected ErrOutOfRange", raid.GetName(), err)
+		}
+		raid.CleanUp()
+	}
+}
+
+// TestDiscardSkipsUnused tests that scrub and rebuild pass over strips that
+// were never written or were discarded
+func TestDiscardSkipsUnused(t *testing.T) {
+	raid, err := NewRAID5WithGeometry(rebuildGeometry())
+	if err != nil {
+		t.Fatalf("Failed to create RAID5: %v", err)
+	}
+	if err := raid.Initialize(); err != nil {
+		t.Fatalf("Failed to initialize RAID5: %v", err)
+	}
+	defer raid.CleanUp()
+
+	// Two stripes of four blocks are written and the first is discarded,
+	// leaving strip 1 the only one in use
+	writeAndVerify(t, raid, 8)
+	if err := raid.Discard(0, 4); err != nil {
+		t.Fatalf("Discard failed: %v", err)
+	}
+
+	report, err := raid.Scrub(ScrubOptions{LastStrip: -1, SkipUnused: true})
+	if err != nil {
+		t.Fatalf("Scrub failed to start: %v", err)
+	}
+	if report.Checked != 1 || report.Unused != TestRebuildBlocks-1 {
+		t.Errorf("Scrub reported %+v, expected 1 strip checked and %d unused", report, TestRebuildBlocks-1)
+	}
+
+	raid.AddSpare(NewMemoryDisk(TestBlockSize))
+	raid.FailDisk(2)
+	if err := raid.WaitRebuild(); err != nil {
+		t.Fatalf("Rebuild failed: %v", err)
+	}
+	if status := raid.RebuildStatus(); status.Done != TestRebuildBlocks || status.Skipped != TestRebuildBlocks-1 {
+		t.Errorf("Rebuild status is %+v, expected %d blocks with %d skipped", status, TestRebuildBlocks, TestRebuildBlocks-1)
+	}
+	for blockNum := 0; blockNum < 8; blockNum++ {
+		want := blockPattern(blockNum)
+		if blockNum < 4 {
+			want = make([]byte, TestBlockSize)
+		}
+		if data, err := raid.Read(blockNum); err != nil || !bytes.Equal(data, want) {
+			t.Errorf("Block %d is wrong after rebuilding onto the spare, err %v", blockNum, err)
+		}
+	}
+}
+
+// TestCacheDiscard tests that discarding drops cached blocks, dirty ones
+// included, before they can be written back
+func TestCacheDiscard(t *testing.T) {
+	cache, raid := newTestCache(t, 8, WriteBack, time.Hour)
+	for blockNum := 0; blockNum < 4; blockNum++ {
+		cache.Write(blockNum, blockPattern(blockNum))
+	}
+	if err := cache.Discard(0, 2); err != nil {
+		t.Fatalf("Cache discard failed: %v", err)
+	}
+	if cache.DirtyBlocks() != 2 {
+		t.Errorf("%d blocks dirty after discarding 2 of 4, expected 2", cache.DirtyBlocks())
+	}
+	if err := cache.Flush(); err != nil {
+		t.Fatalf("Cache flush failed: %v", err)
+	}
+	for blockNum := 0; blockNum < 4; blockNum++ {
+		want := blockPattern(blockNum)
+		if blockNum < 2 {
+			want = make([]byte, TestBlockSize)
+		}
+		if data, err := raid.Read(blockNum); err != nil || !bytes.Equal(data, want) {
+			t.Errorf("Array block %d is wrong after discard and flush, err %v", blockNum, err)
+		}
+	}
+}
+
+// TestReinitializeKeepsStripsInUse tests that an array initialized over disk
+// files that already hold data does not treat any strip as unused
+func TestReinitializeKeepsStripsInUse(t *testing.T) {
+	g := testGeometry(t, 3, 1)
+	g.DiskBlocks = TestRebuildBlocks
+	raid, err := NewRAID5WithGeometry(g)
+	if err != nil {
+		t.Fatalf("Failed to create RAID5: %v", err)
+	}
+	if err := raid.Initialize(); err != nil {
+		t.Fatalf("Failed to initialize RAID5: %v", err)
+	}
+	writeAndVerify(t, raid, 8)
+	if err := raid.Close(); err != nil {
+		t.Fatalf("Failed to close RAID5: %v", err)
+	}
+
+	raid, err = NewRAID5WithGeometry(g)
+	if err != nil {
+		t.Fatalf("Failed to create RAID5: %v", err)
+	}
+	if err := raid.Initialize(); err != nil {
+		t.Fatalf("Failed to initialize RAID5 again: %v", err)
+	}
+	defer raid.CleanUp()
+	report, err := raid.Scrub(ScrubOptions{LastStrip: -1, SkipUnused: true})
+	if err != nil {
+		t.Fatalf("Scrub failed to start: %v", err)
+	}
+	if report.Unused != 0 || report.Checked != TestRebuildBlocks {
+		t.Errorf("Scrub over reused disk files reported %+v, expected every strip checked", report)
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// SyncMode selects when a file-backed disk syncs its writes to stable storage
+type SyncMode int
+
+const (
+	// SyncAlways syncs after every write, so a write that has returned
+	// survives a crash. This is the default.
+	SyncAlways SyncMode = iota
+	// SyncBatched syncs once SyncPolicy.Writes writes have built up, or
+	// SyncPolicy.Interval after the first write since the last sync,
+	// whichever comes first
+	SyncBatched
+	// SyncNever leaves syncing to the operating system and to Flush
+	SyncNever
+)
+
+// SyncPolicy is the durability policy of a file-backed disk. The zero value
+// syncs every write.
+type SyncPolicy struct {
+	Mode     SyncMode
+	Writes   int           // SyncBatched: sync after this many writes, 0 for no limit
+	Interval time.Duration // SyncBatched: longest a write waits for its sync, 0 for no limit
+}
+
+func (p SyncPolicy) String() string {
+	switch p.Mode {
+	case SyncNever:
+		return "never"
+	case SyncBatched:
+		switch {
+		case p.Writes > 0 && p.Interval > 0:
+			return fmt.Sprintf("every %d writes or %v", p.Writes, p.Interval)
+		case p.Writes > 0:
+			return fmt.Sprintf("every %d writes", p.Writes)
+		case p.Interval > 0:
+			return fmt.Sprintf("every %v", p.Interval)
+		}
+		return "on flush"
+	}
+	return "always"
+}
+
+// flushable is implemented by devices and arrays that can make their completed
+// writes durable
+type flushable interface {
+	Flush() error
+}
+
+// flushDevice flushes a member device. Devices with nothing to sync, such
+// as MemoryDisk, do not implement flushable.
+func flushDevice(disk BlockDevice) error {
+	if f, ok := disk.(flushable); ok {
+		return f.Flush()
+	}
+	return nil
+}
+
+// flushDisks flushes disks concurrently, skipping nil ones, and returns each
+// disk's error
+func flushDisks(disks []BlockDevice) []error {
+	errs := make([]error, len(disks))
+	runParallel(len(disks), func(i int) error {
+		if disks[i] != nil {
+			errs[i] = flushDevice(disks[i])
+		}
+		return errs[i]
+	})
+	return errs
+}
+
+// Flush syncs every working member, so every write that has returned is
+// durable. A member that fails to sync is marked failed like any other disk
+// error; the flush only fails if that leaves more members lost than the
+// redundancy covers.
+func (m *memberSet) Flush() error {
+	m.mu.Lock()
+	disks := make([]BlockDevice, len(m.disks))
+	for i, disk := range m.disks {
+		if !m.failed[i] {
+			disks[i] = disk
+		}
+	}
+	m.mu.Unlock()
+
+	errs := flushDisks(disks)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var first error
+	for i, err := range errs {
+		if err == nil {
+			continue
+		}
+		if m.disks[i] == disks[i] && !m.failed[i] {
+			m.markFailed(i)
+		}
+		if first == nil {
+			first = &ErrDiskFailed{Disk: i, Err: err}
+		}
+	}
+	if first != nil && m.arrayFailed() {
+		return fmt.Errorf("%w: %w", ErrArrayFailed, first)
+	}
+	return nil
+}
+
+// SetSyncPolicy sets when the disk syncs its writes. Writes left unsynced by
+// the old policy are synced first.
+func (d *Disk) SetSyncPolicy(policy SyncPolicy) error {
+	err := d.Flush()
+	d.syncMu.Lock()
+	d.policy = policy
+	d.syncMu.Unlock()
+	return err
+}
+
+// afterWrite applies the sync policy to a write that has just completed
+func (d *Disk) afterWrite() error {
+	d.syncMu.Lock()
+	switch d.policy.Mode {
+	case SyncAlways:
+		d.syncMu.Unlock()
+		return d.file.Sync()
+	case SyncNever:
+		d.syncMu.Unlock()
+		return nil
+	}
+
+	d.unsynced++
+	if d.policy.Writes > 0 && d.unsynced >= d.policy.Writes {
+		d.syncMu.Unlock()
+		return d.Flush()
+	}
+	if d.policy.Interval > 0 && d.syncTimer == nil {
+		d.syncTimer = time.AfterFunc(d.policy.Interval, d.flushLater)
+	}
+	d.syncMu.Unlock()
+	return nil
+}
+
+// flushLater is run by the sync timer. There is no caller to return an error
+// to, so the next Flush returns it.
+func (d *Disk) flushLater() {
+	if err := d.Flush(); err != nil {
+		d.syncMu.Lock()
+		d.syncErr = err
+		d.syncMu.Unlock()
+	}
+}
+
+// Flush syncs the disk, so every write that has returned is durable,
+// whatever the sync policy
+func (d *Disk) Flush() error {
+	d.syncMu.Lock()
+	d.unsynced = 0
+	if d.syncTimer != nil {
+		d.syncTimer.Stop()
+		d.syncTimer = nil
+	}
+	err := d.syncErr
+	d.syncErr = nil
+	d.syncMu.Unlock()
+
+	if syncErr := d.file.Sync(); syncErr != nil {
+		return syncErr
+	}
+	return err
+}
+
+// stopSync stops the sync timer before the file is closed. If flush is set,
+// writes the batched policy has not synced yet are synced first.
+func (d *Disk) stopSync(flush bool) error {
+	d.syncMu.Lock()
+	pending := d.unsynced > 0
+	d.unsynced = 0
+	if d.syncTimer != nil {
+		d.syncTimer.Stop()
+		d.syncTimer = nil
+	}
+	d.syncMu.Unlock()
+	if flush && pending {
+		return d.file.Sync()
+	}
+	return nil
+}
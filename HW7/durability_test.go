@@ -0,0 +1,180 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// pendingSyncs returns the writes a disk has not synced yet and whether a
+// timed sync is waiting
+func pendingSyncs(d *Disk) (int, bool) {
+	d.syncMu.Lock()
+	defer d.syncMu.Unlock()
+	return d.unsynced, d.syncTimer != nil
+}
+
+// TestSyncPolicy tests when a file-backed disk syncs under each policy
+func TestSyncPolicy(t *testing.T) {
+	disk, err := NewDiskWithBlockSize(filepath.Join(t.TempDir(), "disk.dat"), TestBlockSize)
+	if err != nil {
+		t.Fatalf("Failed to create disk: %v", err)
+	}
+	defer disk.Delete()
+
+	// A batch is synced on its fourth write
+	disk.SetSyncPolicy(SyncPolicy{Mode: SyncBatched, Writes: 4})
+	for blockNum := 0; blockNum < 3; blockNum++ {
+		disk.Write(blockNum, blockPattern(blockNum))
+	}
+	if n, _ := pendingSyncs(disk); n != 3 {
+		t.Errorf("%d writes pending after 3 batched writes, expected 3", n)
+	}
+	disk.Write(3, blockPattern(3))
+	if n, _ := pendingSyncs(disk); n != 0 {
+		t.Errorf("%d writes pending after a full batch, expected 0", n)
+	}
+
+	// A timed sync catches writes that never fill a batch
+	disk.SetSyncPolicy(SyncPolicy{Mode: SyncBatched, Writes: 100, Interval: 10 * time.Millisecond})
+	disk.Write(4, blockPattern(4))
+	if n, timed := pendingSyncs(disk); n != 1 || !timed {
+		t.Errorf("Write left %d pending, timer %v; expected 1 pending with a timer", n, timed)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if n, timed := pendingSyncs(disk); n != 0 || timed {
+		t.Errorf("%d writes still pending, timer %v, after the interval", n, timed)
+	}
+
+	// Without automatic syncs, Flush is the barrier
+	disk.SetSyncPolicy(SyncPolicy{Mode: SyncNever})
+	disk.Write(5, blockPattern(5))
+	if err := disk.Flush(); err != nil {
+		t.Errorf("Flush failed: %v", err)
+	}
+	testBackend(t, disk)
+
+	for _, c := range []struct {
+		policy SyncPolicy
+		want   string
+	}{
+		{SyncPolicy{}, "always"},
+		{SyncPolicy{Mode: SyncBatched, Writes: 64}, "every 64 writes"},
+		{SyncPolicy{Mode: SyncBatched, Interval: time.Second}, "every 1s"},
+		{SyncPolicy{Mode: SyncNever}, "never"},
+	} {
+		if got := c.policy.String(); got != c.want {
+			t.Errorf("Policy %+v prints as %q, expected %q", c.policy, got, c.want)
+		}
+	}
+}
+
+// TestGeometrySync tests that an array gives its file-backed members the
+// geometry's sync policy
+func TestGeometrySync(t *testing.T) {
+	g := testGeometry(t, 3, 1)
+	g.Sync = SyncPolicy{Mode: SyncBatched, Writes: 16}
+	raid, err := NewRAID5WithGeometry(g)
+	if err != nil {
+		t.Fatalf("Failed to create RAID5: %v", err)
+	}
+	if err := raid.Initialize(); err != nil {
+		t.Fatalf("Failed to initialize RAID5: %v", err)
+	}
+	defer raid.CleanUp()
+
+	if raid.Geometry().Sync != g.Sync {
+		t.Errorf("Geometry has sync policy %v, expected %v", raid.Geometry().Sync, g.Sync)
+	}
+	for i, disk := range raid.disks {
+		if d, ok := disk.(*Disk); !ok || d.policy != g.Sync {
+			t.Errorf("Member %d does not have the geometry's sync policy", i)
+		}
+	}
+	writeAndVerify(t, raid, 40)
+	if err := raid.Flush(); err != nil {
+		t.Errorf("Flush failed: %v", err)
+	}
+	for i, disk := range raid.disks {
+		if n, _ := pendingSyncs(disk.(*Disk)); n != 0 {
+			t.Errorf("Member %d has %d writes pending after Flush", i, n)
+		}
+	}
+}
+
+// TestArrayFlush tests that flushing reaches every member, and that members
+// that fail to flush are handled like any other disk failure
+func TestArrayFlush(t *testing.T) {
+	raid0 := NewRAID0()
+	if err := raid0.Initialize(); err != nil {
+		t.Fatalf("Failed to initialize RAID0: %v", err)
+	}
+	defer raid0.CleanUp()
+	faulty := injectFaults(raid0.disks)
+	if err := raid0.Flush(); err != nil {
+		t.Errorf("RAID0 flush failed: %v", err)
+	}
+	faulty[2].Kill()
+	var diskErr *ErrDiskFailed
+	if err := raid0.Flush(); !errors.As(err, &diskErr) || diskErr.Disk != 2 {
+		t.Errorf("RAID0 flush with dead disk 2 returned %v, expected ErrDiskFailed for disk 2", err)
+	}
+
+	// One member failing to flush degrades RAID5; a second fails it
+	raid5 := NewRAID5()
+	if err := raid5.Initialize(); err != nil {
+		t.Fatalf("Failed to initialize RAID5: %v", err)
+	}
+	defer raid5.CleanUp()
+	faulty = injectFaults(raid5.disks)
+	writeAndVerify(t, raid5, 10)
+	faulty[0].Kill()
+	if err := raid5.Flush(); err != nil {
+		t.Errorf("RAID5 flush with one dead member failed: %v", err)
+	}
+	if !raid5.failed[0] {
+		t.Errorf("Member 0 failed to flush but was not marked failed")
+	}
+	verifyBlocks(t, raid5, 10)
+	faulty[1].Kill()
+	if err := raid5.Flush(); !errors.Is(err, ErrArrayFailed) {
+		t.Errorf("RAID5 flush with two dead members returned %v, expected ErrArrayFailed", err)
+	}
+
+	// Nested arrays and volumes flush through to the bottom
+	raid10, err := NewRAID10(2, 2)
+	if err != nil {
+		t.Fatalf("Failed to create RAID10: %v", err)
+	}
+	if err := raid10.Initialize(); err != nil {
+		t.Fatalf("Failed to initialize RAID10: %v", err)
+	}
+	defer raid10.CleanUp()
+	if err := NewVolume(raid10).Sync(); err != nil {
+		t.Errorf("RAID10 volume sync failed: %v", err)
+	}
+}
+
+// TestCacheFlushBarrier tests that flushing a write-back cache writes its
+// dirty blocks back and flushes the array beneath it
+func TestCacheFlushBarrier(t *testing.T) {
+	cache, raid := newTestCache(t, 8, WriteBack, time.Hour)
+	for blockNum := 0; blockNum < 4; blockNum++ {
+		cache.Write(blockNum, blockPattern(blockNum))
+	}
+	faulty := injectFaults(raid.disks)
+	if err := cache.Flush(); err != nil {
+		t.Fatalf("Cache flush failed: %v", err)
+	}
+	if cache.DirtyBlocks() != 0 {
+		t.Errorf("%d blocks still dirty after Flush", cache.DirtyBlocks())
+	}
+	verifyBlocks(t, raid, 4)
+
+	faulty[0].Kill()
+	faulty[1].Kill()
+	if err := cache.Flush(); !errors.Is(err, ErrArrayFailed) {
+		t.Errorf("Cache flush over a failed array returned %v, expected ErrArrayFailed", err)
+	}
+}
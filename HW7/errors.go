@@ -0,0 +1,82 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Errors returned by arrays and devices. A bad request (ErrOutOfRange,
+// ErrBlockSize) can be told apart from a hardware fault (ErrDiskFailed,
+// ErrArrayFailed, ErrChecksum) with errors.Is and errors.As.
+var (
+	// ErrOutOfRange is returned for a block number outside an array or
+	// device
+	ErrOutOfRange = errors.New("block number out of range")
+
+	// ErrBlockSize is returned for data that is not one block, or a whole
+	// number of blocks where a run is expected
+	ErrBlockSize = errors.New("data size does not match block size")
+
+	// ErrArrayFailed is returned when more member disks have failed than the
+	// redundancy can cover
+	ErrArrayFailed = errors.New("array has failed: too many member disks lost")
+
+	// ErrDegraded is returned by operations that need every member working,
+	// such as a reshape, while a member has failed or is being rebuilt
+	ErrDegraded = errors.New("array is degraded")
+)
+
+// ErrDiskFailed reports an I/O error on a member disk. Arrays with
+// redundancy mark the disk failed and carry on; RAID0 returns the error.
+type ErrDiskFailed struct {
+	Disk int   // Member index
+	Err  error // Error from the disk
+}
+
+func (e *ErrDiskFailed) Error() string {
+	return fmt.Sprintf("disk %d failed: %v", e.Disk, e.Err)
+}
+
+func (e *ErrDiskFailed) Unwrap() error {
+	return e.Err
+}
+
+// checkBlock returns ErrOutOfRange unless blockNum is one of capacity blocks
+func checkBlock(blockNum, capacity int) error {
+	if blockNum < 0 || blockNum >= capacity {
+		return fmt.Errorf("%w: block %d of %d", ErrOutOfRange, blockNum, capacity)
+	}
+	return nil
+}
+
+// checkData returns ErrBlockSize unless data is exactly one block
+func checkData(data []byte, blockSize int) error {
+	if len(data) != blockSize {
+		return fmt.Errorf("%w: %d bytes for a %d-byte block", ErrBlockSize, len(data), blockSize)
+	}
+	return nil
+}
+
+// checkRun checks a write of whole blocks starting at blockNum, all of which
+// must lie within capacity blocks
+func checkRun(blockNum int, data []byte, blockSize, capacity int) error {
+	if len(data)%blockSize != 0 {
+		return fmt.Errorf("%w: %d bytes is not a whole number of %d-byte blocks", ErrBlockSize, len(data), blockSize)
+	}
+	return checkExtent(blockNum, len(data)/blockSize, capacity)
+}
+
+// checkExtent checks count blocks starting at blockNum, all of which must lie
+// within capacity blocks
+func checkExtent(blockNum, count, capacity int) error {
+	if count < 0 {
+		return fmt.Errorf("%w: negative count %d", ErrOutOfRange, count)
+	}
+	if count == 0 {
+		return nil
+	}
+	if err := checkBlock(blockNum, capacity); err != nil {
+		return err
+	}
+	return checkBlock(blockNum+count-1, capacity)
+}
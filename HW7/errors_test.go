@@ -0,0 +1,88 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+// TestRangeErrors tests that every level rejects blocks outside the array and
+// data that is not a whole block
+func TestRangeErrors(t *testing.T) {
+	for _, raid := range []RAID{NewRAID0(), NewRAID1(), NewRAID4(), NewRAID5(), NewRAID6()} {
+		if err := raid.Initialize(); err != nil {
+			t.Fatalf("Failed to initialize %s: %v", raid.GetName(), err)
+		}
+		capacity := raid.GetEffectiveCapacity()
+
+		for _, blockNum := range []int{-1, capacity, capacity + 100} {
+			if _, err := raid.Read(blockNum); !errors.Is(err, ErrOutOfRange) {
+				t.Errorf("%s read of block %d returned %v, expected ErrOutOfRange", raid.GetName(), blockNum, err)
+			}
+			if err := raid.Write(blockNum, blockPattern(0)); !errors.Is(err, ErrOutOfRange) {
+				t.Errorf("%s write of block %d returned %v, expected ErrOutOfRange", raid.GetName(), blockNum, err)
+			}
+		}
+		if err := raid.Write(capacity-1, blockPattern(1)); err != nil {
+			t.Errorf("%s write of the last block failed: %v", raid.GetName(), err)
+		}
+
+		if err := raid.Write(0, make([]byte, TestBlockSize-1)); !errors.Is(err, ErrBlockSize) {
+			t.Errorf("%s short write returned %v, expected ErrBlockSize", raid.GetName(), err)
+		}
+
+		// A run must fit inside the array and be whole blocks
+		run := append(blockPattern(0), blockPattern(1)...)
+		if err := WriteBlocks(raid, capacity-1, run, TestBlockSize); !errors.Is(err, ErrOutOfRange) {
+			t.Errorf("%s run past the end returned %v, expected ErrOutOfRange", raid.GetName(), err)
+		}
+		if err := WriteBlocks(raid, 0, run[1:], TestBlockSize); !errors.Is(err, ErrBlockSize) {
+			t.Errorf("%s partial-block run returned %v, expected ErrBlockSize", raid.GetName(), err)
+		}
+		raid.CleanUp()
+	}
+}
+
+// TestDiskErrors tests that disk and array failures can be told apart with
+// errors.Is and errors.As
+func TestDiskErrors(t *testing.T) {
+	raid0 := NewRAID0()
+	if err := raid0.Initialize(); err != nil {
+		t.Fatalf("Failed to initialize RAID0: %v", err)
+	}
+	defer raid0.CleanUp()
+	faulty := injectFaults(raid0.disks)
+	faulty[1].Kill()
+
+	_, err := raid0.Read(1)
+	var diskErr *ErrDiskFailed
+	if !errors.As(err, &diskErr) || diskErr.Disk != 1 {
+		t.Errorf("RAID0 read from dead disk 1 returned %v, expected ErrDiskFailed for disk 1", err)
+	}
+	if !errors.Is(err, errInjectedFault) {
+		t.Errorf("ErrDiskFailed does not wrap the disk's error: %v", err)
+	}
+
+	raid5 := NewRAID5()
+	if err := raid5.Initialize(); err != nil {
+		t.Fatalf("Failed to initialize RAID5: %v", err)
+	}
+	defer raid5.CleanUp()
+
+	// One lost member leaves the array degraded, too degraded to grow
+	raid5.FailDisk(0)
+	if err := raid5.Grow(); !errors.Is(err, ErrDegraded) {
+		t.Errorf("Growing a degraded RAID5 returned %v, expected ErrDegraded", err)
+	}
+	if _, err := raid5.Read(0); err != nil {
+		t.Errorf("Degraded RAID5 read failed: %v", err)
+	}
+
+	// A second lost member fails the array: blocks 0 and 1, on the lost
+	// members, cannot be rebuilt
+	raid5.FailDisk(1)
+	for blockNum := 0; blockNum < 2; blockNum++ {
+		if _, err := raid5.Read(blockNum); !errors.Is(err, ErrArrayFailed) {
+			t.Errorf("RAID5 read of block %d with two lost members returned %v, expected ErrArrayFailed", blockNum, err)
+		}
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// errInjectedFault is returned by a FaultyDisk when an injected fault fires
+var errInjectedFault = errors.New("injected disk fault")
+
+// FaultKind selects what an injected fault does to an operation
+type FaultKind int
+
+const (
+	FaultError   FaultKind = iota // Fail the operation with an I/O error
+	FaultCorrupt                  // Silently flip bits in the data
+	FaultLatency                  // Delay the operation
+)
+
+// FaultOp selects which operations a fault applies to
+type FaultOp int
+
+const (
+	FaultOnRead  FaultOp = 1 << iota // Apply the fault to reads
+	FaultOnWrite                     // Apply the fault to writes
+	FaultOnAny   = FaultOnRead | FaultOnWrite
+)
+
+// Fault describes one injected fault. It applies to blocks FirstBlock through
+// LastBlock inclusive; a negative LastBlock means every block from FirstBlock
+// to the end of the disk.
+type Fault struct {
+	Kind       FaultKind
+	Ops        FaultOp
+	FirstBlock int
+	LastBlock  int
+	Latency    time.Duration // Only used by FaultLatency
+}
+
+// matches reports whether the fault covers an operation on a block
+func (f *Fault) matches(op FaultOp, blockNum int) bool {
+	if f.Ops&op == 0 || blockNum < f.FirstBlock {
+		return false
+	}
+	return f.LastBlock < 0 || blockNum <= f.LastBlock
+}
+
+// FaultyDisk wraps a BlockDevice and injects failures into its reads and
+// writes, so tests can simulate dead drives, latent sector errors, silent
+// corruption and slow disks
+type FaultyDisk struct {
+	disk      BlockDevice
+	mu        sync.Mutex
+	faults    []Fault
+	dead      bool
+	ops       int // Reads and writes seen so far
+	failAfter int // Disk dies on this operation number, 0 if unset
+}
+
+// NewFaultyDisk wraps a disk with no faults configured
+func NewFaultyDisk(disk BlockDevice) *FaultyDisk {
+	return &FaultyDisk{disk: disk}
+}
+
+// AddFault adds a fault that applies to every later matching operation
+func (f *FaultyDisk) AddFault(fault Fault) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.faults = append(f.faults, fault)
+}
+
+// FailBlocks makes reads and writes to a block range return errors, like a
+// latent sector error
+func (f *FaultyDisk) FailBlocks(firstBlock, lastBlock int) {
+	f.AddFault(Fault{Kind: FaultError, Ops: FaultOnAny, FirstBlock: firstBlock, LastBlock: lastBlock})
+}
+
+// CorruptBlocks makes reads from a block range return silently corrupted data
+func (f *FaultyDisk) CorruptBlocks(firstBlock, lastBlock int) {
+	f.AddFault(Fault{Kind: FaultCorrupt, Ops: FaultOnRead, FirstBlock: firstBlock, LastBlock: lastBlock})
+}
+
+// SetLatency delays every read and write on the disk
+func (f *FaultyDisk) SetLatency(latency time.Duration) {
+	f.AddFault(Fault{Kind: FaultLatency, Ops: FaultOnAny, LastBlock: -1, Latency: latency})
+}
+
+// FailAfter makes the whole disk fail permanently on its Nth operation from
+// now, counting both reads and writes
+func (f *FaultyDisk) FailAfter(n int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.failAfter = f.ops + n
+}
+
+// Kill permanently fails the whole disk
+func (f *FaultyDisk) Kill() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.dead = true
+}
+
+// Clear removes every fault and brings a killed disk back
+func (f *FaultyDisk) Clear() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.faults = nil
+	f.dead = false
+	f.failAfter = 0
+}
+
+// inject counts an operation and returns the faults that apply to it. It
+// returns errInjectedFault if the operation must fail outright.
+func (f *FaultyDisk) inject(op FaultOp, blockNum int) (latency time.Duration, corrupt bool, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.ops++
+	if f.failAfter > 0 && f.ops >= f.failAfter {
+		f.dead = true
+	}
+	if f.dead {
+		return 0, false, errInjectedFault
+	}
+
+	for i := range f.faults {
+		fault := &f.faults[i]
+		if !fault.matches(op, blockNum) {
+			continue
+		}
+		switch fault.Kind {
+		case FaultError:
+			err = errInjectedFault
+		case FaultCorrupt:
+			corrupt = true
+		case FaultLatency:
+			latency += fault.Latency
+		}
+	}
+	return latency, corrupt, err
+}
+
+// corrupt flips bits in a copy of the data so the caller's buffer is untouched
+func corrupt(data []byte) []byte {
+	bad := make([]byte, len(data))
+	copy(bad, data)
+	for i := 0; i < len(bad); i += 512 {
+		bad[i] ^= 0xFF
+	}
+	return bad
+}
+
+// Read reads a block from the wrapped disk, applying any matching faults
+func (f *FaultyDisk) Read(blockNum int, buffer []byte) error {
+	latency, bad, err := f.inject(FaultOnRead, blockNum)
+	time.Sleep(latency)
+	if err != nil {
+		return err
+	}
+
+	err = f.disk.Read(blockNum, buffer)
+	if err != nil {
+		return err
+	}
+	if bad {
+		copy(buffer, corrupt(buffer))
+	}
+	return nil
+}
+
+// Write writes a block to the wrapped disk, applying any matching faults
+func (f *FaultyDisk) Write(blockNum int, data []byte) error {
+	latency, bad, err := f.inject(FaultOnWrite, blockNum)
+	time.Sleep(latency)
+	if err != nil {
+		return err
+	}
+
+	if bad {
+		data = corrupt(data)
+	}
+	return f.disk.Write(blockNum, data)
+}
+
+// Flush flushes the wrapped disk. A killed disk fails the flush.
+func (f *FaultyDisk) Flush() error {
+	f.mu.Lock()
+	dead := f.dead
+	f.mu.Unlock()
+	if dead {
+		return errInjectedFault
+	}
+	return flushDevice(f.disk)
+}
+
+// Discard discards blocks on the wrapped disk, applying any write faults that
+// match the first block
+func (f *FaultyDisk) Discard(blockNum, count int) error {
+	latency, _, err := f.inject(FaultOnWrite, blockNum)
+	time.Sleep(latency)
+	if err != nil {
+		return err
+	}
+	return passDiscard(f.disk, blockNum, count)
+}
+
+// Close closes the wrapped disk
+func (f *FaultyDisk) Close() error {
+	return f.disk.Close()
+}
+
+// Delete deletes the wrapped disk
+func (f *FaultyDisk) Delete() error {
+	return f.disk.Delete()
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+// injectFaults wraps every member disk of an initialized array in a FaultyDisk
+func injectFaults(disks []BlockDevice) []*FaultyDisk {
+	faulty := make([]*FaultyDisk, len(disks))
+	for i, disk := range disks {
+		faulty[i] = NewFaultyDisk(disk)
+		disks[i] = faulty[i]
+	}
+	return faulty
+}
+
+// TestFaultyDisk tests each kind of injected fault on a single disk
+func TestFaultyDisk(t *testing.T) {
+	faulty := NewFaultyDisk(NewMemoryDisk(TestBlockSize))
+	defer faulty.Delete()
+
+	buffer := make([]byte, TestBlockSize)
+
+	// Latent sector error on blocks 2-3 only
+	faulty.FailBlocks(2, 3)
+	if err := faulty.Write(1, blockPattern(1)); err != nil {
+		t.Errorf("Write outside failed range returned error: %v", err)
+	}
+	if err := faulty.Read(2, buffer); err == nil {
+		t.Errorf("Expected read of failed block 2 to return an error")
+	}
+	if err := faulty.Write(3, blockPattern(3)); err == nil {
+		t.Errorf("Expected write of failed block 3 to return an error")
+	}
+
+	// Silent corruption returns bad data with no error
+	faulty.Clear()
+	faulty.CorruptBlocks(1, 1)
+	if err := faulty.Read(1, buffer); err != nil {
+		t.Fatalf("Corrupted read returned error: %v", err)
+	}
+	if bytes.Equal(buffer, blockPattern(1)) {
+		t.Errorf("Expected corrupted read to return different data")
+	}
+
+	// Latency is added to every operation
+	faulty.Clear()
+	faulty.SetLatency(20 * time.Millisecond)
+	start := time.Now()
+	if err := faulty.Read(1, buffer); err != nil {
+		t.Fatalf("Slow read returned error: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 20*time.Millisecond {
+		t.Errorf("Expected read to take at least 20ms, took %v", elapsed)
+	}
+
+	// The disk dies on its third operation and stays dead
+	faulty.Clear()
+	faulty.FailAfter(3)
+	for op := 1; op <= 4; op++ {
+		err := faulty.Read(1, buffer)
+		if op < 3 && err != nil {
+			t.Errorf("Operation %d failed before the disk should die: %v", op, err)
+		}
+		if op >= 3 && err == nil {
+			t.Errorf("Operation %d succeeded after the disk should have died", op)
+		}
+	}
+}
+
+// TestRAID0DiskFailure tests that RAID0 loses the blocks on a dead disk
+func TestRAID0DiskFailure(t *testing.T) {
+	raid := NewRAID0()
+	err := raid.Initialize()
+	if err != nil {
+		t.Fatalf("Failed to initialize RAID0: %v", err)
+	}
+	defer raid.CleanUp()
+	faulty := injectFaults(raid.disks)
+
+	for blockNum := 0; blockNum < 10; blockNum++ {
+		if err := raid.Write(blockNum, blockPattern(blockNum)); err != nil {
+			t.Fatalf("Failed to write to RAID0 block %d: %v", blockNum, err)
+		}
+	}
+
+	faulty[1].Kill()
+	if _, err := raid.Read(1); err == nil {
+		t.Errorf("Expected RAID0 read from dead disk to fail")
+	}
+	readData, err := raid.Read(0)
+	if err != nil || !bytes.Equal(readData, blockPattern(0)) {
+		t.Errorf("RAID0 read from healthy disk failed: %v", err)
+	}
+}
+
+// TestRAID1MirrorFailure tests that RAID1 reads survive a dead mirror
+func TestRAID1MirrorFailure(t *testing.T) {
+	raid := NewRAID1()
+	err := raid.Initialize()
+	if err != nil {
+		t.Fatalf("Failed to initialize RAID1: %v", err)
+	}
+	defer raid.CleanUp()
+	faulty := injectFaults(raid.disks)
+
+	for blockNum := 0; blockNum < 10; blockNum++ {
+		if err := raid.Write(blockNum, blockPattern(blockNum)); err != nil {
+			t.Fatalf("Failed to write to RAID1 block %d: %v", blockNum, err)
+		}
+	}
+
+	faulty[3].Kill()
+	for blockNum := 0; blockNum < 10; blockNum++ {
+		readData, err := raid.Read(blockNum)
+		if err != nil || !bytes.Equal(readData, blockPattern(blockNum)) {
+			t.Errorf("RAID1 read of block %d failed with a dead mirror: %v", blockNum, err)
+		}
+	}
+}
+
+// TestRAID4LatentSectorError tests that a bad block is rebuilt from parity
+func TestRAID4LatentSectorError(t *testing.T) {
+	raid := NewRAID4()
+	err := raid.Initialize()
+	if err != nil {
+		t.Fatalf("Failed to initialize RAID4: %v", err)
+	}
+	defer raid.CleanUp()
+	faulty := injectFaults(raid.disks)
+
+	for blockNum := 0; blockNum < 20; blockNum++ {
+		if err := raid.Write(blockNum, blockPattern(blockNum)); err != nil {
+			t.Fatalf("Failed to write to RAID4 block %d: %v", blockNum, err)
+		}
+	}
+
+	// Strip 2 of disk 0 holds logical block 8
+	faulty[0].AddFault(Fault{Kind: FaultError, Ops: FaultOnRead, FirstBlock: 2, LastBlock: 2})
+	readData, err := raid.Read(8)
+	if err != nil {
+		t.Fatalf("Failed to read RAID4 block 8 with a latent sector error: %v", err)
+	}
+	if !bytes.Equal(readData, blockPattern(8)) {
+		t.Errorf("Data mismatch in rebuilt RAID4 block 8")
+	}
+}
+
+// TestRAID5DiskDiesMidWrite tests that RAID5 keeps working when a disk dies
+// part way through a sequence of writes
+func TestRAID5DiskDiesMidWrite(t *testing.T) {
+	raid := NewRAID5()
+	err := raid.Initialize()
+	if err != nil {
+		t.Fatalf("Failed to initialize RAID5: %v", err)
+	}
+	defer raid.CleanUp()
+	faulty := injectFaults(raid.disks)
+
+	faulty[2].FailAfter(7)
+	for blockNum := 0; blockNum < 20; blockNum++ {
+		if err := raid.Write(blockNum, blockPattern(blockNum)); err != nil {
+			t.Fatalf("Failed to write to RAID5 block %d: %v", blockNum, err)
+		}
+	}
+
+	if !raid.failed[2] {
+		t.Errorf("Expected RAID5 to mark disk 2 failed")
+	}
+	for blockNum := 0; blockNum < 20; blockNum++ {
+		readData, err := raid.Read(blockNum)
+		if err != nil {
+			t.Fatalf("Failed to read RAID5 block %d: %v", blockNum, err)
+		}
+		if !bytes.Equal(readData, blockPattern(blockNum)) {
+			t.Errorf("Data mismatch in RAID5 block %d after disk failure", blockNum)
+		}
+	}
+}
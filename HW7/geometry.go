@@ -0,0 +1,100 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Geometry describes the shape of an array
+type Geometry struct {
+	NumDisks    int        // Member disks in the array
+	BlockSize   int        // Bytes per block
+	DiskBlocks  int        // Blocks on each member disk
+	ChunkBlocks int        // Stripe unit: blocks placed on one disk before moving to the next
+	Dir         string     // Directory for the disk%d.dat files, "" for the working directory
+	Integrity   bool       // Store and verify a checksum with every block
+	Backend     Backend    // Kind of device created for each member
+	Sync        SyncPolicy // When file-backed members sync their writes
+}
+
+// DefaultGeometry returns the geometry built from the package constants
+func DefaultGeometry() Geometry {
+	return Geometry{
+		NumDisks:    NumDisks,
+		BlockSize:   BlockSize,
+		DiskBlocks:  NumBlocks,
+		ChunkBlocks: 1,
+		Backend:     DefaultBackend,
+	}
+}
+
+// validate checks that the geometry is usable for a RAID level that needs at
+// least minDisks member disks
+func (g Geometry) validate(level string, minDisks int) error {
+	switch {
+	case g.NumDisks < minDisks:
+		return fmt.Errorf("%s needs at least %d disks, got %d", level, minDisks, g.NumDisks)
+	case g.BlockSize < superblockSize:
+		return fmt.Errorf("block size must be at least %d bytes to hold the superblock", superblockSize)
+	case g.DiskBlocks <= 0:
+		return errors.New("disk size must be positive")
+	case g.ChunkBlocks <= 0:
+		return errors.New("chunk size must be positive")
+	case g.DiskBlocks%g.ChunkBlocks != 0:
+		return fmt.Errorf("disk size of %d blocks is not a whole number of %d-block chunks",
+			g.DiskBlocks, g.ChunkBlocks)
+	}
+	return nil
+}
+
+// stripeLocation maps a logical block onto a striped layout with dataDisks
+// data chunks per stripe. It returns the stripe, the data slot within the
+// stripe, and the row: the block number on the member disk.
+func stripeLocation(blockNum, dataDisks, chunkBlocks int) (stripe, slot, row int) {
+	chunk := blockNum / chunkBlocks
+	stripe = chunk / dataDisks
+	slot = chunk % dataDisks
+	row = stripe*chunkBlocks + blockNum%chunkBlocks
+	return stripe, slot, row
+}
+
+// NewRAID0WithGeometry creates a RAID0 array with the given geometry
+func NewRAID0WithGeometry(g Geometry) (*RAID0, error) {
+	if err := g.validate("RAID0", 2); err != nil {
+		return nil, err
+	}
+	return newRAID0(g), nil
+}
+
+// NewRAID1WithGeometry creates a RAID1 array with the given geometry. Chunk
+// size has no effect on mirroring.
+func NewRAID1WithGeometry(g Geometry) (*RAID1, error) {
+	if err := g.validate("RAID1", 2); err != nil {
+		return nil, err
+	}
+	return newRAID1(g), nil
+}
+
+// NewRAID4WithGeometry creates a RAID4 array with the given geometry
+func NewRAID4WithGeometry(g Geometry) (*RAID4, error) {
+	if err := g.validate("RAID4", 3); err != nil {
+		return nil, err
+	}
+	return newRAID4(g), nil
+}
+
+// NewRAID5WithGeometry creates a RAID5 array with the given geometry
+func NewRAID5WithGeometry(g Geometry) (*RAID5, error) {
+	if err := g.validate("RAID5", 3); err != nil {
+		return nil, err
+	}
+	return newRAID5(g), nil
+}
+
+// NewRAID6WithGeometry creates a RAID6 array with the given geometry
+func NewRAID6WithGeometry(g Geometry) (*RAID6, error) {
+	if err := g.validate("RAID6", 4); err != nil {
+		return nil, err
+	}
+	return newRAID6(g), nil
+}
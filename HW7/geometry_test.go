@@ -0,0 +1,304 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testGeometry returns a geometry whose disks live in a temporary directory
+func testGeometry(t *testing.T, numDisks, chunkBlocks int) Geometry {
+	return Geometry{
+		NumDisks:    numDisks,
+		BlockSize:   TestBlockSize,
+		DiskBlocks:  NumBlocks,
+		ChunkBlocks: chunkBlocks,
+		Dir:         t.TempDir(),
+	}
+}
+
+// TestGeometryValidation tests that unusable geometries are rejected
+func TestGeometryValidation(t *testing.T) {
+	newRAID0 := func(g Geometry) error { _, err := NewRAID0WithGeometry(g); return err }
+	newRAID1 := func(g Geometry) error { _, err := NewRAID1WithGeometry(g); return err }
+	newRAID4 := func(g Geometry) error { _, err := NewRAID4WithGeometry(g); return err }
+	newRAID5 := func(g Geometry) error { _, err := NewRAID5WithGeometry(g); return err }
+	newRAID6 := func(g Geometry) error { _, err := NewRAID6WithGeometry(g); return err }
+
+	withDisks := func(n int) Geometry {
+		g := DefaultGeometry()
+		g.NumDisks = n
+		return g
+	}
+	badBlockSize := DefaultGeometry()
+	badBlockSize.BlockSize = 0
+	badChunk := DefaultGeometry()
+	badChunk.ChunkBlocks = 0
+	unevenChunk := DefaultGeometry()
+	unevenChunk.ChunkBlocks = 3
+
+	tests := []struct {
+		name    string
+		create  func(Geometry) error
+		g       Geometry
+		wantErr bool
+	}{
+		{"RAID0 with 2 disks", newRAID0, withDisks(2), false},
+		{"RAID0 with 1 disk", newRAID0, withDisks(1), true},
+		{"RAID1 with 1 disk", newRAID1, withDisks(1), true},
+		{"RAID4 with 2 disks", newRAID4, withDisks(2), true},
+		{"RAID5 with 3 disks", newRAID5, withDisks(3), false},
+		{"RAID5 with 2 disks", newRAID5, withDisks(2), true},
+		{"RAID6 with 3 disks", newRAID6, withDisks(3), true},
+		{"RAID6 with 4 disks", newRAID6, withDisks(4), false},
+		{"zero block size", newRAID5, badBlockSize, true},
+		{"zero chunk size", newRAID5, badChunk, true},
+		{"disk not a whole number of chunks", newRAID0, unevenChunk, true},
+	}
+
+	for _, tt := range tests {
+		err := tt.create(tt.g)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: got error %v, expected error: %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+// TestRAID0ChunkMapping tests that each chunk of blocks lands on one disk
+// before the stripe moves on to the next
+func TestRAID0ChunkMapping(t *testing.T) {
+	g := testGeometry(t, 3, 4)
+	raid, err := NewRAID0WithGeometry(g)
+	if err != nil {
+		t.Fatalf("Failed to create RAID0: %v", err)
+	}
+	err = raid.Initialize()
+	if err != nil {
+		t.Fatalf("Failed to initialize RAID0: %v", err)
+	}
+	defer raid.CleanUp()
+
+	if _, err := os.Stat(filepath.Join(g.Dir, "disk2.dat")); err != nil {
+		t.Errorf("Expected disk file in the geometry directory: %v", err)
+	}
+
+	writeAndVerify(t, raid, 30)
+
+	// Blocks 0-3 are on disk 0, 4-7 on disk 1, 8-11 on disk 2, then 12-15
+	// go back to disk 0 at blocks 4-7
+	data := make([]byte, TestBlockSize)
+	for blockNum := 0; blockNum < 30; blockNum++ {
+		chunk := blockNum / 4
+		diskNum := chunk % 3
+		row := chunk/3*4 + blockNum%4
+		if err := raid.disks[diskNum].Read(row, data); err != nil {
+			t.Fatalf("Failed to read disk %d block %d: %v", diskNum, row, err)
+		}
+		if !bytes.Equal(data, blockPattern(blockNum)) {
+			t.Errorf("Block %d not found on disk %d block %d", blockNum, diskNum, row)
+		}
+	}
+}
+
+// TestRAID5ChunkMapping tests chunked RAID5 layout, parity and degraded reads
+func TestRAID5ChunkMapping(t *testing.T) {
+	raid, err := NewRAID5WithGeometry(testGeometry(t, 4, 2))
+	if err != nil {
+		t.Fatalf("Failed to create RAID5: %v", err)
+	}
+
+	// Parity rotates once per stripe of 2-block chunks
+	for blockNum, expected := range []int{0, 0, 1, 1, 2, 2, 0, 0, 1, 1, 3, 3, 0, 0, 2} {
+		row, diskNum, parityDisk := raid.mapBlock(blockNum)
+		if row != blockNum/6*2+blockNum%2 {
+			t.Errorf("RAID5 block %d mapped to row %d", blockNum, row)
+		}
+		if diskNum != expected {
+			t.Errorf("RAID5 block %d mapped to disk %d, expected %d", blockNum, diskNum, expected)
+		}
+		if parityDisk == diskNum {
+			t.Errorf("RAID5 block %d shares disk %d with its parity", blockNum, diskNum)
+		}
+	}
+
+	testDegradedReadWrite(t, raid, 1)
+}
+
+// TestRAID4ChunkMapping tests degraded reads and writes with chunked RAID4
+func TestRAID4ChunkMapping(t *testing.T) {
+	raid, err := NewRAID4WithGeometry(testGeometry(t, 4, 4))
+	if err != nil {
+		t.Fatalf("Failed to create RAID4: %v", err)
+	}
+	testDegradedReadWrite(t, raid, 0)
+}
+
+// TestRAID6ChunkMapping tests that chunked RAID6 survives two failed disks
+func TestRAID6ChunkMapping(t *testing.T) {
+	raid, err := NewRAID6WithGeometry(testGeometry(t, 5, 2))
+	if err != nil {
+		t.Fatalf("Failed to create RAID6: %v", err)
+	}
+	err = raid.Initialize()
+	if err != nil {
+		t.Fatalf("Failed to initialize RAID6: %v", err)
+	}
+	defer raid.CleanUp()
+
+	writeAndVerify(t, raid, 30)
+	raid.FailDisk(1)
+	raid.FailDisk(4)
+	verifyBlocks(t, raid, 30)
+}
+
+// TestChunkedFullStripeWrite tests that multi-block writes covering whole
+// stripes of chunks keep parity correct on every row
+func TestChunkedFullStripeWrite(t *testing.T) {
+	raid, err := NewRAID5WithGeometry(testGeometry(t, 4, 4))
+	if err != nil {
+		t.Fatalf("Failed to create RAID5: %v", err)
+	}
+	err = raid.Initialize()
+	if err != nil {
+		t.Fatalf("Failed to initialize RAID5: %v", err)
+	}
+	defer raid.CleanUp()
+
+	// Two whole stripes of 12 blocks, starting part way into the first
+	if err := raid.WriteBlocks(2, patternRun(2, 34)); err != nil {
+		t.Fatalf("Failed to write blocks: %v", err)
+	}
+	for row := 0; row < 12; row++ {
+		checkParity(t, &raid.memberSet, row)
+	}
+	for blockNum := 2; blockNum < 36; blockNum++ {
+		readData, err := raid.Read(blockNum)
+		if err != nil || !bytes.Equal(readData, blockPattern(blockNum)) {
+			t.Errorf("Data mismatch in RAID5 block %d: %v", blockNum, err)
+		}
+	}
+}
+
+// TestGeometryBlockSize tests an array with a non-default block size
+func TestGeometryBlockSize(t *testing.T) {
+	g := testGeometry(t, 3, 1)
+	g.BlockSize = 512
+	raid, err := NewRAID5WithGeometry(g)
+	if err != nil {
+		t.Fatalf("Failed to create RAID5: %v", err)
+	}
+	err = raid.Initialize()
+	if err != nil {
+		t.Fatalf("Failed to initialize RAID5: %v", err)
+	}
+	defer raid.CleanUp()
+
+	for blockNum := 0; blockNum < 10; blockNum++ {
+		if err := raid.Write(blockNum, bytes.Repeat([]byte{byte(blockNum + 1)}, 512)); err != nil {
+			t.Fatalf("Failed to write to RAID5 block %d: %v", blockNum, err)
+		}
+	}
+	for blockNum := 0; blockNum < 10; blockNum++ {
+		readData, err := raid.Read(blockNum)
+		if err != nil || !bytes.Equal(readData, bytes.Repeat([]byte{byte(blockNum + 1)}, 512)) {
+			t.Errorf("Data mismatch in RAID5 block %d: %v", blockNum, err)
+		}
+	}
+
+	// The superblock records the block size, and sits in the 512-byte block
+	// after the data blocks
+	sb, err := ReadSuperblock(filepath.Join(g.Dir, "disk0.dat"))
+	if err != nil {
+		t.Fatalf("Failed to read superblock: %v", err)
+	}
+	if sb.Geometry.BlockSize != 512 {
+		t.Errorf("Superblock block size is %d, expected 512", sb.Geometry.BlockSize)
+	}
+	info, err := os.Stat(filepath.Join(g.Dir, "disk0.dat"))
+	if err != nil {
+		t.Fatalf("Failed to stat disk0.dat: %v", err)
+	}
+	if info.Size() != int64(g.DiskBlocks+1)*512 {
+		t.Errorf("disk0.dat is %d bytes, expected %d", info.Size(), (g.DiskBlocks+1)*512)
+	}
+}
+
+// fuzzChunk bounds a fuzzed chunk size to 1 to 16 blocks
+func fuzzChunk(chunkBlocks uint8) int {
+	return 1 + int(chunkBlocks%16)
+}
+
+// FuzzStripeLocation checks that the striped layout puts every block in one
+// place, and that the place can be turned back into the block number
+func FuzzStripeLocation(f *testing.F) {
+	f.Add(uint8(4), uint8(1), uint32(0))
+	f.Add(uint8(2), uint8(4), uint32(13))
+	f.Add(uint8(15), uint8(15), uint32(1<<20))
+	f.Fuzz(func(t *testing.T, dataDisks, chunkBlocks uint8, blockNum uint32) {
+		d, c, b := 1+int(dataDisks%16), fuzzChunk(chunkBlocks), int(blockNum)
+		stripe, slot, row := stripeLocation(b, d, c)
+		if slot < 0 || slot >= d || row/c != stripe {
+			t.Fatalf("Block %d maps to stripe %d slot %d row %d with %d data disks of %d-block chunks",
+				b, stripe, slot, row, d, c)
+		}
+		if back := (stripe*d+slot)*c + row%c; back != b {
+			t.Fatalf("Block %d maps to stripe %d slot %d row %d, which maps back to block %d", b, stripe, slot, row, back)
+		}
+		if (b+1)%c != 0 {
+			if _, nextSlot, nextRow := stripeLocation(b+1, d, c); nextSlot != slot || nextRow != row+1 {
+				t.Fatalf("Block %d is not on the disk block after block %d in its chunk", b+1, b)
+			}
+		}
+	})
+}
+
+// FuzzRAID5MapBlock checks that a RAID5 block never shares a disk with its
+// strip's parity, that the parity disk is the one scrub and rebuild use for
+// the row, and that the mapping can be reversed
+func FuzzRAID5MapBlock(f *testing.F) {
+	f.Add(uint8(5), uint8(1), uint32(0))
+	f.Add(uint8(3), uint8(4), uint32(17))
+	f.Add(uint8(16), uint8(7), uint32(1<<20))
+	f.Fuzz(func(t *testing.T, numDisks, chunkBlocks uint8, blockNum uint32) {
+		n, c, b := 3+int(numDisks%14), fuzzChunk(chunkBlocks), int(blockNum)
+		r := newRAID5(Geometry{NumDisks: n, BlockSize: TestBlockSize, DiskBlocks: NumBlocks, ChunkBlocks: c})
+		row, diskNum, parityDisk := r.mapBlock(b)
+		if diskNum < 0 || diskNum >= n || parityDisk < 0 || parityDisk >= n || diskNum == parityDisk {
+			t.Fatalf("Block %d maps to disk %d with parity on disk %d, of %d disks", b, diskNum, parityDisk, n)
+		}
+		if rowParity := r.getParityDisk(row / c); rowParity != parityDisk {
+			t.Fatalf("Block %d has parity on disk %d, but row %d has it on disk %d", b, parityDisk, row, rowParity)
+		}
+		slot := diskNum
+		if diskNum > parityDisk {
+			slot--
+		}
+		if back := (row/c*r.dataDisks+slot)*c + row%c; back != b {
+			t.Fatalf("Block %d maps to disk %d row %d, which maps back to block %d", b, diskNum, row, back)
+		}
+	})
+}
+
+// FuzzRAID6MapBlock checks that a RAID6 block is never on its strip's P or Q
+// disk and that the mapping can be reversed
+func FuzzRAID6MapBlock(f *testing.F) {
+	f.Add(uint8(6), uint8(1), uint32(0))
+	f.Add(uint8(4), uint8(2), uint32(9))
+	f.Add(uint8(17), uint8(5), uint32(1<<20))
+	f.Fuzz(func(t *testing.T, numDisks, chunkBlocks uint8, blockNum uint32) {
+		n, c, b := 4+int(numDisks%14), fuzzChunk(chunkBlocks), int(blockNum)
+		r := newRAID6(Geometry{NumDisks: n, BlockSize: TestBlockSize, DiskBlocks: NumBlocks, ChunkBlocks: c})
+		stripNum, diskNum, slot := r.mapBlock(b)
+		pDisk, qDisk := r.getParityDisks(stripNum)
+		if diskNum < 0 || diskNum >= n || diskNum == pDisk || diskNum == qDisk || pDisk == qDisk {
+			t.Fatalf("Block %d maps to disk %d with P on disk %d and Q on disk %d, of %d disks", b, diskNum, pDisk, qDisk, n)
+		}
+		if (diskNum-qDisk-1+n)%n != slot || slot >= r.dataDisks {
+			t.Fatalf("Block %d is in slot %d but on disk %d, with Q on disk %d", b, slot, diskNum, qDisk)
+		}
+		if back := (stripNum/c*r.dataDisks+slot)*c + stripNum%c; back != b {
+			t.Fatalf("Block %d maps to disk %d row %d, which maps back to block %d", b, diskNum, stripNum, back)
+		}
+	})
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"sync"
+)
+
+// ErrChecksum is returned by an IntegrityDisk when a block does not match its
+// stored checksum
+var ErrChecksum = errors.New("block checksum mismatch")
+
+// castagnoli is the CRC32C table used for block checksums
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// IntegrityDisk wraps a BlockDevice and stores a CRC32C checksum with every
+// block, in the style of dm-integrity. Each checksum block is followed by the
+// data blocks it covers. It holds a checksum for each of them and, after the
+// checksums, a bitmap of which have been written; a block never written is
+// not checked.
+type IntegrityDisk struct {
+	disk      BlockDevice
+	blockSize int
+	perGroup  int        // Data blocks covered by one checksum block
+	mu        sync.Mutex // Guards groups and the checksums in them
+	groups    map[int]*checksumGroup
+}
+
+// checksumGroup is the contents of one checksum block
+type checksumGroup struct {
+	io      sync.Mutex // Held while the checksum block is read or written
+	loaded  bool
+	sums    []uint32
+	written []bool // Blocks whose checksum is valid
+}
+
+// NewIntegrityDisk wraps disk so that every block is checksummed
+func NewIntegrityDisk(disk BlockDevice, blockSize int) *IntegrityDisk {
+	return &IntegrityDisk{
+		disk:      disk,
+		blockSize: blockSize,
+		perGroup:  blockSize * 8 / 33, // 32 bits of checksum and one written bit each
+		groups:    make(map[int]*checksumGroup),
+	}
+}
+
+// locate returns the checksum group of a block and where the block itself
+// lives on the underlying disk
+func (d *IntegrityDisk) locate(blockNum int) (group, physical int) {
+	group = blockNum / d.perGroup
+	return group, group*(d.perGroup+1) + 1 + blockNum%d.perGroup
+}
+
+// group returns a checksum group, reading its checksum block the first time
+func (d *IntegrityDisk) group(num int) (*checksumGroup, error) {
+	d.mu.Lock()
+	g, ok := d.groups[num]
+	if !ok {
+		g = &checksumGroup{}
+		d.groups[num] = g
+	}
+	d.mu.Unlock()
+
+	g.io.Lock()
+	defer g.io.Unlock()
+	if g.loaded {
+		return g, nil
+	}
+	block := make([]byte, d.blockSize)
+	if err := d.disk.Read(num*(d.perGroup+1), block); err != nil {
+		return nil, err
+	}
+	g.sums = make([]uint32, d.perGroup)
+	g.written = make([]bool, d.perGroup)
+	bitmap := block[d.perGroup*4:]
+	for i := range g.sums {
+		g.sums[i] = binary.LittleEndian.Uint32(block[i*4:])
+		g.written[i] = bitmap[i/8]&(1<<(i%8)) != 0
+	}
+	g.loaded = true
+	return g, nil
+}
+
+// Read reads a block and checks it against its checksum
+func (d *IntegrityDisk) Read(blockNum int, buffer []byte) error {
+	num, physical := d.locate(blockNum)
+	g, err := d.group(num)
+	if err != nil {
+		return err
+	}
+	if err := d.disk.Read(physical, buffer); err != nil {
+		return err
+	}
+
+	i := blockNum % d.perGroup
+	d.mu.Lock()
+	written, want := g.written[i], g.sums[i]
+	d.mu.Unlock()
+	if written && crc32.Checksum(buffer, castagnoli) != want {
+		return ErrChecksum
+	}
+	return nil
+}
+
+// Write writes a block and then its updated checksum block
+func (d *IntegrityDisk) Write(blockNum int, data []byte) error {
+	num, physical := d.locate(blockNum)
+	g, err := d.group(num)
+	if err != nil {
+		return err
+	}
+	if err := d.disk.Write(physical, data); err != nil {
+		return err
+	}
+	return d.updateGroup(num, g, blockNum%d.perGroup, 1, crc32.Checksum(data, castagnoli), true)
+}
+
+// updateGroup sets the checksums of n blocks of a group, starting at first,
+// and writes its checksum block. Writes of the same checksum block are
+// serialized, and each one includes every update made before it started.
+func (d *IntegrityDisk) updateGroup(num int, g *checksumGroup, first, n int, sum uint32, written bool) error {
+	g.io.Lock()
+	defer g.io.Unlock()
+
+	block := make([]byte, d.blockSize)
+	bitmap := block[d.perGroup*4:]
+	d.mu.Lock()
+	for i := first; i < first+n; i++ {
+		g.sums[i] = sum
+		g.written[i] = written
+	}
+	for i, sum := range g.sums {
+		binary.LittleEndian.PutUint32(block[i*4:], sum)
+		if g.written[i] {
+			bitmap[i/8] |= 1 << (i % 8)
+		}
+	}
+	d.mu.Unlock()
+	return d.disk.Write(num*(d.perGroup+1), block)
+}
+
+// Discard discards blocks on the underlying disk and clears their checksums,
+// so they read as never written
+func (d *IntegrityDisk) Discard(blockNum, count int) error {
+	for count > 0 {
+		num, physical := d.locate(blockNum)
+		first := blockNum % d.perGroup
+		n := min(count, d.perGroup-first)
+		g, err := d.group(num)
+		if err != nil {
+			return err
+		}
+		if err := discardDevice(d.disk, physical, n, d.blockSize); err != nil {
+			return err
+		}
+		if err := d.updateGroup(num, g, first, n, 0, false); err != nil {
+			return err
+		}
+		blockNum += n
+		count -= n
+	}
+	return nil
+}
+
+// Flush flushes the underlying disk
+func (d *IntegrityDisk) Flush() error {
+	return flushDevice(d.disk)
+}
+
+// Close closes the underlying disk
+func (d *IntegrityDisk) Close() error {
+	return d.disk.Close()
+}
+
+// Delete deletes the underlying disk
+func (d *IntegrityDisk) Delete() error {
+	return d.disk.Delete()
+}
+
+// IntegrityStats counts blocks that failed their checksum on a member
+type IntegrityStats struct {
+	Detected      int // Reads that failed their checksum
+	Repaired      int // Bad copies rewritten from redundancy
+	Unrecoverable int // Bad blocks with no good copy to repair them from
+}
+
+// IntegrityStats returns the corruption events seen so far
+func (m *memberSet) IntegrityStats() IntegrityStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.corruption
+}
+
+// heal handles a member block that failed its checksum. The block is rebuilt
+// from the other members into buffer and written back to repair the bad
+// copy. The disk itself is not marked failed. Reads of the strip made while
+// healing are not healed in turn, since some rebuilds read the bad block
+// again; any other bad copy they find just leaves the block unrecoverable.
+// Must be called with mu held.
+func (m *memberSet) heal(diskNum, blockNum int, buffer []byte) error {
+	if m.healing[blockNum] {
+		return ErrChecksum
+	}
+	m.corruption.Detected++
+	if m.rebuildBlock == nil {
+		m.corruption.Unrecoverable++
+		return ErrChecksum
+	}
+
+	if m.healing == nil {
+		m.healing = make(map[int]bool)
+	}
+	m.healing[blockNum] = true
+	data, err := m.rebuildBlock(diskNum, blockNum)
+	delete(m.healing, blockNum)
+	if err != nil {
+		m.corruption.Unrecoverable++
+		return ErrChecksum
+	}
+
+	copy(buffer, data)
+	if m.write(diskNum, blockNum, data) == nil {
+		m.corruption.Repaired++
+	}
+	return nil
+}
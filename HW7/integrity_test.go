@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// integrityGeometry returns a small geometry with block checksums on
+func integrityGeometry(t *testing.T, numDisks int) Geometry {
+	t.Helper()
+	g := testGeometry(t, numDisks, 2)
+	g.DiskBlocks = TestRebuildBlocks
+	g.Integrity = true
+	return g
+}
+
+// rotBlock overwrites a block underneath a member's checksums, as silent
+// corruption on the medium would
+func rotBlock(t *testing.T, m *memberSet, diskNum, blockNum int) {
+	t.Helper()
+	disk := m.disks[diskNum].(*IntegrityDisk)
+	_, physical := disk.locate(blockNum)
+	if err := disk.disk.Write(physical, bytes.Repeat([]byte{0xee}, TestBlockSize)); err != nil {
+		t.Fatalf("Failed to corrupt disk %d block %d: %v", diskNum, blockNum, err)
+	}
+}
+
+// checkMember checks that a member block reads back without a checksum error
+// and with the expected contents
+func checkMember(t *testing.T, m *memberSet, diskNum, blockNum int, expected []byte) {
+	t.Helper()
+	data := make([]byte, TestBlockSize)
+	if err := m.disks[diskNum].Read(blockNum, data); err != nil {
+		t.Errorf("Disk %d block %d still fails to read: %v", diskNum, blockNum, err)
+	} else if !bytes.Equal(data, expected) {
+		t.Errorf("Disk %d block %d was not repaired", diskNum, blockNum)
+	}
+}
+
+// readBlock checks that one array block reads back with its pattern
+func readBlock(t *testing.T, raid RAID, blockNum int) {
+	t.Helper()
+	data, err := raid.Read(blockNum)
+	if err != nil {
+		t.Fatalf("Failed to read from %s block %d: %v", raid.GetName(), blockNum, err)
+	}
+	if !bytes.Equal(data, blockPattern(blockNum)) {
+		t.Errorf("Data mismatch in %s block %d", raid.GetName(), blockNum)
+	}
+}
+
+// TestIntegrityDisk tests that a checksummed disk detects a block changed
+// underneath it, and that unwritten blocks read back without error
+func TestIntegrityDisk(t *testing.T) {
+	raw, err := NewDisk(filepath.Join(t.TempDir(), "disk.dat"))
+	if err != nil {
+		t.Fatalf("Failed to create disk: %v", err)
+	}
+	defer raw.Close()
+	disk := NewIntegrityDisk(raw, TestBlockSize)
+
+	data := make([]byte, TestBlockSize)
+	if err := disk.Read(300, data); err != nil {
+		t.Errorf("Unwritten block failed to read: %v", err)
+	}
+	for _, blockNum := range []int{0, 127, 128, 300} {
+		if err := disk.Write(blockNum, blockPattern(blockNum)); err != nil {
+			t.Fatalf("Failed to write block %d: %v", blockNum, err)
+		}
+	}
+
+	// A fresh wrapper must find the checksums on disk
+	disk = NewIntegrityDisk(raw, TestBlockSize)
+	for _, blockNum := range []int{0, 127, 128, 300} {
+		if err := disk.Read(blockNum, data); err != nil || !bytes.Equal(data, blockPattern(blockNum)) {
+			t.Errorf("Block %d did not read back: %v", blockNum, err)
+		}
+	}
+
+	_, physical := disk.locate(128)
+	raw.Write(physical, bytes.Repeat([]byte{0xee}, TestBlockSize))
+	if err := disk.Read(128, data); !errors.Is(err, ErrChecksum) {
+		t.Errorf("Expected a checksum error for a corrupted block, got %v", err)
+	}
+
+	// A stored checksum of zero is a checksum like any other, since CRC32C
+	// can come out as zero
+	block := make([]byte, TestBlockSize)
+	raw.Read(0, block)
+	clear(block[:4])
+	raw.Write(0, block)
+	disk = NewIntegrityDisk(raw, TestBlockSize)
+	if err := disk.Read(0, data); !errors.Is(err, ErrChecksum) {
+		t.Errorf("Expected a checksum error for a block whose checksum is zero, got %v", err)
+	}
+}
+
+// TestRAID1SelfHeal tests that a bad mirror copy is replaced from another
+// mirror when read, without failing the disk
+func TestRAID1SelfHeal(t *testing.T) {
+	raid, err := NewRAID1WithGeometry(integrityGeometry(t, 2))
+	if err != nil {
+		t.Fatalf("Failed to create RAID1: %v", err)
+	}
+	err = raid.Initialize()
+	if err != nil {
+		t.Fatalf("Failed to initialize RAID1: %v", err)
+	}
+	defer raid.CleanUp()
+	writeAndVerify(t, raid, 10)
+
+	rotBlock(t, &raid.memberSet, 0, 4)
+	rotBlock(t, &raid.memberSet, 1, 4)
+	rotBlock(t, &raid.memberSet, 0, 6)
+	for _, blockNum := range []int{0, 5, 6, 9} {
+		readBlock(t, raid, blockNum)
+	}
+
+	if _, err := raid.Read(4); !errors.Is(err, ErrChecksum) {
+		t.Errorf("Expected block 4 with both copies bad to fail, got %v", err)
+	}
+	checkMember(t, &raid.memberSet, 0, 6, blockPattern(6))
+	if stats := raid.IntegrityStats(); stats != (IntegrityStats{Detected: 2, Repaired: 1, Unrecoverable: 1}) {
+		t.Errorf("Integrity stats are %+v, expected 2 detected, 1 repaired, 1 unrecoverable", stats)
+	}
+	if slices.Contains(raid.failed, true) {
+		t.Errorf("Corruption failed disks %v, expected none", raid.failed)
+	}
+}
+
+// TestRAID5SelfHeal tests that bad data and parity blocks are rebuilt from
+// the rest of their strip, on both single reads and scrubs
+func TestRAID5SelfHeal(t *testing.T) {
+	raid, err := NewRAID5WithGeometry(integrityGeometry(t, 4))
+	if err != nil {
+		t.Fatalf("Failed to create RAID5: %v", err)
+	}
+	err = raid.Initialize()
+	if err != nil {
+		t.Fatalf("Failed to initialize RAID5: %v", err)
+	}
+	defer raid.CleanUp()
+	writeAndVerify(t, raid, 60)
+
+	stripNum, diskNum, parityDisk := raid.mapBlock(13)
+	rotBlock(t, &raid.memberSet, diskNum, stripNum)
+	readBlock(t, raid, 13)
+	checkMember(t, &raid.memberSet, diskNum, stripNum, blockPattern(13))
+
+	// A bad parity block is found when the scrub reads the whole strip
+	stripNum, _, parityDisk = raid.mapBlock(20)
+	rotBlock(t, &raid.memberSet, parityDisk, stripNum)
+	report, err := raid.Scrub(ScrubOptions{LastStrip: -1})
+	if err != nil {
+		t.Fatalf("Failed to scrub RAID5: %v", err)
+	}
+	if len(report.Mismatches) != 0 || report.Skipped != 0 {
+		t.Errorf("Scrub reported %+v, expected the bad parity to be healed first", report)
+	}
+	checkParity(t, &raid.memberSet, stripNum)
+
+	if stats := raid.IntegrityStats(); stats != (IntegrityStats{Detected: 2, Repaired: 2}) {
+		t.Errorf("Integrity stats are %+v, expected 2 detected and repaired", stats)
+	}
+	if slices.Contains(raid.failed, true) {
+		t.Errorf("Corruption failed disks %v, expected none", raid.failed)
+	}
+}
+
+// TestRAID6SelfHeal tests healing a data block when the same strip's P
+// block is also bad
+func TestRAID6SelfHeal(t *testing.T) {
+	raid, err := NewRAID6WithGeometry(integrityGeometry(t, 5))
+	if err != nil {
+		t.Fatalf("Failed to create RAID6: %v", err)
+	}
+	err = raid.Initialize()
+	if err != nil {
+		t.Fatalf("Failed to initialize RAID6: %v", err)
+	}
+	defer raid.CleanUp()
+	writeAndVerify(t, raid, 30)
+
+	stripNum, diskNum, _ := raid.mapBlock(7)
+	pDisk, _ := raid.getParityDisks(stripNum)
+	rotBlock(t, &raid.memberSet, diskNum, stripNum)
+	rotBlock(t, &raid.memberSet, pDisk, stripNum)
+	readBlock(t, raid, 7)
+	checkMember(t, &raid.memberSet, diskNum, stripNum, blockPattern(7))
+
+	if stats := raid.IntegrityStats(); stats.Detected != 1 || stats.Repaired != 1 {
+		t.Errorf("Integrity stats are %+v, expected 1 detected and repaired", stats)
+	}
+}
+
+// TestIntegrityReopen tests that integrity mode is recorded in the
+// superblocks and turned back on when the array is opened again
+func TestIntegrityReopen(t *testing.T) {
+	raid, err := NewRAID5WithGeometry(integrityGeometry(t, 3))
+	if err != nil {
+		t.Fatalf("Failed to create RAID5: %v", err)
+	}
+	err = raid.Initialize()
+	if err != nil {
+		t.Fatalf("Failed to initialize RAID5: %v", err)
+	}
+	if err := raid.EnableBitmap(); err != nil {
+		t.Fatalf("Failed to enable bitmap: %v", err)
+	}
+	writeAndVerify(t, raid, 20)
+	dir := raid.Geometry().Dir
+	if err := raid.Close(); err != nil {
+		t.Fatalf("Failed to close RAID5: %v", err)
+	}
+
+	raid = openTestArray(t, dir)
+	defer raid.CleanUp()
+	if !raid.Geometry().Integrity {
+		t.Fatalf("Reopened array does not have integrity on")
+	}
+	verifyBlocks(t, raid, 20)
+
+	stripNum, diskNum, _ := raid.mapBlock(5)
+	rotBlock(t, &raid.memberSet, diskNum, stripNum)
+	readBlock(t, raid, 5)
+	if stats := raid.IntegrityStats(); stats.Repaired != 1 {
+		t.Errorf("Integrity stats are %+v, expected 1 repair", stats)
+	}
+}
+
+// TestIntegrityDiskConcurrent tests that writes through a checksummed disk
+// run in parallel, and that concurrent updates of one checksum block all
+// reach the disk
+func TestIntegrityDiskConcurrent(t *testing.T) {
+	const latency = 50 * time.Millisecond
+	faulty := NewFaultyDisk(NewMemoryDisk(TestBlockSize))
+	faulty.SetLatency(latency)
+	disk := NewIntegrityDisk(faulty, TestBlockSize)
+
+	// Blocks in different groups share no checksum block, and blocks in the
+	// same group share one
+	var blocks []int
+	for i := 0; i < 4; i++ {
+		blocks = append(blocks, i*disk.perGroup, i*disk.perGroup+1)
+	}
+	for _, blockNum := range blocks {
+		if err := disk.Read(blockNum, make([]byte, TestBlockSize)); err != nil {
+			t.Fatalf("Failed to read block %d: %v", blockNum, err)
+		}
+	}
+
+	start := time.Now()
+	var wg sync.WaitGroup
+	for _, blockNum := range blocks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := disk.Write(blockNum, blockPattern(blockNum)); err != nil {
+				t.Errorf("Failed to write block %d: %v", blockNum, err)
+			}
+		}()
+	}
+	wg.Wait()
+	if elapsed := time.Since(start); elapsed > 5*latency {
+		t.Errorf("%d writes took %v, expected them to overlap", len(blocks), elapsed)
+	}
+
+	faulty.SetLatency(0)
+	disk = NewIntegrityDisk(faulty, TestBlockSize)
+	data := make([]byte, TestBlockSize)
+	for _, blockNum := range blocks {
+		if err := disk.Read(blockNum, data); err != nil || !bytes.Equal(data, blockPattern(blockNum)) {
+			t.Errorf("Block %d did not read back: %v", blockNum, err)
+		}
+	}
+}
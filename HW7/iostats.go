@@ -0,0 +1,126 @@
+package main
+
+import (
+	"sync/atomic"
+)
+
+// IOStats counts the physical disk reads and writes an array has issued
+type IOStats struct {
+	Reads  int64
+	Writes int64
+}
+
+// Total returns the number of physical I/Os of either kind
+func (s IOStats) Total() int64 {
+	return s.Reads + s.Writes
+}
+
+// ioStatser is implemented by arrays that count their physical I/O
+type ioStatser interface {
+	IOStats() IOStats
+}
+
+// ioCounter is embedded by arrays to count the physical I/O they issue
+type ioCounter struct {
+	reads  atomic.Int64
+	writes atomic.Int64
+}
+
+// IOStats returns the physical reads and writes issued so far
+func (c *ioCounter) IOStats() IOStats {
+	return IOStats{Reads: c.reads.Load(), Writes: c.writes.Load()}
+}
+
+// resetIOStats zeroes the counters
+func (c *ioCounter) resetIOStats() {
+	c.reads.Store(0)
+	c.writes.Store(0)
+}
+
+func (c *ioCounter) countRead() {
+	c.reads.Add(1)
+}
+
+func (c *ioCounter) countWrite() {
+	c.writes.Add(1)
+}
+
+// QueueStats reports how many requests a disk has had in flight at once,
+// which shows how much of the array's parallelism reached the disk
+type QueueStats struct {
+	Requests int64   // Requests issued
+	MaxDepth int64   // Most requests in flight at once
+	AvgDepth float64 // Requests in flight seen by each arriving request, counting itself
+}
+
+// queueStatser is implemented by devices that track their queue depth
+type queueStatser interface {
+	QueueStats() QueueStats
+}
+
+// queueCounter is embedded by devices to track the requests in flight
+type queueCounter struct {
+	inFlight atomic.Int64
+	requests atomic.Int64
+	depthSum atomic.Int64 // Sum of the depth seen by each request
+	maxDepth atomic.Int64
+}
+
+// start records a request arriving
+func (q *queueCounter) start() {
+	depth := q.inFlight.Add(1)
+	q.requests.Add(1)
+	q.depthSum.Add(depth)
+	for {
+		most := q.maxDepth.Load()
+		if depth <= most || q.maxDepth.CompareAndSwap(most, depth) {
+			return
+		}
+	}
+}
+
+// finish records a request completing
+func (q *queueCounter) finish() {
+	q.inFlight.Add(-1)
+}
+
+// QueueStats returns the queue depth seen so far
+func (q *queueCounter) QueueStats() QueueStats {
+	stats := QueueStats{Requests: q.requests.Load(), MaxDepth: q.maxDepth.Load()}
+	if stats.Requests > 0 {
+		stats.AvgDepth = float64(q.depthSum.Load()) / float64(stats.Requests)
+	}
+	return stats
+}
+
+// queueStats returns the queue depth of each disk, zero for disks that do
+// not track it
+func queueStats(disks []BlockDevice) []QueueStats {
+	stats := make([]QueueStats, len(disks))
+	for i, disk := range disks {
+		if statser, ok := disk.(queueStatser); ok {
+			stats[i] = statser.QueueStats()
+		}
+	}
+	return stats
+}
+
+// memberQueueStatser is implemented by arrays that report the queue depth
+// of their members
+type memberQueueStatser interface {
+	MemberQueueStats() []QueueStats
+}
+
+// MemberQueueStats returns the queue depth of each member disk
+func (r *RAID0) MemberQueueStats() []QueueStats {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return queueStats(r.disks)
+}
+
+// MemberQueueStats returns the queue depth of each member disk
+func (m *memberSet) MemberQueueStats() []QueueStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return queueStats(m.disks)
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// TestQueueCounter tests the depth each arriving request sees
+func TestQueueCounter(t *testing.T) {
+	var q queueCounter
+	q.start()
+	q.start()
+	q.start()
+	q.finish()
+	q.start()
+	q.finish()
+	q.finish()
+
+	// The requests saw depths 1, 2, 3 and 3
+	stats := q.QueueStats()
+	if stats.Requests != 4 || stats.MaxDepth != 3 || stats.AvgDepth != 2.25 {
+		t.Errorf("Queue stats are %+v, expected 4 requests, max depth 3 and average 2.25", stats)
+	}
+	if q.inFlight.Load() != 1 {
+		t.Errorf("%d requests in flight, expected 1", q.inFlight.Load())
+	}
+}
+
+// TestDiskQueueDepth tests concurrent requests to different blocks of one
+// disk, which may overlap but never more than there are writers
+func TestDiskQueueDepth(t *testing.T) {
+	disk, err := NewDiskWithBlockSize(filepath.Join(t.TempDir(), "disk.dat"), TestBlockSize)
+	if err != nil {
+		t.Fatalf("Failed to create disk: %v", err)
+	}
+	defer disk.Delete()
+
+	const writers, writes = 8, 20
+	var wg sync.WaitGroup
+	for g := 0; g < writers; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < writes; i++ {
+				blockNum := g*writes + i
+				if err := disk.Write(blockNum, blockPattern(blockNum)); err != nil {
+					t.Errorf("Failed to write block %d: %v", blockNum, err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	verifyDisk(t, disk, writers*writes)
+
+	stats := disk.QueueStats()
+	if stats.Requests != 2*writers*writes {
+		t.Errorf("Disk counted %d requests, expected %d", stats.Requests, 2*writers*writes)
+	}
+	if stats.MaxDepth < 1 || stats.MaxDepth > writers {
+		t.Errorf("Queue depth %d is outside 1 to %d writers", stats.MaxDepth, writers)
+	}
+}
+
+// verifyDisk checks that blocks 0 to numBlocks-1 of a disk hold their
+// patterns
+func verifyDisk(t *testing.T, disk BlockDevice, numBlocks int) {
+	t.Helper()
+	buffer := make([]byte, TestBlockSize)
+	for blockNum := 0; blockNum < numBlocks; blockNum++ {
+		if err := disk.Read(blockNum, buffer); err != nil || !bytes.Equal(buffer, blockPattern(blockNum)) {
+			t.Errorf("Block %d read back wrong, err %v", blockNum, err)
+		}
+	}
+}
+
+// TestMemberQueueStats tests that an array reports the queue depth of each
+// member
+func TestMemberQueueStats(t *testing.T) {
+	g := testGeometry(t, 5, 1)
+	raid, _ := NewRAID5WithGeometry(g)
+	if err := raid.Initialize(); err != nil {
+		t.Fatalf("Failed to initialize RAID5: %v", err)
+	}
+	defer raid.CleanUp()
+
+	writeAndVerify(t, raid, 10)
+	stats := raid.MemberQueueStats()
+	if len(stats) != 5 {
+		t.Fatalf("Got queue stats for %d members, expected 5", len(stats))
+	}
+	for i, q := range stats {
+		if q.Requests == 0 || q.MaxDepth < 1 {
+			t.Errorf("Member %d reported no requests: %+v", i, q)
+		}
+	}
+}
@@ -2,9 +2,11 @@ package main
 
 import (
 	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"log"
+	"math/rand"
 	"os"
 	"sync"
 	"time"
@@ -15,6 +17,12 @@ const (
 	NumDisks   = 5
 	NumBlocks  = 10000 // Total logical blocks
 	DataSize   = 100 * 1024 * 1024 // 100MB for benchmarking
+
+	NestedDisks = 6 // Disks used to compare RAID10 and RAID50 with RAID5
+
+	BenchmarkCacheBlocks = 8192 // 32MB block cache for the cached benchmark
+
+	SyncBenchmarkBlocks = 1024 // 4MB per sync policy; syncing every write is slow
 )
 
 // RAID interface as specified in the assignment
@@ -25,42 +33,86 @@ type RAID interface {
 	CleanUp() error
 	GetEffectiveCapacity() int
 	GetName() string
+
+	// Discard tells the array that count blocks from blockNum hold no data.
+	// They read as zeros afterwards.
+	Discard(blockNum, count int) error
+
+	// Flush is a write barrier: once it returns, every write that returned
+	// before it was called is durable on the member disks
+	Flush() error
 }
 
-// Disk represents a simulated physical disk
+// BlockDevice is a member device of a RAID array. Disk is the file-backed
+// implementation; MemoryDisk and SparseDisk are alternatives, and wrappers
+// such as FaultyDisk can stand in for any of them.
+type BlockDevice interface {
+	Read(blockNum int, buffer []byte) error
+	Write(blockNum int, data []byte) error
+	Close() error
+	Delete() error
+}
+
+// Disk represents a simulated physical disk. Reads and writes use positional
+// I/O, so requests for different blocks can be in flight at once.
 type Disk struct {
-	file *os.File
-	path string
-	mu   sync.Mutex
+	queueCounter
+	file      *os.File
+	path      string
+	blockSize int
+	direct    bool // Opened with O_DIRECT, bypassing the page cache
+
+	syncMu    sync.Mutex
+	policy    SyncPolicy  // When writes are synced
+	unsynced  int         // Writes since the last sync
+	syncTimer *time.Timer // Syncs batched writes after policy.Interval, nil if none pending
+	syncErr   error       // Error from a timed sync, returned by the next Flush
 }
 
 // NewDisk creates a new simulated disk
 func NewDisk(path string) (*Disk, error) {
+	return NewDiskWithBlockSize(path, BlockSize)
+}
+
+// NewDiskWithBlockSize creates a new simulated disk with the given block size
+func NewDiskWithBlockSize(path string, blockSize int) (*Disk, error) {
 	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
 	if err != nil {
 		return nil, err
 	}
 
 	return &Disk{
-		file: file,
-		path: path,
+		file:      file,
+		path:      path,
+		blockSize: blockSize,
 	}, nil
 }
 
 // Read reads a block from the disk
 func (d *Disk) Read(blockNum int, buffer []byte) error {
-	d.mu.Lock()
-	defer d.mu.Unlock()
-
-	offset := int64(blockNum) * int64(BlockSize)
-	_, err := d.file.Seek(offset, io.SeekStart)
-	if err != nil {
+	if blockNum < 0 {
+		return fmt.Errorf("%w: block %d", ErrOutOfRange, blockNum)
+	}
+	d.start()
+	defer d.finish()
+
+	offset := int64(blockNum) * int64(d.blockSize)
+	var n int
+	var err error
+	if d.direct {
+		n, err = d.readDirect(buffer, offset)
+	} else {
+		n, err = d.file.ReadAt(buffer, offset)
+	}
+	if err != nil && err != io.EOF {
 		return err
 	}
 
-	_, err = io.ReadFull(d.file, buffer)
-	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
-		return err
+	// Blocks past the end of the file have never been written, so read as
+	// zeros. The array checks block numbers against its capacity, so running
+	// off the end here is not an error.
+	for i := n; i < len(buffer); i++ {
+		buffer[i] = 0
 	}
 
 	return nil
@@ -68,31 +120,59 @@ func (d *Disk) Read(blockNum int, buffer []byte) error {
 
 // Write writes a block to the disk
 func (d *Disk) Write(blockNum int, data []byte) error {
-	d.mu.Lock()
-	defer d.mu.Unlock()
-
-	offset := int64(blockNum) * int64(BlockSize)
-	_, err := d.file.Seek(offset, io.SeekStart)
-	if err != nil {
-		return err
+	if blockNum < 0 {
+		return fmt.Errorf("%w: block %d", ErrOutOfRange, blockNum)
+	}
+	d.start()
+	defer d.finish()
+
+	offset := int64(blockNum) * int64(d.blockSize)
+	var err error
+	if d.direct {
+		err = d.writeDirect(data, offset)
+	} else {
+		_, err = d.file.WriteAt(data, offset)
 	}
-
-	_, err = d.file.Write(data)
 	if err != nil {
 		return err
 	}
 
-	// Ensure data is flushed to simulate real disk write delays
-	return d.file.Sync()
+	// Sync as the policy says; by default every write, like a real disk
+	return d.afterWrite()
+}
+
+// diskFactory creates member disk i of an array
+type diskFactory func(i int) (BlockDevice, error)
+
+// openMember creates member disk i using newDisk, or with the geometry's
+// backend, named disk%d.dat in its directory, if no factory is set. With
+// integrity on, the disk is wrapped to checksum every block.
+func openMember(newDisk diskFactory, g Geometry, i int) (BlockDevice, error) {
+	var disk BlockDevice
+	var err error
+	if newDisk == nil {
+		disk, err = g.Backend.open(g, i)
+	} else {
+		disk, err = newDisk(i)
+	}
+	if err != nil || disk == nil || !g.Integrity {
+		return disk, err
+	}
+	return NewIntegrityDisk(disk, g.BlockSize), nil
 }
 
-// Close closes the disk
+// Close syncs any writes the sync policy is holding back and closes the disk
 func (d *Disk) Close() error {
+	if err := d.stopSync(true); err != nil {
+		d.file.Close()
+		return err
+	}
 	return d.file.Close()
 }
 
 // Delete deletes the disk file
 func (d *Disk) Delete() error {
+	d.stopSync(false)
 	err := d.file.Close()
 	if err != nil {
 		return err
@@ -102,15 +182,40 @@ func (d *Disk) Delete() error {
 
 // RAID0 implements striping across disks
 type RAID0 struct {
-	disks      []*Disk
-	blockSize  int
-	numDisks   int
+	ioCounter
+	identity
+	disks       []BlockDevice
+	newDisk     diskFactory
+	dir         string
+	blockSize   int
+	numDisks    int
+	diskBlocks  int // Number of blocks on each member disk
+	chunkBlocks int // Blocks per chunk on one disk before moving to the next
+
+	noSuperblock bool // Members are arrays with superblocks of their own
+	integrity    bool    // Members checksum every block
+	backend      Backend // Kind of device created for each member
+	sync         SyncPolicy // When file-backed members sync their writes
+
+	mu      sync.RWMutex // Held for writing while a reshape moves a stripe
+	reshape *reshaper    // Current or last reshape, nil if there has been none
 }
 
 func NewRAID0() *RAID0 {
+	return newRAID0(DefaultGeometry())
+}
+
+func newRAID0(g Geometry) *RAID0 {
 	return &RAID0{
-		blockSize: BlockSize,
-		numDisks:  NumDisks,
+		identity:    identity{level: 0},
+		dir:         g.Dir,
+		blockSize:   g.BlockSize,
+		numDisks:    g.NumDisks,
+		diskBlocks:  g.DiskBlocks,
+		chunkBlocks: g.ChunkBlocks,
+		integrity:   g.Integrity,
+		backend:     g.Backend,
+		sync:        g.Sync,
 	}
 }
 
@@ -119,18 +224,64 @@ func (r *RAID0) GetName() string {
 }
 
 func (r *RAID0) Initialize() error {
-	r.disks = make([]*Disk, r.numDisks)
+	r.resetIOStats()
+	r.reshape = nil
+	r.disks = make([]BlockDevice, r.numDisks)
 	for i := 0; i < r.numDisks; i++ {
-		disk, err := NewDisk(fmt.Sprintf("disk%d.dat", i))
+		disk, err := openMember(r.newDisk, r.Geometry(), i)
 		if err != nil {
 			return err
 		}
 		r.disks[i] = disk
 	}
+	if r.noSuperblock {
+		return nil
+	}
+	return r.stamp(r.Geometry(), r.disks, func(int) MemberState { return MemberActive }, nil)
+}
+
+// Geometry returns the shape of the array
+func (r *RAID0) Geometry() Geometry {
+	return Geometry{
+		NumDisks:    r.numDisks,
+		BlockSize:   r.blockSize,
+		DiskBlocks:  r.diskBlocks,
+		ChunkBlocks: r.chunkBlocks,
+		Dir:         r.dir,
+		Integrity:   r.integrity,
+		Backend:     r.backend,
+		Sync:        r.sync,
+	}
+}
+
+// Close stops any reshape, recording how far it got, and closes the member
+// disks without deleting them
+func (r *RAID0) Close() error {
+	r.reshape.halt()
+	var first error
+	for _, disk := range r.disks {
+		if err := disk.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// Flush syncs every member disk
+func (r *RAID0) Flush() error {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for i, err := range flushDisks(r.disks) {
+		if err != nil {
+			return &ErrDiskFailed{Disk: i, Err: err}
+		}
+	}
 	return nil
 }
 
 func (r *RAID0) CleanUp() error {
+	r.reshape.halt()
+	r.reshape.removeBackup()
 	for _, disk := range r.disks {
 		err := disk.Delete()
 		if err != nil {
@@ -140,41 +291,153 @@ func (r *RAID0) CleanUp() error {
 	return nil
 }
 
+// GetEffectiveCapacity returns the capacity in blocks. While a reshape is
+// running this is still the capacity of the old layout.
 func (r *RAID0) GetEffectiveCapacity() int {
-	return r.numDisks * NumBlocks
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.capacity()
+}
+
+// capacity returns the capacity in blocks. Must be called with mu held.
+func (r *RAID0) capacity() int {
+	if r.reshape.active() {
+		return r.reshape.oldCapacity
+	}
+	return r.numDisks * r.diskBlocks
 }
 
 func (r *RAID0) Write(blockNum int, data []byte) error {
-	if len(data) != r.blockSize {
-		return errors.New("data size does not match block size")
+	if err := checkData(data, r.blockSize); err != nil {
+		return err
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if err := checkBlock(blockNum, r.capacity()); err != nil {
+		return err
+	}
+	return r.write(blockNum, data)
+}
+
+// write writes a block. Must be called with mu held.
+func (r *RAID0) write(blockNum int, data []byte) error {
+	if r.reshape.pending(blockNum) {
+		return r.reshape.oldWrite(blockNum, data)
+	}
+	if err := r.reshape.commitWrite(blockNum); err != nil {
+		return err
 	}
 
-	diskNum := blockNum % r.numDisks
-	diskBlockNum := blockNum / r.numDisks
+	_, diskNum, diskBlockNum := stripeLocation(blockNum, r.numDisks, r.chunkBlocks)
 
-	return r.disks[diskNum].Write(diskBlockNum, data)
+	r.countWrite()
+	if err := r.disks[diskNum].Write(diskBlockNum, data); err != nil {
+		return &ErrDiskFailed{Disk: diskNum, Err: err}
+	}
+	return nil
+}
+
+// Discard frees count blocks from blockNum on the members. The blocks a run
+// puts on one member are consecutive there, so each member gets one discard.
+func (r *RAID0) Discard(blockNum, count int) error {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if err := checkExtent(blockNum, count, r.capacity()); err != nil {
+		return err
+	}
+	if r.reshape.active() {
+		// Blocks are moving between layouts, so zero them one at a time
+		zeros := make([]byte, r.blockSize)
+		for i := 0; i < count; i++ {
+			if err := r.write(blockNum+i, zeros); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	first := make([]int, r.numDisks)
+	last := make([]int, r.numDisks)
+	for i := range first {
+		first[i] = -1
+	}
+	for i := blockNum; i < blockNum+count; i++ {
+		_, diskNum, row := stripeLocation(i, r.numDisks, r.chunkBlocks)
+		if first[diskNum] < 0 {
+			first[diskNum] = row
+		}
+		last[diskNum] = row
+	}
+	return runParallel(r.numDisks, func(diskNum int) error {
+		if first[diskNum] < 0 {
+			return nil
+		}
+		r.countWrite()
+		err := discardDevice(r.disks[diskNum], first[diskNum], last[diskNum]-first[diskNum]+1, r.blockSize)
+		if err != nil {
+			return &ErrDiskFailed{Disk: diskNum, Err: err}
+		}
+		return nil
+	})
 }
 
 func (r *RAID0) Read(blockNum int) ([]byte, error) {
-	diskNum := blockNum % r.numDisks
-	diskBlockNum := blockNum / r.numDisks
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if err := checkBlock(blockNum, r.capacity()); err != nil {
+		return nil, err
+	}
+	if r.reshape.pending(blockNum) {
+		return r.reshape.oldRead(blockNum)
+	}
+
+	_, diskNum, diskBlockNum := stripeLocation(blockNum, r.numDisks, r.chunkBlocks)
 
 	data := make([]byte, r.blockSize)
-	err := r.disks[diskNum].Read(diskBlockNum, data)
-	return data, err
+	r.countRead()
+	if err := r.disks[diskNum].Read(diskBlockNum, data); err != nil {
+		return nil, &ErrDiskFailed{Disk: diskNum, Err: err}
+	}
+	return data, nil
 }
 
 // RAID1 implements mirroring across disks
 type RAID1 struct {
-	disks      []*Disk
+	memberSet
 	blockSize  int
 	numDisks   int
+
+	readPolicy  ReadPolicy
+	readCounts  []int64 // Reads served by each mirror
+	outstanding []int   // Reads in flight on each mirror
+	lastBlock   []int   // Last block each mirror accessed
+	nextMirror  int     // Next mirror to try under ReadRoundRobin
 }
 
 func NewRAID1() *RAID1 {
+	return newRAID1(DefaultGeometry())
+}
+
+func newRAID1(g Geometry) *RAID1 {
 	return &RAID1{
-		blockSize: BlockSize,
-		numDisks:  NumDisks,
+		memberSet: memberSet{diskBlocks: g.DiskBlocks, dir: g.Dir, integrity: g.Integrity, backend: g.Backend, sync: g.Sync, identity: identity{level: 1}, stripLocking: true},
+		blockSize: g.BlockSize,
+		numDisks:  g.NumDisks,
+	}
+}
+
+// Geometry returns the shape of the array
+func (r *RAID1) Geometry() Geometry {
+	return Geometry{
+		NumDisks:    r.numDisks,
+		BlockSize:   r.blockSize,
+		DiskBlocks:  r.diskBlocks,
+		ChunkBlocks: 1,
+		Dir:         r.dir,
+		Integrity:   r.integrity,
+		Backend:     r.backend,
+		Sync:        r.sync,
 	}
 }
 
@@ -183,69 +446,203 @@ func (r *RAID1) GetName() string {
 }
 
 func (r *RAID1) Initialize() error {
-	r.disks = make([]*Disk, r.numDisks)
+	r.reset(r.numDisks)
+	r.geometry = r.Geometry
+	r.rebuildBlock = r.readMirror
+	r.scrubStrip = r.checkStrip
+	r.readCounts = make([]int64, r.numDisks)
+	r.outstanding = make([]int, r.numDisks)
+	r.lastBlock = make([]int, r.numDisks)
+	r.nextMirror = 0
 	for i := 0; i < r.numDisks; i++ {
-		disk, err := NewDisk(fmt.Sprintf("disk%d.dat", i))
+		disk, err := openMember(r.newDisk, r.Geometry(), i)
 		if err != nil {
 			return err
 		}
 		r.disks[i] = disk
 	}
-	return nil
+	return r.writeSuperblocks()
 }
 
 func (r *RAID1) CleanUp() error {
-	for _, disk := range r.disks {
-		err := disk.Delete()
-		if err != nil {
-			return err
-		}
-	}
-	return nil
+	return r.cleanUp()
 }
 
 func (r *RAID1) GetEffectiveCapacity() int {
-	return NumBlocks
+	return r.diskBlocks
 }
 
 func (r *RAID1) Write(blockNum int, data []byte) error {
-	if len(data) != r.blockSize {
-		return errors.New("data size does not match block size")
+	if err := checkData(data, r.blockSize); err != nil {
+		return err
+	}
+	if err := checkBlock(blockNum, r.GetEffectiveCapacity()); err != nil {
+		return err
 	}
 
-	// Write to all disks for mirroring
-	for _, disk := range r.disks {
-		err := disk.Write(blockNum, data)
-		if err != nil {
-			return err
+	r.stripes.enter()
+	defer r.stripes.exit()
+	r.stripes.lock(blockNum)
+	defer r.stripes.unlock(blockNum)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// Write to all working disks at once for mirroring, releasing mu while
+	// they run. A spare that has not been rebuilt this far yet is skipped; the
+	// rebuild copies the block later.
+	var writes []memberOp
+	for i := range r.disks {
+		if !r.isFailed(i, blockNum) {
+			writes = append(writes, memberOp{diskNum: i, data: data})
+			r.lastBlock[i] = blockNum
 		}
 	}
+	errs, first := r.writeMembers(blockNum, writes)
+	for _, err := range errs {
+		if err == nil {
+			return nil
+		}
+	}
+	if first == nil || first == ErrArrayFailed {
+		return ErrArrayFailed
+	}
+	return fmt.Errorf("%w: %w", ErrArrayFailed, first)
+}
 
-	return nil
+// Discard frees count blocks from blockNum on every mirror
+func (r *RAID1) Discard(blockNum, count int) error {
+	if err := checkExtent(blockNum, count, r.diskBlocks); err != nil {
+		return err
+	}
+	r.stripes.enter()
+	defer r.stripes.exit()
+	// Every block is a whole stripe, so nothing is written as zeros
+	return r.discardBlocks(r.blockSize, 1, 1, blockNum, count, nil)
 }
 
 func (r *RAID1) Read(blockNum int) ([]byte, error) {
-	// Read from the first disk (could implement read balancing here)
+	if err := checkBlock(blockNum, r.GetEffectiveCapacity()); err != nil {
+		return nil, err
+	}
+	r.stripes.enter()
+	defer r.stripes.exit()
+
+	// Reads of a block share its strip lock, so concurrent reads of a hot
+	// block are spread over the mirrors
+	r.stripes.rlock(blockNum)
+	data, err := r.readBlock(blockNum, false)
+	r.stripes.runlock(blockNum)
+	if !errors.Is(err, ErrChecksum) {
+		return data, err
+	}
+
+	// A copy failed its checksum. It is repaired holding the block alone,
+	// like a write; another read may have repaired it in the meantime.
+	r.stripes.lock(blockNum)
+	defer r.stripes.unlock(blockNum)
+	return r.readBlock(blockNum, true)
+}
+
+// readBlock reads a block from a mirror picked by the read policy, falling
+// back to the others if it fails. A copy that fails its checksum is healed
+// from another mirror if repair is set, and returns ErrChecksum otherwise.
+// Must be called with the block's strip locked.
+func (r *RAID1) readBlock(blockNum int, repair bool) ([]byte, error) {
+	data := make([]byte, r.blockSize)
+	tried := make([]bool, r.numDisks)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for {
+		diskNum := r.chooseMirror(blockNum, tried)
+		if diskNum == -1 {
+			return nil, ErrArrayFailed
+		}
+		tried[diskNum] = true
+		r.readCounts[diskNum]++
+		r.outstanding[diskNum]++
+		r.lastBlock[diskNum] = blockNum
+		disk := r.disks[diskNum]
+
+		// Drop the array lock for the disk read itself, so reads to
+		// different mirrors can be in flight at the same time. The strip
+		// lock keeps writes to this block out until the read is done.
+		r.mu.Unlock()
+		r.countRead()
+		err := disk.Read(blockNum, data)
+		r.mu.Lock()
+
+		r.outstanding[diskNum]--
+		if err == nil {
+			return data, nil
+		}
+		if errors.Is(err, ErrChecksum) && r.disks[diskNum] == disk {
+			if !repair {
+				return nil, ErrChecksum
+			}
+			// Repair the bad copy from another mirror
+			if err := r.heal(diskNum, blockNum, data); err != nil {
+				return nil, err
+			}
+			return data, nil
+		}
+		if r.disks[diskNum] == disk {
+			r.markFailed(diskNum)
+		}
+	}
+}
+
+// readMirror reads a block from the first working mirror other than skip.
+// The rebuild uses it to copy blocks onto a spare.
+func (r *RAID1) readMirror(skip, blockNum int) ([]byte, error) {
 	data := make([]byte, r.blockSize)
-	err := r.disks[0].Read(blockNum, data)
-	return data, err
+	for i := range r.disks {
+		if i == skip || r.isFailed(i, blockNum) {
+			continue
+		}
+		if err := r.read(i, blockNum, data); err == nil {
+			return data, nil
+		}
+	}
+	return nil, ErrArrayFailed
 }
 
 // RAID4 implements block-level striping with a dedicated parity disk
 type RAID4 struct {
-	disks      []*Disk
-	blockSize  int
-	numDisks   int
-	parityDisk int
-	dataDisks  int
+	memberSet
+	blockSize   int
+	numDisks    int
+	parityDisk  int
+	dataDisks   int
+	chunkBlocks int // Blocks per chunk on one disk before moving to the next
 }
 
 func NewRAID4() *RAID4 {
+	return newRAID4(DefaultGeometry())
+}
+
+func newRAID4(g Geometry) *RAID4 {
 	return &RAID4{
-		blockSize:  BlockSize,
-		numDisks:   NumDisks,
-		parityDisk: NumDisks - 1, // Last disk is parity
-		dataDisks:  NumDisks - 1, // All except parity disk
+		memberSet:   memberSet{diskBlocks: g.DiskBlocks, dir: g.Dir, integrity: g.Integrity, backend: g.Backend, sync: g.Sync, identity: identity{level: 4}, stripLocking: true},
+		blockSize:   g.BlockSize,
+		numDisks:    g.NumDisks,
+		parityDisk:  g.NumDisks - 1, // Last disk is parity
+		dataDisks:   g.NumDisks - 1, // All except parity disk
+		chunkBlocks: g.ChunkBlocks,
+	}
+}
+
+// Geometry returns the shape of the array
+func (r *RAID4) Geometry() Geometry {
+	return Geometry{
+		NumDisks:    r.numDisks,
+		BlockSize:   r.blockSize,
+		DiskBlocks:  r.diskBlocks,
+		ChunkBlocks: r.chunkBlocks,
+		Dir:         r.dir,
+		Integrity:   r.integrity,
+		Backend:     r.backend,
+		Sync:        r.sync,
 	}
 }
 
@@ -254,96 +651,146 @@ func (r *RAID4) GetName() string {
 }
 
 func (r *RAID4) Initialize() error {
-	r.disks = make([]*Disk, r.numDisks)
+	r.reset(r.numDisks)
+	r.geometry = r.Geometry
+	r.rebuildBlock = r.rebuildMember
+	r.scrubStrip = r.checkStrip
 	for i := 0; i < r.numDisks; i++ {
-		disk, err := NewDisk(fmt.Sprintf("disk%d.dat", i))
+		disk, err := openMember(r.newDisk, r.Geometry(), i)
 		if err != nil {
 			return err
 		}
 		r.disks[i] = disk
 	}
-	return nil
+	return r.writeSuperblocks()
 }
 
 func (r *RAID4) CleanUp() error {
-	for _, disk := range r.disks {
-		err := disk.Delete()
-		if err != nil {
-			return err
-		}
-	}
-	return nil
+	return r.cleanUp()
 }
 
 func (r *RAID4) GetEffectiveCapacity() int {
-	return r.dataDisks * NumBlocks
+	return r.dataDisks * r.diskBlocks
+}
+
+// mapBlock returns the row (block number on the member disks) and data disk
+// that hold a logical block
+func (r *RAID4) mapBlock(blockNum int) (row, diskNum int) {
+	_, diskNum, row = stripeLocation(blockNum, r.dataDisks, r.chunkBlocks)
+	return row, diskNum
+}
+
+// rebuildMember recomputes a member's block in a strip from the other members
+func (r *RAID4) rebuildMember(diskNum, stripNum int) ([]byte, error) {
+	return r.reconstructBlock(r.blockSize, stripNum, diskNum)
 }
 
 func (r *RAID4) Write(blockNum int, data []byte) error {
-	if len(data) != r.blockSize {
-		return errors.New("data size does not match block size")
+	if err := checkData(data, r.blockSize); err != nil {
+		return err
 	}
+	if err := checkBlock(blockNum, r.GetEffectiveCapacity()); err != nil {
+		return err
+	}
+	r.stripes.enter()
+	defer r.stripes.exit()
+	return r.write(blockNum, data)
+}
 
-	stripNum := blockNum / r.dataDisks
-	diskNum := blockNum % r.dataDisks
+// write writes one block under its strip's lock. It must be called between
+// stripes.enter and stripes.exit.
+func (r *RAID4) write(blockNum int, data []byte) error {
+	stripNum, diskNum := r.mapBlock(blockNum)
+	r.stripes.lock(stripNum)
+	defer r.stripes.unlock(stripNum)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// Write data to data disk and update parity on the parity disk
+	return r.writeParityBlock(r.blockSize, stripNum, diskNum, r.parityDisk, data)
+}
 
-	// Write data to data disk
-	err := r.disks[diskNum].Write(stripNum, data)
-	if err != nil {
+// WriteBlocks writes a run of contiguous blocks, using full-stripe writes
+// for the strips the run covers completely
+func (r *RAID4) WriteBlocks(blockNum int, data []byte) error {
+	if err := checkRun(blockNum, data, r.blockSize, r.GetEffectiveCapacity()); err != nil {
 		return err
 	}
+	r.stripes.enter()
+	defer r.stripes.exit()
+	return r.writeBlocks(r.blockSize, r.dataDisks, r.chunkBlocks, blockNum, data,
+		func(blockNum int) (row, diskNum, parityDisk int) {
+			row, diskNum = r.mapBlock(blockNum)
+			return row, diskNum, r.parityDisk
+		})
+}
 
-	// Calculate and write parity
-	parity := make([]byte, r.blockSize)
-	
-	// Read data from all disks for this strip to calculate parity
-	for i := 0; i < r.dataDisks; i++ {
-		if i == diskNum {
-			// We already have this data, XOR it with parity
-			for j := 0; j < r.blockSize; j++ {
-				parity[j] ^= data[j]
-			}
-		} else {
-			// Read data from other disks
-			blockData := make([]byte, r.blockSize)
-			err := r.disks[i].Read(stripNum, blockData)
-			if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
-				return err
-			}
-			
-			// XOR with parity
-			for j := 0; j < r.blockSize; j++ {
-				parity[j] ^= blockData[j]
-			}
-		}
+// Discard frees count blocks from blockNum. Whole stripes are discarded on
+// every member; blocks in partial stripes are written as zeros.
+func (r *RAID4) Discard(blockNum, count int) error {
+	if err := checkExtent(blockNum, count, r.GetEffectiveCapacity()); err != nil {
+		return err
 	}
-
-	// Write parity to parity disk
-	return r.disks[r.parityDisk].Write(stripNum, parity)
+	r.stripes.enter()
+	defer r.stripes.exit()
+	zeros := make([]byte, r.blockSize)
+	return r.discardBlocks(r.blockSize, r.dataDisks, r.chunkBlocks, blockNum, count,
+		func(blockNum int) error {
+			return r.write(blockNum, zeros)
+		})
 }
 
 func (r *RAID4) Read(blockNum int) ([]byte, error) {
-	stripNum := blockNum / r.dataDisks
-	diskNum := blockNum % r.dataDisks
-
-	data := make([]byte, r.blockSize)
-	err := r.disks[diskNum].Read(stripNum, data)
-	return data, err
+	if err := checkBlock(blockNum, r.GetEffectiveCapacity()); err != nil {
+		return nil, err
+	}
+	r.stripes.enter()
+	defer r.stripes.exit()
+	stripNum, diskNum := r.mapBlock(blockNum)
+	r.stripes.lock(stripNum)
+	defer r.stripes.unlock(stripNum)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// Falls back to rebuilding from parity if the data disk has failed
+	return r.readParityBlock(r.blockSize, stripNum, diskNum)
 }
 
 // RAID5 implements block-level striping with distributed parity
 type RAID5 struct {
-	disks     []*Disk
-	blockSize int
-	numDisks  int
-	dataDisks int
+	memberSet
+	blockSize   int
+	numDisks    int
+	dataDisks   int
+	chunkBlocks int       // Blocks per chunk on one disk before moving to the next
+	reshape     *reshaper // Current or last reshape, nil if there has been none
 }
 
 func NewRAID5() *RAID5 {
+	return newRAID5(DefaultGeometry())
+}
+
+func newRAID5(g Geometry) *RAID5 {
 	return &RAID5{
-		blockSize: BlockSize,
-		numDisks:  NumDisks,
-		dataDisks: NumDisks - 1, // One disk's worth of capacity is used for parity
+		memberSet:   memberSet{diskBlocks: g.DiskBlocks, dir: g.Dir, integrity: g.Integrity, backend: g.Backend, sync: g.Sync, identity: identity{level: 5}, stripLocking: true},
+		blockSize:   g.BlockSize,
+		numDisks:    g.NumDisks,
+		dataDisks:   g.NumDisks - 1, // One disk's worth of capacity is used for parity
+		chunkBlocks: g.ChunkBlocks,
+	}
+}
+
+// Geometry returns the shape of the array
+func (r *RAID5) Geometry() Geometry {
+	return Geometry{
+		NumDisks:    r.numDisks,
+		BlockSize:   r.blockSize,
+		DiskBlocks:  r.diskBlocks,
+		ChunkBlocks: r.chunkBlocks,
+		Dir:         r.dir,
+		Integrity:   r.integrity,
+		Backend:     r.backend,
+		Sync:        r.sync,
 	}
 }
 
@@ -352,29 +799,52 @@ func (r *RAID5) GetName() string {
 }
 
 func (r *RAID5) Initialize() error {
-	r.disks = make([]*Disk, r.numDisks)
+	r.setup()
 	for i := 0; i < r.numDisks; i++ {
-		disk, err := NewDisk(fmt.Sprintf("disk%d.dat", i))
+		disk, err := openMember(r.newDisk, r.Geometry(), i)
 		if err != nil {
 			return err
 		}
 		r.disks[i] = disk
 	}
-	return nil
+	return r.writeSuperblocks()
+}
+
+// setup prepares the member set for Initialize, before any disks are opened
+func (r *RAID5) setup() {
+	r.reset(r.numDisks)
+	r.geometry = r.Geometry
+	r.rebuildBlock = r.rebuildMember
+	r.scrubStrip = r.checkStrip
+	r.reshape = nil
+}
+
+// Close stops any reshape, recording how far it got, and closes the array
+func (r *RAID5) Close() error {
+	r.reshape.halt()
+	return r.memberSet.Close()
 }
 
 func (r *RAID5) CleanUp() error {
-	for _, disk := range r.disks {
-		err := disk.Delete()
-		if err != nil {
-			return err
-		}
-	}
-	return nil
+	r.reshape.halt()
+	r.reshape.removeBackup()
+	return r.cleanUp()
 }
 
+// GetEffectiveCapacity returns the capacity in blocks. While a reshape is
+// running this is still the capacity of the old layout.
 func (r *RAID5) GetEffectiveCapacity() int {
-	return r.dataDisks * NumBlocks
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.capacity()
+}
+
+// capacity returns the capacity in blocks. Must be called with mu held.
+func (r *RAID5) capacity() int {
+	if r.reshape.active() {
+		return r.reshape.oldCapacity
+	}
+	return r.dataDisks * r.diskBlocks
 }
 
 // getParityDisk returns the disk number that stores parity for a given strip
@@ -383,94 +853,211 @@ func (r *RAID5) getParityDisk(stripNum int) int {
 	return (r.numDisks - 1 - (stripNum % r.numDisks))
 }
 
-func (r *RAID5) Write(blockNum int, data []byte) error {
-	if len(data) != r.blockSize {
-		return errors.New("data size does not match block size")
-	}
+// mapBlock returns the row (block number on the member disks), data disk and
+// parity disk for a logical block
+func (r *RAID5) mapBlock(blockNum int) (row, diskNum, parityDisk int) {
+	stripNum, stripOffset, row := stripeLocation(blockNum, r.dataDisks, r.chunkBlocks)
+
+	parityDisk = r.getParityDisk(stripNum)
 
-	stripNum := blockNum / r.dataDisks
-	stripOffset := blockNum % r.dataDisks
-	
-	parityDisk := r.getParityDisk(stripNum)
-	
 	// Adjust the disk number if it's affected by the parity placement
-	diskNum := stripOffset
+	diskNum = stripOffset
 	if diskNum >= parityDisk {
 		diskNum++
 	}
-	
+
 	// If diskNum is now equal to numDisks, wrap around
 	if diskNum >= r.numDisks {
 		diskNum = 0
 	}
+	return row, diskNum, parityDisk
+}
 
-	// Write data to the data disk
-	err := r.disks[diskNum].Write(stripNum, data)
-	if err != nil {
+// rebuildMember recomputes a member's block in a strip from the other members
+func (r *RAID5) rebuildMember(diskNum, stripNum int) ([]byte, error) {
+	return r.reconstructBlock(r.blockSize, stripNum, diskNum)
+}
+
+func (r *RAID5) Write(blockNum int, data []byte) error {
+	if err := checkData(data, r.blockSize); err != nil {
 		return err
 	}
+	r.stripes.enter()
+	defer r.stripes.exit()
+	return r.write(blockNum, data)
+}
 
-	// Calculate and write parity
-	parity := make([]byte, r.blockSize)
-	
-	// Read data from all disks for this strip to calculate parity
-	for i := 0; i < r.numDisks; i++ {
-		if i == parityDisk {
-			continue // Skip parity disk when calculating
-		}
-		
-		if i == diskNum {
-			// We already have this data, XOR it with parity
-			for j := 0; j < r.blockSize; j++ {
-				parity[j] ^= data[j]
-			}
-		} else {
-			// Read data from other data disks
-			blockData := make([]byte, r.blockSize)
-			err := r.disks[i].Read(stripNum, blockData)
-			if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+// write writes one block under its strip's lock. The layout cannot change
+// while an operation is in progress, so it must be called between
+// stripes.enter and stripes.exit.
+func (r *RAID5) write(blockNum int, data []byte) error {
+	stripNum, diskNum, parityDisk := r.mapBlock(blockNum)
+	r.stripes.lock(stripNum)
+	defer r.stripes.unlock(stripNum)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := checkBlock(blockNum, r.capacity()); err != nil {
+		return err
+	}
+	if r.reshape.pending(blockNum) {
+		return r.reshape.oldWrite(blockNum, data)
+	}
+	if err := r.reshape.commitWrite(blockNum); err != nil {
+		return err
+	}
+
+	// Write data to the data disk and update parity on this strip's parity disk
+	return r.writeParityBlock(r.blockSize, stripNum, diskNum, parityDisk, data)
+}
+
+// WriteBlocks writes a run of contiguous blocks, using full-stripe writes
+// for the strips the run covers completely. While a reshape is running the
+// blocks are written one at a time.
+func (r *RAID5) WriteBlocks(blockNum int, data []byte) error {
+	r.stripes.enter()
+	defer r.stripes.exit()
+	r.mu.Lock()
+	reshaping := r.reshape.active()
+	capacity := r.capacity()
+	r.mu.Unlock()
+	if err := checkRun(blockNum, data, r.blockSize, capacity); err != nil {
+		return err
+	}
+	if reshaping {
+		for offset := 0; offset < len(data); offset += r.blockSize {
+			if err := r.write(blockNum, data[offset:offset+r.blockSize]); err != nil {
 				return err
 			}
-			
-			// XOR with parity
-			for j := 0; j < r.blockSize; j++ {
-				parity[j] ^= blockData[j]
-			}
+			blockNum++
 		}
+		return nil
 	}
+	return r.writeBlocks(r.blockSize, r.dataDisks, r.chunkBlocks, blockNum, data, r.mapBlock)
+}
 
-	// Write parity to parity disk
-	return r.disks[parityDisk].Write(stripNum, parity)
+// Discard frees count blocks from blockNum. Whole stripes are discarded on
+// every member; blocks in partial stripes, or anywhere while a reshape is
+// running, are written as zeros.
+func (r *RAID5) Discard(blockNum, count int) error {
+	r.stripes.enter()
+	defer r.stripes.exit()
+	r.mu.Lock()
+	reshaping := r.reshape.active()
+	capacity := r.capacity()
+	r.mu.Unlock()
+	if err := checkExtent(blockNum, count, capacity); err != nil {
+		return err
+	}
+	zeros := make([]byte, r.blockSize)
+	writeZero := func(blockNum int) error {
+		return r.write(blockNum, zeros)
+	}
+	if reshaping {
+		for i := 0; i < count; i++ {
+			if err := writeZero(blockNum + i); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return r.discardBlocks(r.blockSize, r.dataDisks, r.chunkBlocks, blockNum, count, writeZero)
 }
 
 func (r *RAID5) Read(blockNum int) ([]byte, error) {
-	stripNum := blockNum / r.dataDisks
-	stripOffset := blockNum % r.dataDisks
-	
-	parityDisk := r.getParityDisk(stripNum)
-	
-	// Adjust the disk number if it's affected by the parity placement
-	diskNum := stripOffset
-	if diskNum >= parityDisk {
-		diskNum++
+	r.stripes.enter()
+	defer r.stripes.exit()
+	stripNum, diskNum, _ := r.mapBlock(blockNum)
+	r.stripes.lock(stripNum)
+	defer r.stripes.unlock(stripNum)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := checkBlock(blockNum, r.capacity()); err != nil {
+		return nil, err
 	}
-	
-	// If diskNum is now equal to numDisks, wrap around
-	if diskNum >= r.numDisks {
-		diskNum = 0
+	if r.reshape.pending(blockNum) {
+		return r.reshape.oldRead(blockNum)
 	}
 
-	data := make([]byte, r.blockSize)
-	err := r.disks[diskNum].Read(stripNum, data)
-	return data, err
+	// Falls back to rebuilding from parity if the data disk has failed
+	return r.readParityBlock(r.blockSize, stripNum, diskNum)
+}
+
+// BenchmarkStats holds the results of one benchmark run
+type BenchmarkStats struct {
+	WriteTime time.Duration
+	ReadTime  time.Duration
+
+	// Physical disk I/Os per logical write, 0 if the array does not count them
+	IOsPerWrite float64
+
+	// Time the simulated disks took, zero if the array has none
+	VirtualWriteTime time.Duration
+	VirtualReadTime  time.Duration
+
+	// Cache counts, zero if the benchmark ran without a cache
+	Cache CacheStats
+
+	// Queue depth of each member disk, nil if the array does not report it
+	QueueDepth []QueueStats
+}
+
+// meanQueueDepth returns the average queue depth over the members that
+// tracked it and the deepest queue any of them saw
+func (s BenchmarkStats) meanQueueDepth() (mean float64, most int64) {
+	var tracked int
+	for _, q := range s.QueueDepth {
+		if q.Requests > 0 {
+			mean += q.AvgDepth
+			most = max(most, q.MaxDepth)
+			tracked++
+		}
+	}
+	if tracked > 0 {
+		mean /= float64(tracked)
+	}
+	return mean, most
+}
+
+// BenchmarkOptions selects how RunBenchmark drives the array
+type BenchmarkOptions struct {
+	// Sequential writes the data in SequentialChunkBlocks runs through
+	// WriteBlocks, so parity arrays can use full-stripe writes
+	Sequential bool
+
+	// CacheBlocks puts a block cache of that many blocks in front of the
+	// array, in CacheMode. 0 runs without a cache.
+	CacheBlocks int
+	CacheMode   CacheMode
+
+	// Random writes and reads the blocks in a shuffled order, the same on
+	// every run. Sequential writes still go in order.
+	Random bool
+
+	// VirtualTime makes PrintBenchmarkTable report the time the simulated
+	// disks took instead of wall-clock time
+	VirtualTime bool
 }
 
 // RunBenchmark runs benchmark tests on a RAID implementation
-func RunBenchmark(raid RAID, numBlocks int) (writeTime, readTime time.Duration, err error) {
+func RunBenchmark(raid RAID, numBlocks int, opts BenchmarkOptions) (stats BenchmarkStats, err error) {
+	// Physical I/O and virtual time are counted below the cache, if there
+	// is one
+	array := raid
+	counter, counted := raid.(ioStatser)
+	timer, timed := raid.(virtualTimer)
+	queues, queued := raid.(memberQueueStatser)
+	var cache *CachedRAID
+	if opts.CacheBlocks > 0 {
+		cache = NewCachedRAID(raid, opts.CacheBlocks, opts.CacheMode)
+		raid = cache
+	}
+
 	// Initialize RAID
 	err = raid.Initialize()
 	if err != nil {
-		return 0, 0, err
+		return stats, err
 	}
 	defer raid.CleanUp()
 
@@ -480,27 +1067,157 @@ func RunBenchmark(raid RAID, numBlocks int) (writeTime, readTime time.Duration,
 		testData[i] = byte(i % 256)
 	}
 
+	order := make([]int, numBlocks)
+	for i := range order {
+		order[i] = i
+	}
+	if opts.Random {
+		order = rand.New(rand.NewSource(1)).Perm(numBlocks)
+	}
+
 	// Measure write performance
+	var before IOStats
+	if counted {
+		before = counter.IOStats()
+	}
+	var virtualStart time.Duration
+	if timed {
+		// Each phase starts with every disk idle
+		virtualStart = timer.VirtualTime()
+		timer.AdvanceTo(virtualStart)
+	}
 	writeStart := time.Now()
-	for i := 0; i < numBlocks; i++ {
-		err = raid.Write(i, testData)
-		if err != nil {
-			return 0, 0, err
+	if opts.Sequential {
+		chunk := make([]byte, 0, SequentialChunkBlocks*BlockSize)
+		for i := 0; i < SequentialChunkBlocks; i++ {
+			chunk = append(chunk, testData...)
+		}
+		for i := 0; i < numBlocks; i += SequentialChunkBlocks {
+			n := min(SequentialChunkBlocks, numBlocks-i)
+			err = WriteBlocks(raid, i, chunk[:n*BlockSize], BlockSize)
+			if err != nil {
+				return stats, err
+			}
 		}
+	} else {
+		for _, i := range order {
+			err = raid.Write(i, testData)
+			if err != nil {
+				return stats, err
+			}
+		}
+	}
+	// Writes the sync policy has held back are synced within the write phase.
+	// Only the array is flushed; a write-back cache keeps its dirty blocks.
+	if err = array.Flush(); err != nil {
+		return stats, err
+	}
+	stats.WriteTime = time.Since(writeStart)
+	if counted && numBlocks > 0 {
+		ios := counter.IOStats().Total() - before.Total()
+		stats.IOsPerWrite = float64(ios) / float64(numBlocks)
+	}
+
+	// Flush a write-back cache so its writes are timed with the write phase
+	if cache != nil && timed {
+		if err = cache.Flush(); err != nil {
+			return stats, err
+		}
+	}
+	if timed {
+		virtualEnd := timer.VirtualTime()
+		stats.VirtualWriteTime = virtualEnd - virtualStart
+		virtualStart = virtualEnd
+		timer.AdvanceTo(virtualStart)
 	}
-	writeTime = time.Since(writeStart)
 
 	// Measure read performance
 	readStart := time.Now()
-	for i := 0; i < numBlocks; i++ {
+	for _, i := range order {
 		_, err = raid.Read(i)
 		if err != nil {
-			return 0, 0, err
+			return stats, err
 		}
 	}
-	readTime = time.Since(readStart)
+	stats.ReadTime = time.Since(readStart)
+	if timed {
+		stats.VirtualReadTime = timer.VirtualTime() - virtualStart
+	}
 
-	return writeTime, readTime, nil
+	if cache != nil {
+		stats.Cache = cache.CacheStats()
+	}
+	if queued {
+		stats.QueueDepth = queues.MemberQueueStats()
+	}
+	return stats, nil
+}
+
+// PrintBenchmarkTable benchmarks each array and prints one row per array.
+// Overhead is measured against the raw capacity of numDisks disks.
+func PrintBenchmarkTable(raids []RAID, numDisks, numBenchmarkBlocks int, opts BenchmarkOptions) {
+	fmt.Printf("%-8s %-15s %-15s %-15s %-15s %-15s %-15s %-15s %-15s",
+		"RAID", "Write Time", "Write Speed", "Read Time", "Read Speed", "Effective Cap", "Overhead", "IOs/Write", "Queue Depth")
+	if opts.CacheBlocks > 0 {
+		fmt.Printf(" %-15s", "Cache Hits")
+	}
+	fmt.Println()
+
+	for _, raid := range raids {
+		stats, err := RunBenchmark(raid, numBenchmarkBlocks, opts)
+		if err != nil {
+			log.Fatalf("Error running benchmark for %s: %v", raid.GetName(), err)
+		}
+
+		if opts.VirtualTime {
+			stats.WriteTime, stats.ReadTime = stats.VirtualWriteTime, stats.VirtualReadTime
+		}
+		dataSize := numBenchmarkBlocks * BlockSize
+		writeSpeed := CalculateSpeed(dataSize, stats.WriteTime)
+		readSpeed := CalculateSpeed(dataSize, stats.ReadTime)
+		effectiveCap := raid.GetEffectiveCapacity() * BlockSize / (1024 * 1024) // in MB
+		overhead := 100.0 - (float64(effectiveCap) / float64(numDisks*NumBlocks*BlockSize/(1024*1024)) * 100.0)
+
+		queueDepth := "-"
+		if mean, most := stats.meanQueueDepth(); most > 0 {
+			queueDepth = fmt.Sprintf("%.2f (max %d)", mean, most)
+		}
+		fmt.Printf("%-8s %-15s %-15.2f %-15s %-15.2f %-15d %-15.2f %-15.2f %-15s",
+			raid.GetName(),
+			FormatDuration(stats.WriteTime),
+			writeSpeed,
+			FormatDuration(stats.ReadTime),
+			readSpeed,
+			effectiveCap,
+			overhead,
+			stats.IOsPerWrite,
+			queueDepth)
+		if opts.CacheBlocks > 0 {
+			fmt.Printf(" %-15s", fmt.Sprintf("%.1f%%", stats.Cache.HitRate()*100))
+		}
+		fmt.Println()
+	}
+}
+
+// PrintSyncTable prints the write speed of file-backed RAID0, RAID1 and
+// RAID5 arrays under each sync policy, to show what fsync costs
+func PrintSyncTable(policies []SyncPolicy, numBenchmarkBlocks int) {
+	fmt.Printf("%-26s %-15s %-15s %-15s\n", "Sync Policy", "RAID0 Write", "RAID1 Write", "RAID5 Write")
+	for _, policy := range policies {
+		g := DefaultGeometry()
+		g.Backend = FileBackend
+		g.Sync = policy
+		fmt.Printf("%-26s", policy)
+		for _, raid := range []RAID{newRAID0(g), newRAID1(g), newRAID5(g)} {
+			stats, err := RunBenchmark(raid, numBenchmarkBlocks, BenchmarkOptions{})
+			if err != nil {
+				log.Fatalf("Error running benchmark for %s: %v", raid.GetName(), err)
+			}
+			speed := CalculateSpeed(numBenchmarkBlocks*BlockSize, stats.WriteTime)
+			fmt.Printf(" %-15s", fmt.Sprintf("%.2f MB/s", speed))
+		}
+		fmt.Println()
+	}
 }
 
 // FormatDuration formats a duration as seconds with 2 decimal places
@@ -514,6 +1231,14 @@ func CalculateSpeed(dataSize int, duration time.Duration) float64 {
 }
 
 func main() {
+	backendName := flag.String("backend", FileBackend.String(), "member disk backend: file, sparse, memory, simulated or direct")
+	flag.Parse()
+	backend, err := ParseBackend(*backendName)
+	if err != nil {
+		log.Fatal(err)
+	}
+	DefaultBackend = backend
+
 	// Calculate how many blocks for 100MB
 	numBenchmarkBlocks := DataSize / BlockSize
 	if DataSize%BlockSize != 0 {
@@ -524,7 +1249,8 @@ func main() {
 	fmt.Printf("Block Size: %d bytes\n", BlockSize)
 	fmt.Printf("Number of Disks: %d\n", NumDisks)
 	fmt.Printf("Data Size: %d MB\n", DataSize/1024/1024)
-	fmt.Printf("Number of Blocks: %d\n\n", numBenchmarkBlocks)
+	fmt.Printf("Number of Blocks: %d\n", numBenchmarkBlocks)
+	fmt.Printf("Disk Backend: %s\n\n", backend)
 
 	// Run benchmarks for each RAID level
 	raids := []RAID{
@@ -532,31 +1258,79 @@ func main() {
 		NewRAID1(),
 		NewRAID4(),
 		NewRAID5(),
+		NewRAID6(),
 	}
 
-	fmt.Printf("%-8s %-15s %-15s %-15s %-15s %-15s %-15s\n",
-		"RAID", "Write Time", "Write Speed", "Read Time", "Read Speed", "Effective Cap", "Overhead")
+	PrintBenchmarkTable(raids, NumDisks, numBenchmarkBlocks, BenchmarkOptions{})
 
-	for _, raid := range raids {
-		writeTime, readTime, err := RunBenchmark(raid, numBenchmarkBlocks)
-		if err != nil {
-			log.Fatalf("Error running benchmark for %s: %v", raid.GetName(), err)
-		}
+	// Sequential writes let the parity levels write whole stripes at once
+	fmt.Printf("\nSequential (full-stripe) writes:\n")
+	sequential := []RAID{
+		NewRAID0(),
+		NewRAID4(),
+		NewRAID5(),
+	}
+	PrintBenchmarkTable(sequential, NumDisks, numBenchmarkBlocks, BenchmarkOptions{Sequential: true})
 
-		writeSpeed := CalculateSpeed(DataSize, writeTime)
-		readSpeed := CalculateSpeed(DataSize, readTime)
-		effectiveCap := raid.GetEffectiveCapacity() * BlockSize / (1024 * 1024) // in MB
-		overhead := 100.0 - (float64(effectiveCap) / float64(NumDisks*NumBlocks*BlockSize/(1024*1024)) * 100.0)
+	// Compare nested levels with RAID5 on the same number of disks
+	fmt.Printf("\nNested RAID on %d disks:\n", NestedDisks)
+	geometry := DefaultGeometry()
+	geometry.NumDisks = NestedDisks
+	raid5, err := NewRAID5WithGeometry(geometry)
+	if err != nil {
+		log.Fatalf("Failed to create RAID5: %v", err)
+	}
+	raid10, err := NewRAID10(NestedDisks/2, 2)
+	if err != nil {
+		log.Fatalf("Failed to create RAID10: %v", err)
+	}
+	raid50, err := NewRAID50(2, NestedDisks/2)
+	if err != nil {
+		log.Fatalf("Failed to create RAID50: %v", err)
+	}
+	nested := []RAID{raid5, raid10, raid50}
+	PrintBenchmarkTable(nested, NestedDisks, numBenchmarkBlocks, BenchmarkOptions{})
 
-		fmt.Printf("%-8s %-15s %-15.2f %-15s %-15.2f %-15d %-15.2f\n",
-			raid.GetName(),
-			FormatDuration(writeTime),
-			writeSpeed,
-			FormatDuration(readTime),
-			readSpeed,
-			effectiveCap,
-			overhead)
+	// A write-back cache absorbs writes until it has to evict
+	fmt.Printf("\nWith a %d-block write-back cache:\n", BenchmarkCacheBlocks)
+	cached := []RAID{
+		NewRAID1(),
+		NewRAID5(),
+		NewRAID6(),
+	}
+	PrintBenchmarkTable(cached, NumDisks, numBenchmarkBlocks,
+		BenchmarkOptions{CacheBlocks: BenchmarkCacheBlocks, CacheMode: WriteBack})
+
+	// Syncing less often trades durability for speed. Every policy's write
+	// time ends with a Flush, so all of them get the data onto the disks.
+	fmt.Printf("\nSync policies, %d blocks on file-backed disks:\n", SyncBenchmarkBlocks)
+	PrintSyncTable([]SyncPolicy{
+		{Mode: SyncAlways},
+		{Mode: SyncBatched, Writes: 64},
+		{Mode: SyncBatched, Interval: 100 * time.Millisecond},
+		{Mode: SyncNever},
+	}, SyncBenchmarkBlocks)
+
+	// Simulated disks charge seek, rotation and transfer time instead of
+	// waiting for fsync, so the results can be set against the OSTEP analysis.
+	// Sequential writes go in full stripes, as the analysis assumes.
+	DefaultBackend = SimulatedBackend
+	for _, random := range []bool{false, true} {
+		pattern := "sequential"
+		if random {
+			pattern = "random"
+		}
+		fmt.Printf("\nSimulated disks, %s blocks (virtual time):\n", pattern)
+		simulated := []RAID{
+			NewRAID0(),
+			NewRAID1(),
+			NewRAID4(),
+			NewRAID5(),
+		}
+		PrintBenchmarkTable(simulated, NumDisks, numBenchmarkBlocks,
+			BenchmarkOptions{Sequential: !random, Random: random, VirtualTime: true})
 	}
+	DefaultBackend = backend
 
 	// Analysis and comparison with textbook expectations
 	fmt.Printf("\nAnalysis:\n")
@@ -564,6 +1338,11 @@ func main() {
 	fmt.Printf("- RAID1: Provides redundancy but at the cost of capacity (1/N of total capacity).\n")
 	fmt.Printf("- RAID4: Better capacity utilization than RAID1 but parity disk becomes a bottleneck for writes.\n")
 	fmt.Printf("- RAID5: Distributes parity to avoid the bottleneck in RAID4 while maintaining redundancy.\n")
+	fmt.Printf("- RAID6: Adds a second (Q) parity block so any two disks can fail, at the cost of more capacity and slower writes.\n")
+	fmt.Printf("- RAID10: Stripes over mirror pairs, trading half the capacity for fast writes and no parity updates.\n")
+	fmt.Printf("- RAID50: Stripes over RAID5 groups, so each parity update only touches one group.\n")
+	fmt.Printf("- Sync policies: batching fsyncs, or leaving them to Flush, removes most of the cost of small file-backed writes.\n")
 	fmt.Printf("\nIf the performance trends match textbook expectations, RAID0 should be fastest for both reads and writes,\n")
 	fmt.Printf("while RAID5 should offer better write performance than RAID4 due to distributed parity.\n")
+	fmt.Printf("Full-stripe sequential writes should bring RAID4 and RAID5 close to RAID0, since parity needs no reads.\n")
 }
\ No newline at end of file
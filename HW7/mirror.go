@@ -0,0 +1,69 @@
+package main
+
+// ReadPolicy selects which mirror serves each RAID1 read
+type ReadPolicy int
+
+const (
+	ReadFirst            ReadPolicy = iota // First working mirror
+	ReadRoundRobin                         // Rotate across working mirrors
+	ReadLeastOutstanding                   // Mirror with the fewest reads in flight
+	ReadNearest                            // Mirror whose last access was closest, like a short seek
+)
+
+// SetReadPolicy selects how reads are balanced across mirrors
+func (r *RAID1) SetReadPolicy(policy ReadPolicy) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.readPolicy = policy
+}
+
+// ReadCounts returns how many reads each mirror has served
+func (r *RAID1) ReadCounts() []int64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]int64(nil), r.readCounts...)
+}
+
+// chooseMirror picks a working mirror for a block that has not been tried
+// yet, or returns -1 if none is left. Must be called with mu held.
+func (r *RAID1) chooseMirror(blockNum int, tried []bool) int {
+	best := -1
+	for n := 0; n < r.numDisks; n++ {
+		i := n
+		if r.readPolicy == ReadRoundRobin {
+			i = (r.nextMirror + n) % r.numDisks
+		}
+		if tried[i] || r.isFailed(i, blockNum) {
+			continue
+		}
+		if best == -1 || r.betterMirror(i, best, blockNum) {
+			best = i
+		}
+	}
+
+	if best != -1 && r.readPolicy == ReadRoundRobin {
+		r.nextMirror = (best + 1) % r.numDisks
+	}
+	return best
+}
+
+// betterMirror reports whether mirror i should serve a read ahead of the
+// current best candidate under the read policy
+func (r *RAID1) betterMirror(i, best, blockNum int) bool {
+	switch r.readPolicy {
+	case ReadLeastOutstanding:
+		return r.outstanding[i] < r.outstanding[best]
+	case ReadNearest:
+		return seekDistance(r.lastBlock[i], blockNum) < seekDistance(r.lastBlock[best], blockNum)
+	}
+	// ReadFirst and ReadRoundRobin take the first candidate they see
+	return false
+}
+
+// seekDistance is how far a disk head moves between two blocks
+func seekDistance(from, to int) int {
+	if from > to {
+		return from - to
+	}
+	return to - from
+}
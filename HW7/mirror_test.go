@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newTestMirror creates a RAID1 with the first blocks written
+func newTestMirror(t *testing.T, policy ReadPolicy) *RAID1 {
+	raid := NewRAID1()
+	err := raid.Initialize()
+	if err != nil {
+		t.Fatalf("Failed to initialize RAID1: %v", err)
+	}
+	writeAndVerify(t, raid, 10)
+	raid.SetReadPolicy(policy)
+	raid.readCounts = make([]int64, raid.numDisks)
+	return raid
+}
+
+// TestReadFirstPolicy tests that the default policy reads only the first mirror
+func TestReadFirstPolicy(t *testing.T) {
+	raid := newTestMirror(t, ReadFirst)
+	defer raid.CleanUp()
+
+	verifyBlocks(t, raid, 10)
+	expected := []int64{10, 0, 0, 0, 0}
+	for i, count := range raid.ReadCounts() {
+		if count != expected[i] {
+			t.Errorf("ReadFirst read counts %v, expected %v", raid.ReadCounts(), expected)
+			break
+		}
+	}
+}
+
+// TestRoundRobinPolicy tests that reads are spread evenly and that a failed
+// mirror is skipped
+func TestRoundRobinPolicy(t *testing.T) {
+	raid := newTestMirror(t, ReadRoundRobin)
+	defer raid.CleanUp()
+
+	verifyBlocks(t, raid, 10)
+	for i, count := range raid.ReadCounts() {
+		if count != 2 {
+			t.Errorf("Mirror %d served %d of 10 round-robin reads, expected 2", i, count)
+		}
+	}
+
+	raid.FailDisk(2)
+	raid.readCounts = make([]int64, raid.numDisks)
+	for pass := 0; pass < 2; pass++ {
+		verifyBlocks(t, raid, 10)
+	}
+	expected := []int64{5, 5, 0, 5, 5}
+	for i, count := range raid.ReadCounts() {
+		if count != expected[i] {
+			t.Errorf("Round-robin read counts with mirror 2 failed: %v, expected %v", raid.ReadCounts(), expected)
+			break
+		}
+	}
+}
+
+// TestNearestPolicy tests that reads go to the mirror whose head is closest
+func TestNearestPolicy(t *testing.T) {
+	raid := newTestMirror(t, ReadNearest)
+	defer raid.CleanUp()
+
+	// Two interleaved sequential streams, far apart on disk and from the
+	// last write. Each stream should stay on the mirror it started on.
+	for i := 0; i < 5; i++ {
+		for _, blockNum := range []int{5000 + i, 1000 + i} {
+			if _, err := raid.Read(blockNum); err != nil {
+				t.Fatalf("Failed to read RAID1 block %d: %v", blockNum, err)
+			}
+		}
+	}
+	expected := []int64{5, 5, 0, 0, 0}
+	for i, count := range raid.ReadCounts() {
+		if count != expected[i] {
+			t.Errorf("Nearest read counts %v, expected %v", raid.ReadCounts(), expected)
+			break
+		}
+	}
+}
+
+// TestLeastOutstandingPolicy tests that concurrent reads are spread across
+// mirrors by how many reads each has in flight
+func TestLeastOutstandingPolicy(t *testing.T) {
+	raid := newTestMirror(t, ReadLeastOutstanding)
+	defer raid.CleanUp()
+	faulty := injectFaults(raid.disks)
+
+	const latency = 50 * time.Millisecond
+	for _, disk := range faulty {
+		disk.SetLatency(latency)
+	}
+
+	start := time.Now()
+	var wg sync.WaitGroup
+	for blockNum := 0; blockNum < raid.numDisks; blockNum++ {
+		wg.Add(1)
+		go func(blockNum int) {
+			defer wg.Done()
+			if _, err := raid.Read(blockNum); err != nil {
+				t.Errorf("Failed to read RAID1 block %d: %v", blockNum, err)
+			}
+		}(blockNum)
+	}
+	wg.Wait()
+
+	for i, count := range raid.ReadCounts() {
+		if count != 1 {
+			t.Errorf("Mirror %d served %d of %d concurrent reads, expected 1", i, count, raid.numDisks)
+		}
+	}
+	if elapsed := time.Since(start); elapsed > 3*latency {
+		t.Errorf("Concurrent reads took %v, expected about %v", elapsed, latency)
+	}
+}
+
+// TestLeastOutstandingHotBlock tests that concurrent reads of the same block
+// run at once and are spread across mirrors, rather than taking turns on one
+func TestLeastOutstandingHotBlock(t *testing.T) {
+	raid := newTestMirror(t, ReadLeastOutstanding)
+	defer raid.CleanUp()
+	faulty := injectFaults(raid.disks)
+
+	const latency = 50 * time.Millisecond
+	for _, disk := range faulty {
+		disk.SetLatency(latency)
+	}
+
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < raid.numDisks; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if data, err := raid.Read(0); err != nil || !bytes.Equal(data, blockPattern(0)) {
+				t.Errorf("Failed to read RAID1 block 0: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	for i, count := range raid.ReadCounts() {
+		if count != 1 {
+			t.Errorf("Mirror %d served %d of %d concurrent reads of one block, expected 1", i, count, raid.numDisks)
+		}
+	}
+	if elapsed := time.Since(start); elapsed > 3*latency {
+		t.Errorf("Concurrent reads of one block took %v, expected about %v", elapsed, latency)
+	}
+}
+
+// TestMirrorReadDuringWrite tests that a read racing writes to the same block
+// returns one whole version of it, never a mix of two
+func TestMirrorReadDuringWrite(t *testing.T) {
+	raid, err := NewRAID1WithGeometry(testGeometry(t, 3, 1))
+	if err != nil {
+		t.Fatalf("Failed to create RAID1: %v", err)
+	}
+	if err := raid.Initialize(); err != nil {
+		t.Fatalf("Failed to initialize RAID1: %v", err)
+	}
+	defer raid.CleanUp()
+	raid.SetReadPolicy(ReadRoundRobin)
+
+	versions := [][]byte{blockPattern(1), blockPattern(2)}
+	raid.Write(0, versions[0])
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 200; i++ {
+			if err := raid.Write(0, versions[i%2]); err != nil {
+				t.Errorf("Failed to write block 0: %v", err)
+			}
+		}
+	}()
+	for i := 0; i < 200; i++ {
+		data, err := raid.Read(0)
+		if err != nil {
+			t.Fatalf("Failed to read block 0: %v", err)
+		}
+		if !bytes.Equal(data, versions[0]) && !bytes.Equal(data, versions[1]) {
+			t.Fatalf("Read %d returned a block that is neither version", i)
+		}
+	}
+	wg.Wait()
+}
@@ -0,0 +1,386 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+const (
+	modelRuns  = 20  // Random sequences run against each array
+	modelSteps = 200 // Operations in each sequence
+)
+
+// modelOpKind is an operation the model-based tests run against an array
+type modelOpKind int
+
+const (
+	modelWrite   modelOpKind = iota
+	modelRead                // Read a block and compare it with the model
+	modelFail                // Fail a member disk
+	modelReplace             // Attach a spare, which replaces a failed member
+	modelRebuild             // Wait for the rebuild onto a spare to finish
+)
+
+// modelOp is one step of a model-based test
+type modelOp struct {
+	kind    modelOpKind
+	block   int // Block written or read
+	version int // Tells successive writes of a block apart
+	disk    int // Member failed
+}
+
+func (op modelOp) String() string {
+	switch op.kind {
+	case modelWrite:
+		return fmt.Sprintf("write block %d (version %d)", op.block, op.version)
+	case modelRead:
+		return fmt.Sprintf("read block %d", op.block)
+	case modelFail:
+		return fmt.Sprintf("fail disk %d", op.disk)
+	case modelReplace:
+		return "add spare"
+	}
+	return "wait for rebuild"
+}
+
+// modelBlock returns the contents of a version of a block. The block number
+// and version head the block, so data written to the wrong place or a stale
+// copy never matches.
+func modelBlock(blockNum, version int) []byte {
+	data := make([]byte, TestBlockSize)
+	binary.LittleEndian.PutUint32(data, uint32(blockNum))
+	binary.LittleEndian.PutUint32(data[4:], uint32(version))
+	for i := 8; i < len(data); i++ {
+		data[i] = byte((i + blockNum*7 + version*13) % 251)
+	}
+	return data
+}
+
+// modelTarget is an array the model-based tests run against
+type modelTarget struct {
+	name       string
+	numDisks   int
+	redundancy int // Members the array can lose; 0 for no failures
+	newRAID    func() (RAID, error)
+}
+
+// memberFailer is the part of the redundant levels that fails and replaces
+// members
+type memberFailer interface {
+	FailDisk(diskNum int)
+	AddSpare(disk BlockDevice)
+	WaitRebuild() error
+}
+
+// raidModel is the reference an array is checked against: a map of the
+// blocks written, and which members are lost. A member stays lost until the
+// rebuild onto its spare has been waited for.
+type raidModel struct {
+	blocks     map[int][]byte
+	redundancy int
+	failed     []bool
+	spares     int
+	rebuilding int // Member being rebuilt onto a spare, -1 for none
+}
+
+func newRAIDModel(target modelTarget) *raidModel {
+	return &raidModel{
+		blocks:     make(map[int][]byte),
+		redundancy: target.redundancy,
+		failed:     make([]bool, target.numDisks),
+		rebuilding: -1,
+	}
+}
+
+// lost returns how many members the model counts as lost
+func (m *raidModel) lost() int {
+	n := 0
+	for _, failed := range m.failed {
+		if failed {
+			n++
+		}
+	}
+	return n
+}
+
+// valid reports whether an operation can run without losing data, and
+// without the array's choice of which member a spare replaces becoming a
+// matter of timing. Sequences are replayed through valid, so any part of a
+// sequence is a sequence that can run.
+func (m *raidModel) valid(op modelOp) bool {
+	switch op.kind {
+	case modelFail:
+		// A failure while a rebuild runs with a spare left over would start
+		// another rebuild whenever the first one finished
+		return m.redundancy > 0 && !m.failed[op.disk] && m.lost() < m.redundancy &&
+			(m.rebuilding < 0 || m.spares == 0)
+	case modelReplace:
+		return m.redundancy > 0 && m.rebuilding < 0
+	case modelRebuild:
+		return m.redundancy > 0
+	}
+	return true
+}
+
+// startRebuild mirrors the array swapping a spare in for its lowest numbered
+// failed member
+func (m *raidModel) startRebuild() {
+	if m.rebuilding >= 0 || m.spares == 0 {
+		return
+	}
+	for i, failed := range m.failed {
+		if failed {
+			m.rebuilding = i
+			m.spares--
+			return
+		}
+	}
+}
+
+// apply updates the model for a valid operation
+func (m *raidModel) apply(op modelOp) {
+	switch op.kind {
+	case modelWrite:
+		m.blocks[op.block] = modelBlock(op.block, op.version)
+	case modelFail:
+		m.failed[op.disk] = true
+		m.startRebuild()
+	case modelReplace:
+		m.spares++
+		m.startRebuild()
+	case modelRebuild:
+		if m.rebuilding >= 0 {
+			m.failed[m.rebuilding] = false
+			m.rebuilding = -1
+		}
+	}
+}
+
+// step runs a valid operation on both the array and the model, and checks
+// that the array behaves as the model says
+func (m *raidModel) step(raid RAID, op modelOp) error {
+	var err error
+	switch op.kind {
+	case modelWrite:
+		err = raid.Write(op.block, modelBlock(op.block, op.version))
+	case modelRead:
+		err = m.check(raid, op.block)
+	case modelFail:
+		raid.(memberFailer).FailDisk(op.disk)
+	case modelReplace:
+		raid.(memberFailer).AddSpare(NewMemoryDisk(TestBlockSize))
+	case modelRebuild:
+		err = raid.(memberFailer).WaitRebuild()
+	}
+	if err != nil {
+		return err
+	}
+	m.apply(op)
+	return nil
+}
+
+// check reads a block and compares it with the model. Blocks never written
+// read as zeros.
+func (m *raidModel) check(raid RAID, blockNum int) error {
+	want, ok := m.blocks[blockNum]
+	if !ok {
+		want = make([]byte, TestBlockSize)
+	}
+	data, err := raid.Read(blockNum)
+	if err != nil {
+		return fmt.Errorf("read block %d: %w", blockNum, err)
+	}
+	if !bytes.Equal(data, want) {
+		return fmt.Errorf("block %d holds block %d version %d, expected block %d version %d",
+			blockNum, binary.LittleEndian.Uint32(data), binary.LittleEndian.Uint32(data[4:]),
+			binary.LittleEndian.Uint32(want), binary.LittleEndian.Uint32(want[4:]))
+	}
+	return nil
+}
+
+// runModel replays a sequence on a fresh array, skipping operations the model
+// says are not valid at that point, then checks every block written. It
+// returns the first difference from the model.
+func runModel(target modelTarget, ops []modelOp) error {
+	raid, err := target.newRAID()
+	if err != nil {
+		return err
+	}
+	if err := raid.Initialize(); err != nil {
+		return err
+	}
+	defer raid.CleanUp()
+
+	model := newRAIDModel(target)
+	for i, op := range ops {
+		if !model.valid(op) {
+			continue
+		}
+		if err := model.step(raid, op); err != nil {
+			return fmt.Errorf("step %d, %v: %w", i, op, err)
+		}
+	}
+	for blockNum := range model.blocks {
+		if err := model.check(raid, blockNum); err != nil {
+			return fmt.Errorf("after the last step: %w", err)
+		}
+	}
+	return nil
+}
+
+// generateOps returns a random sequence of operations on an array of the
+// given capacity. The model steers it towards operations that are valid, and
+// half the reads go to blocks already written.
+func generateOps(rng *rand.Rand, target modelTarget, capacity, steps int) []modelOp {
+	model := newRAIDModel(target)
+	var written []int
+	ops := make([]modelOp, 0, steps)
+	for version := 0; len(ops) < steps; version++ {
+		var op modelOp
+		switch n := rng.Intn(100); {
+		case n < 45:
+			op = modelOp{kind: modelWrite, block: rng.Intn(capacity), version: version}
+			written = append(written, op.block)
+		case n < 90:
+			op = modelOp{kind: modelRead, block: rng.Intn(capacity)}
+			if len(written) > 0 && rng.Intn(2) == 0 {
+				op.block = written[rng.Intn(len(written))]
+			}
+		case n < 94:
+			op = modelOp{kind: modelFail, disk: rng.Intn(target.numDisks)}
+		case n < 97:
+			op = modelOp{kind: modelReplace}
+		default:
+			op = modelOp{kind: modelRebuild}
+		}
+		if model.valid(op) {
+			model.apply(op)
+			ops = append(ops, op)
+		}
+	}
+	return ops
+}
+
+// shrinkOps cuts a failing sequence down by dropping runs of operations,
+// halving the run length whenever no run can go, until no single operation
+// can be dropped without the sequence passing
+func shrinkOps(ops []modelOp, fails func([]modelOp) bool) []modelOp {
+	for chunk := len(ops) / 2; chunk >= 1; {
+		dropped := false
+		for start := 0; start+chunk <= len(ops); {
+			candidate := append(append([]modelOp{}, ops[:start]...), ops[start+chunk:]...)
+			if fails(candidate) {
+				ops = candidate
+				dropped = true
+			} else {
+				start += chunk
+			}
+		}
+		if !dropped {
+			chunk /= 2
+		}
+	}
+	return ops
+}
+
+// formatOps lists a sequence one operation per line
+func formatOps(ops []modelOp) string {
+	var b strings.Builder
+	for i, op := range ops {
+		fmt.Fprintf(&b, "\t%d: %v\n", i, op)
+	}
+	return b.String()
+}
+
+// checkModel runs random sequences against a target. The first sequence that
+// fails is shrunk, and the test fails with the shortest reproduction found.
+func checkModel(t *testing.T, target modelTarget) {
+	t.Helper()
+	raid, err := target.newRAID()
+	if err != nil {
+		t.Fatalf("Failed to create %s: %v", target.name, err)
+	}
+	capacity := raid.GetEffectiveCapacity()
+
+	for seed := int64(1); seed <= modelRuns; seed++ {
+		ops := generateOps(rand.New(rand.NewSource(seed)), target, capacity, modelSteps)
+		if runModel(target, ops) == nil {
+			continue
+		}
+		ops = shrinkOps(ops, func(ops []modelOp) bool { return runModel(target, ops) != nil })
+		t.Fatalf("%s differs from the model with seed %d: %v\nShortest failing sequence:\n%s",
+			target.name, seed, runModel(target, ops), formatOps(ops))
+	}
+}
+
+// modelTargets returns every RAID level, with chunk sizes and disk counts
+// that differ between levels
+func modelTargets() []modelTarget {
+	geometry := func(numDisks, chunkBlocks int) Geometry {
+		g := rebuildGeometry()
+		g.NumDisks = numDisks
+		g.ChunkBlocks = chunkBlocks
+		return g
+	}
+	return []modelTarget{
+		{"RAID0", 3, 0, func() (RAID, error) { return NewRAID0WithGeometry(geometry(3, 4)) }},
+		{"RAID1", 3, 2, func() (RAID, error) { return NewRAID1WithGeometry(geometry(3, 1)) }},
+		{"RAID4", 4, 1, func() (RAID, error) { return NewRAID4WithGeometry(geometry(4, 2)) }},
+		{"RAID5", 5, 1, func() (RAID, error) { return NewRAID5WithGeometry(geometry(5, 4)) }},
+		{"RAID6", 6, 2, func() (RAID, error) { return NewRAID6WithGeometry(geometry(6, 2)) }},
+		{"RAID10", 4, 0, func() (RAID, error) { return NewRAID10(2, 2) }},
+	}
+}
+
+// TestModel runs random sequences of writes, reads, member failures,
+// replacements and rebuilds against every level, checking each step against
+// an in-memory model of the array
+func TestModel(t *testing.T) {
+	for _, target := range modelTargets() {
+		t.Run(target.name, func(t *testing.T) {
+			checkModel(t, target)
+		})
+	}
+}
+
+// misdirectedRAID is an array with a bug: it writes block 7 to block 8
+type misdirectedRAID struct {
+	*RAID5
+}
+
+func (r misdirectedRAID) Write(blockNum int, data []byte) error {
+	if blockNum == 7 {
+		blockNum = 8
+	}
+	return r.RAID5.Write(blockNum, data)
+}
+
+// TestModelShrink tests that the model catches a misplaced write and shrinks
+// the sequence that found it down to the write itself
+func TestModelShrink(t *testing.T) {
+	target := modelTarget{"misdirected RAID5", 5, 1, func() (RAID, error) {
+		raid, err := NewRAID5WithGeometry(rebuildGeometry())
+		return misdirectedRAID{raid}, err
+	}}
+
+	// Every block is written somewhere in a sequence this long
+	var ops []modelOp
+	for seed := int64(1); ops == nil && seed <= modelRuns; seed++ {
+		candidate := generateOps(rand.New(rand.NewSource(seed)), target, 16, modelSteps)
+		if runModel(target, candidate) != nil {
+			ops = candidate
+		}
+	}
+	if ops == nil {
+		t.Fatalf("No sequence caught block 7 being written to block 8")
+	}
+
+	ops = shrinkOps(ops, func(ops []modelOp) bool { return runModel(target, ops) != nil })
+	if len(ops) != 1 || ops[0].kind != modelWrite || ops[0].block != 7 {
+		t.Errorf("Shrunk to:\n%sexpected a single write of block 7", formatOps(ops))
+	}
+}
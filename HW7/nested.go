@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"io"
+)
+
+// RAIDDevice lets a RAID array serve as a member device of another array,
+// so levels can be stacked
+type RAIDDevice struct {
+	raid RAID
+}
+
+// NewRAIDDevice initializes an array and wraps it as a BlockDevice
+func NewRAIDDevice(raid RAID) (*RAIDDevice, error) {
+	err := raid.Initialize()
+	if err != nil {
+		return nil, err
+	}
+	return &RAIDDevice{raid: raid}, nil
+}
+
+// Read reads a block from the wrapped array
+func (d *RAIDDevice) Read(blockNum int, buffer []byte) error {
+	data, err := d.raid.Read(blockNum)
+	if err != nil {
+		return err
+	}
+	copy(buffer, data)
+	return nil
+}
+
+// Write writes a block to the wrapped array
+func (d *RAIDDevice) Write(blockNum int, data []byte) error {
+	return d.raid.Write(blockNum, data)
+}
+
+// Flush flushes the wrapped array
+func (d *RAIDDevice) Flush() error {
+	return d.raid.Flush()
+}
+
+// Discard discards blocks on the wrapped array
+func (d *RAIDDevice) Discard(blockNum, count int) error {
+	return d.raid.Discard(blockNum, count)
+}
+
+// Close closes the wrapped array's disks without deleting them
+func (d *RAIDDevice) Close() error {
+	if closer, ok := d.raid.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// Delete cleans up the wrapped array and its disks
+func (d *RAIDDevice) Delete() error {
+	return d.raid.CleanUp()
+}
+
+// NestedRAID is a RAID0 stripe over member arrays, such as RAID10 (RAID0 over
+// RAID1 mirrors) or RAID50 (RAID0 over RAID5 groups)
+type NestedRAID struct {
+	*RAID0
+	name   string
+	groups []RAID
+}
+
+// newNestedRAID stripes over numGroups arrays made by newGroup with the group
+// geometry. Each group's disks are numbered across the whole array so
+// file-backed groups use disk0.dat, disk1.dat and so on without clashing.
+func newNestedRAID(name string, numGroups int, group Geometry,
+	newGroup func(g Geometry, newDisk diskFactory) (RAID, error)) (*NestedRAID, error) {
+	groups := make([]RAID, numGroups)
+	for g := range groups {
+		first := g * group.NumDisks
+		var err error
+		groups[g], err = newGroup(group, func(i int) (BlockDevice, error) {
+			return group.Backend.open(group, first+i)
+		})
+		if err != nil {
+			return nil, fmt.Errorf("%s group: %w", name, err)
+		}
+	}
+
+	stripe, err := NewRAID0WithGeometry(Geometry{
+		NumDisks:    numGroups,
+		BlockSize:   group.BlockSize,
+		DiskBlocks:  groups[0].GetEffectiveCapacity(),
+		ChunkBlocks: 1,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	stripe.noSuperblock = true
+	nested := &NestedRAID{RAID0: stripe, name: name, groups: groups}
+	nested.newDisk = func(g int) (BlockDevice, error) {
+		return NewRAIDDevice(nested.groups[g])
+	}
+	return nested, nil
+}
+
+// groupGeometry returns the default geometry with disksPerGroup disks
+func groupGeometry(disksPerGroup int) Geometry {
+	g := DefaultGeometry()
+	g.NumDisks = disksPerGroup
+	return g
+}
+
+// NewRAID10 creates a RAID0 stripe over numGroups RAID1 mirrors of
+// mirrorsPerGroup disks each
+func NewRAID10(numGroups, mirrorsPerGroup int) (*NestedRAID, error) {
+	return newNestedRAID("RAID10", numGroups, groupGeometry(mirrorsPerGroup),
+		func(g Geometry, newDisk diskFactory) (RAID, error) {
+			group, err := NewRAID1WithGeometry(g)
+			if err != nil {
+				return nil, err
+			}
+			group.newDisk = newDisk
+			return group, nil
+		})
+}
+
+// NewRAID50 creates a RAID0 stripe over numGroups RAID5 groups of
+// disksPerGroup disks each
+func NewRAID50(numGroups, disksPerGroup int) (*NestedRAID, error) {
+	return newNestedRAID("RAID50", numGroups, groupGeometry(disksPerGroup),
+		func(g Geometry, newDisk diskFactory) (RAID, error) {
+			group, err := NewRAID5WithGeometry(g)
+			if err != nil {
+				return nil, err
+			}
+			group.newDisk = newDisk
+			return group, nil
+		})
+}
+
+// NewRAID60 creates a RAID0 stripe over numGroups RAID6 groups of
+// disksPerGroup disks each
+func NewRAID60(numGroups, disksPerGroup int) (*NestedRAID, error) {
+	return newNestedRAID("RAID60", numGroups, groupGeometry(disksPerGroup),
+		func(g Geometry, newDisk diskFactory) (RAID, error) {
+			group, err := NewRAID6WithGeometry(g)
+			if err != nil {
+				return nil, err
+			}
+			group.newDisk = newDisk
+			return group, nil
+		})
+}
+
+func (r *NestedRAID) GetName() string {
+	return r.name
+}
+
+// IOStats sums the physical I/O of every group, since the stripe layer's own
+// reads and writes are logical operations on the groups
+func (r *NestedRAID) IOStats() IOStats {
+	var total IOStats
+	for _, group := range r.groups {
+		if counter, ok := group.(ioStatser); ok {
+			stats := counter.IOStats()
+			total.Reads += stats.Reads
+			total.Writes += stats.Writes
+		}
+	}
+	return total
+}
+
+// Group returns member array g, for example to fail or replace its disks
+func (r *NestedRAID) Group(g int) RAID {
+	return r.groups[g]
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"testing"
+)
+
+// writeAndVerify writes a distinct pattern to each block and reads it back
+func writeAndVerify(t *testing.T, raid RAID, numBlocks int) {
+	t.Helper()
+	for blockNum := 0; blockNum < numBlocks; blockNum++ {
+		if err := raid.Write(blockNum, blockPattern(blockNum)); err != nil {
+			t.Fatalf("Failed to write to %s block %d: %v", raid.GetName(), blockNum, err)
+		}
+	}
+	verifyBlocks(t, raid, numBlocks)
+}
+
+// verifyBlocks checks that each block still holds its distinct pattern
+func verifyBlocks(t *testing.T, raid RAID, numBlocks int) {
+	t.Helper()
+	for blockNum := 0; blockNum < numBlocks; blockNum++ {
+		readData, err := raid.Read(blockNum)
+		if err != nil {
+			t.Fatalf("Failed to read from %s block %d: %v", raid.GetName(), blockNum, err)
+		}
+		if !bytes.Equal(readData, blockPattern(blockNum)) {
+			t.Errorf("Data mismatch in %s block %d", raid.GetName(), blockNum)
+		}
+	}
+}
+
+// TestRAID10 tests striping over mirror pairs, including losing one disk of
+// every pair and then a whole pair
+func TestRAID10(t *testing.T) {
+	DefaultBackend = FileBackend
+	defer func() { DefaultBackend = MemoryBackend }()
+	raid, err := NewRAID10(3, 2)
+	if err != nil {
+		t.Fatalf("Failed to create RAID10: %v", err)
+	}
+	err = raid.Initialize()
+	if err != nil {
+		t.Fatalf("Failed to initialize RAID10: %v", err)
+	}
+	defer raid.CleanUp()
+
+	// Groups take disk0.dat to disk5.dat between them
+	for _, path := range []string{"disk0.dat", "disk5.dat"} {
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("Expected RAID10 member %s to exist: %v", path, err)
+		}
+	}
+	if raid.GetEffectiveCapacity() != 3*NumBlocks {
+		t.Errorf("RAID10 effective capacity incorrect: got %d, expected %d",
+			raid.GetEffectiveCapacity(), 3*NumBlocks)
+	}
+
+	writeAndVerify(t, raid, 30)
+
+	for g := 0; g < 3; g++ {
+		raid.Group(g).(*RAID1).FailDisk(g % 2)
+	}
+	verifyBlocks(t, raid, 30)
+
+	// Losing both halves of the mirror in group 1 loses blocks 1, 4, 7, ...
+	raid.Group(1).(*RAID1).FailDisk(0)
+	raid.Group(1).(*RAID1).FailDisk(1)
+	if _, err := raid.Read(1); err == nil {
+		t.Errorf("Expected RAID10 read to fail with a whole mirror lost")
+	}
+	if _, err := raid.Read(0); err != nil {
+		t.Errorf("RAID10 read from a surviving mirror failed: %v", err)
+	}
+}
+
+// TestRAID50 tests striping over RAID5 groups with one failure per group
+func TestRAID50(t *testing.T) {
+	raid, err := NewRAID50(2, 3)
+	if err != nil {
+		t.Fatalf("Failed to create RAID50: %v", err)
+	}
+	err = raid.Initialize()
+	if err != nil {
+		t.Fatalf("Failed to initialize RAID50: %v", err)
+	}
+	defer raid.CleanUp()
+
+	if raid.GetEffectiveCapacity() != 4*NumBlocks {
+		t.Errorf("RAID50 effective capacity incorrect: got %d, expected %d",
+			raid.GetEffectiveCapacity(), 4*NumBlocks)
+	}
+
+	writeAndVerify(t, raid, 30)
+
+	raid.Group(0).(*RAID5).FailDisk(1)
+	raid.Group(1).(*RAID5).FailDisk(2)
+	verifyBlocks(t, raid, 30)
+}
+
+// TestRAID60 tests striping over RAID6 groups with two failures per group
+func TestRAID60(t *testing.T) {
+	raid, err := NewRAID60(2, 4)
+	if err != nil {
+		t.Fatalf("Failed to create RAID60: %v", err)
+	}
+	err = raid.Initialize()
+	if err != nil {
+		t.Fatalf("Failed to initialize RAID60: %v", err)
+	}
+	defer raid.CleanUp()
+
+	writeAndVerify(t, raid, 30)
+
+	raid.Group(0).(*RAID6).FailDisk(0)
+	raid.Group(0).(*RAID6).FailDisk(3)
+	raid.Group(1).(*RAID6).FailDisk(1)
+	raid.Group(1).(*RAID6).FailDisk(2)
+	verifyBlocks(t, raid, 30)
+}
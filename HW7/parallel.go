@@ -0,0 +1,110 @@
+package main
+
+import (
+	"errors"
+	"sync"
+)
+
+// runParallel calls fn(0) to fn(n-1) in separate goroutines and waits for all
+// of them. It returns the error of whichever call failed first.
+func runParallel(n int, fn func(i int) error) error {
+	var wg sync.WaitGroup
+	var once sync.Once
+	var first error
+
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := fn(i); err != nil {
+				once.Do(func() { first = err })
+			}
+		}(i)
+	}
+	wg.Wait()
+	return first
+}
+
+// memberOp is one member disk read or write within a logical operation
+type memberOp struct {
+	diskNum int
+	data    []byte // Buffer to read into, or data to write
+}
+
+// readMembers reads a block from several members concurrently. Members that
+// return an error are marked failed, and blocks that fail their checksum are
+// healed. It returns each operation's error, along with the first error
+// that occurred.
+func (m *memberSet) readMembers(blockNum int, ops []memberOp) ([]error, error) {
+	return m.parallelIO(false, blockNum, ops)
+}
+
+// writeMembers writes a block to several members concurrently. Members that
+// return an error are marked failed. It returns each operation's error,
+// along with the first error that occurred.
+func (m *memberSet) writeMembers(blockNum int, ops []memberOp) ([]error, error) {
+	return m.parallelIO(true, blockNum, ops)
+}
+
+// parallelIO issues member operations concurrently, so a logical operation
+// costs about one disk latency rather than one per member. Only the disk I/O
+// runs in the goroutines; failures are recorded afterwards by the caller's
+// goroutine, which holds mu. A member replaced by a spare while the I/O was
+// in flight is not marked failed again. The error returned with the others is
+// the one that happened first: members already failed come first, then the
+// I/O errors in the order they occurred, passing over any block healed.
+func (m *memberSet) parallelIO(write bool, blockNum int, ops []memberOp) ([]error, error) {
+	if write {
+		m.markDirty(blockNum)
+		m.markWritten(blockNum)
+	}
+	errs := make([]error, len(ops))
+	disks := make([]BlockDevice, len(ops))
+	var order []int // Failed operations, in the order they failed
+	var orderMu sync.Mutex
+	for i, op := range ops {
+		if m.isFailed(op.diskNum, blockNum) {
+			errs[i] = ErrArrayFailed
+			order = append(order, i)
+		}
+		disks[i] = m.disks[op.diskNum]
+	}
+
+	m.unlocked(func() {
+		runParallel(len(ops), func(i int) error {
+			if errs[i] != nil {
+				return errs[i]
+			}
+			if write {
+				m.countWrite()
+				errs[i] = disks[i].Write(blockNum, ops[i].data)
+			} else {
+				m.countRead()
+				errs[i] = disks[i].Read(blockNum, ops[i].data)
+			}
+			if errs[i] != nil {
+				orderMu.Lock()
+				order = append(order, i)
+				orderMu.Unlock()
+			}
+			return errs[i]
+		})
+	})
+
+	for i, op := range ops {
+		if errors.Is(errs[i], ErrChecksum) {
+			errs[i] = m.heal(op.diskNum, blockNum, op.data)
+		} else if errs[i] != nil && errs[i] != ErrArrayFailed {
+			if m.disks[op.diskNum] == disks[i] {
+				m.markFailed(op.diskNum)
+			}
+			errs[i] = &ErrDiskFailed{Disk: op.diskNum, Err: errs[i]}
+		}
+	}
+	for _, i := range order {
+		if errs[i] != nil {
+			return errs, errs[i]
+		}
+	}
+	return errs, nil
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestRunParallel tests that every call runs and the first error is returned
+func TestRunParallel(t *testing.T) {
+	var calls atomic.Int32
+	errSlow := errors.New("slow failure")
+	errFast := errors.New("fast failure")
+
+	err := runParallel(5, func(i int) error {
+		calls.Add(1)
+		switch i {
+		case 1:
+			time.Sleep(30 * time.Millisecond)
+			return errSlow
+		case 3:
+			return errFast
+		}
+		return nil
+	})
+	if calls.Load() != 5 {
+		t.Errorf("Expected 5 calls, got %d", calls.Load())
+	}
+	if err != errFast {
+		t.Errorf("Expected the first error to be reported, got %v", err)
+	}
+}
+
+// TestParallelMirrorWrite tests that a mirrored write costs about one disk
+// latency rather than one per mirror
+func TestParallelMirrorWrite(t *testing.T) {
+	raid := NewRAID1()
+	err := raid.Initialize()
+	if err != nil {
+		t.Fatalf("Failed to initialize RAID1: %v", err)
+	}
+	defer raid.CleanUp()
+	faulty := injectFaults(raid.disks)
+
+	const latency = 40 * time.Millisecond
+	for _, disk := range faulty {
+		disk.SetLatency(latency)
+	}
+
+	start := time.Now()
+	if err := raid.Write(0, blockPattern(0)); err != nil {
+		t.Fatalf("Failed to write to RAID1: %v", err)
+	}
+	// Five mirrors one after another would take 200ms
+	if elapsed := time.Since(start); elapsed > 3*latency {
+		t.Errorf("Mirrored write took %v, expected about %v", elapsed, latency)
+	}
+	verifyBlocks(t, raid, 1)
+}
+
+// TestParallelReconstruct tests that rebuilding a block from parity reads the
+// surviving disks concurrently
+func TestParallelReconstruct(t *testing.T) {
+	raid := NewRAID5()
+	err := raid.Initialize()
+	if err != nil {
+		t.Fatalf("Failed to initialize RAID5: %v", err)
+	}
+	defer raid.CleanUp()
+
+	writeAndVerify(t, raid, 4)
+	faulty := injectFaults(raid.disks)
+
+	const latency = 40 * time.Millisecond
+	for _, disk := range faulty {
+		disk.SetLatency(latency)
+	}
+	raid.FailDisk(0)
+
+	start := time.Now()
+	verifyBlocks(t, raid, 1)
+	// Four surviving disks one after another would take 160ms
+	if elapsed := time.Since(start); elapsed > 3*latency {
+		t.Errorf("Degraded read took %v, expected about %v", elapsed, latency)
+	}
+}
+
+// TestParallelWriteError tests that a mirrored write reports the disk error
+// when every mirror fails
+func TestParallelWriteError(t *testing.T) {
+	raid := NewRAID1()
+	err := raid.Initialize()
+	if err != nil {
+		t.Fatalf("Failed to initialize RAID1: %v", err)
+	}
+	defer raid.CleanUp()
+	faulty := injectFaults(raid.disks)
+
+	// One working mirror is enough for the write to succeed
+	for _, disk := range faulty[1:] {
+		disk.Kill()
+	}
+	if err := raid.Write(0, blockPattern(0)); err != nil {
+		t.Errorf("Write with one working mirror failed: %v", err)
+	}
+
+	faulty[0].Kill()
+	if err := raid.Write(1, blockPattern(1)); !errors.Is(err, errInjectedFault) {
+		t.Errorf("Expected the injected disk error, got %v", err)
+	}
+}
+
+// TestParallelFirstError tests that the error reported for a failed write is
+// the one that happened first, not the one from the lowest numbered member
+func TestParallelFirstError(t *testing.T) {
+	raid := NewRAID1()
+	err := raid.Initialize()
+	if err != nil {
+		t.Fatalf("Failed to initialize RAID1: %v", err)
+	}
+	defer raid.CleanUp()
+	faulty := injectFaults(raid.disks)
+
+	// Member 0 fails last, after a delay; the others fail at once
+	faulty[0].SetLatency(30 * time.Millisecond)
+	for _, disk := range faulty {
+		disk.FailBlocks(0, -1)
+	}
+	err = raid.Write(0, blockPattern(0))
+	var diskErr *ErrDiskFailed
+	if !errors.As(err, &diskErr) {
+		t.Fatalf("Expected a disk failure, got %v", err)
+	}
+	if diskErr.Disk == 0 {
+		t.Errorf("Reported the error of the slowest member, expected one that failed first")
+	}
+}
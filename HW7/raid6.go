@@ -0,0 +1,384 @@
+package main
+
+import (
+	"errors"
+)
+
+// GF(2^8) arithmetic for the RAID6 Q parity, using the polynomial
+// x^8 + x^4 + x^3 + x^2 + 1 (0x11d) with generator 2, as Linux md does
+var (
+	gfExp [512]byte // gfExp[i] = 2^i, doubled in length so products skip a modulo
+	gfLog [256]int  // gfLog[2^i] = i, gfLog[0] is unused
+)
+
+func init() {
+	x := 1
+	for i := 0; i < 255; i++ {
+		gfExp[i] = byte(x)
+		gfLog[x] = i
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= 0x11d
+		}
+	}
+	for i := 255; i < len(gfExp); i++ {
+		gfExp[i] = gfExp[i-255]
+	}
+}
+
+// gfMul multiplies two field elements
+func gfMul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return gfExp[gfLog[a]+gfLog[b]]
+}
+
+// gfDiv divides a by a non-zero field element b
+func gfDiv(a, b byte) byte {
+	if a == 0 {
+		return 0
+	}
+	return gfExp[gfLog[a]+255-gfLog[b]]
+}
+
+// gfPow returns the generator raised to the power n
+func gfPow(n int) byte {
+	return gfExp[n%255]
+}
+
+// gfMulInto XORs coef*src into dst byte by byte
+func gfMulInto(dst, src []byte, coef byte) {
+	if coef == 0 {
+		return
+	}
+	logCoef := gfLog[coef]
+	for i := range dst {
+		if src[i] != 0 {
+			dst[i] ^= gfExp[gfLog[src[i]]+logCoef]
+		}
+	}
+}
+
+// RAID6 implements block-level striping with two distributed parity blocks
+// per strip: P is the XOR of the data blocks and Q is their Reed-Solomon
+// syndrome over GF(2^8), so any two members can be lost
+type RAID6 struct {
+	memberSet
+	blockSize   int
+	numDisks    int
+	dataDisks   int
+	chunkBlocks int // Blocks per chunk on one disk before moving to the next
+}
+
+func NewRAID6() *RAID6 {
+	return newRAID6(DefaultGeometry())
+}
+
+func newRAID6(g Geometry) *RAID6 {
+	return &RAID6{
+		memberSet:   memberSet{diskBlocks: g.DiskBlocks, dir: g.Dir, integrity: g.Integrity, backend: g.Backend, sync: g.Sync, identity: identity{level: 6}},
+		blockSize:   g.BlockSize,
+		numDisks:    g.NumDisks,
+		dataDisks:   g.NumDisks - 2, // Two disks' worth of capacity is used for parity
+		chunkBlocks: g.ChunkBlocks,
+	}
+}
+
+// Geometry returns the shape of the array
+func (r *RAID6) Geometry() Geometry {
+	return Geometry{
+		NumDisks:    r.numDisks,
+		BlockSize:   r.blockSize,
+		DiskBlocks:  r.diskBlocks,
+		ChunkBlocks: r.chunkBlocks,
+		Dir:         r.dir,
+		Integrity:   r.integrity,
+		Backend:     r.backend,
+		Sync:        r.sync,
+	}
+}
+
+func (r *RAID6) GetName() string {
+	return "RAID6"
+}
+
+func (r *RAID6) Initialize() error {
+	r.reset(r.numDisks)
+	r.geometry = r.Geometry
+	r.rebuildBlock = r.rebuildMember
+	r.scrubStrip = r.checkStrip
+	for i := 0; i < r.numDisks; i++ {
+		disk, err := openMember(r.newDisk, r.Geometry(), i)
+		if err != nil {
+			return err
+		}
+		r.disks[i] = disk
+	}
+	return r.writeSuperblocks()
+}
+
+func (r *RAID6) CleanUp() error {
+	return r.cleanUp()
+}
+
+func (r *RAID6) GetEffectiveCapacity() int {
+	return r.dataDisks * r.diskBlocks
+}
+
+// getParityDisks returns the disks that store P and Q parity for a strip,
+// given by its block number on the members. P rotates once per chunk the same
+// way as RAID5 parity and Q sits on the next disk along.
+func (r *RAID6) getParityDisks(stripNum int) (pDisk, qDisk int) {
+	stripe := stripNum / r.chunkBlocks
+	pDisk = r.numDisks - 1 - (stripe % r.numDisks)
+	qDisk = (pDisk + 1) % r.numDisks
+	return pDisk, qDisk
+}
+
+// dataDisk returns the disk holding data slot n of a strip. Slots fill the
+// disks that are not P or Q, starting from the disk after Q.
+func (r *RAID6) dataDisk(stripNum, slot int) int {
+	_, qDisk := r.getParityDisks(stripNum)
+	return (qDisk + 1 + slot) % r.numDisks
+}
+
+// mapBlock returns the strip, data disk and data slot for a logical block
+func (r *RAID6) mapBlock(blockNum int) (stripNum, diskNum, slot int) {
+	_, slot, stripNum = stripeLocation(blockNum, r.dataDisks, r.chunkBlocks)
+	return stripNum, r.dataDisk(stripNum, slot), slot
+}
+
+// stripe holds the full contents of one RAID6 strip
+type stripe struct {
+	data [][]byte // Data blocks by slot
+	p, q []byte
+}
+
+// computeParity recalculates P and Q from the data blocks
+func (s *stripe) computeParity(blockSize int) {
+	s.p = make([]byte, blockSize)
+	s.q = make([]byte, blockSize)
+	for slot, data := range s.data {
+		xorInto(s.p, data)
+		gfMulInto(s.q, data, gfPow(slot))
+	}
+}
+
+// readStripe reads every block of a strip, rebuilding up to two blocks on
+// failed members from P and Q
+func (r *RAID6) readStripe(stripNum int) (*stripe, error) {
+	pDisk, qDisk := r.getParityDisks(stripNum)
+
+	// Read data slots, then P and Q, from every member at once
+	s := &stripe{data: make([][]byte, r.dataDisks)}
+	ops := make([]memberOp, r.dataDisks+2)
+	for slot := range s.data {
+		s.data[slot] = make([]byte, r.blockSize)
+		ops[slot] = memberOp{diskNum: r.dataDisk(stripNum, slot), data: s.data[slot]}
+	}
+	s.p = make([]byte, r.blockSize)
+	s.q = make([]byte, r.blockSize)
+	ops[r.dataDisks] = memberOp{diskNum: pDisk, data: s.p}
+	ops[r.dataDisks+1] = memberOp{diskNum: qDisk, data: s.q}
+	errs, _ := r.readMembers(stripNum, ops)
+
+	var missing []int // Missing data slots
+	lost := 0
+	for i, err := range errs {
+		if err == nil {
+			continue
+		}
+		lost++
+		switch i {
+		case r.dataDisks:
+			s.p = nil
+		case r.dataDisks + 1:
+			s.q = nil
+		default:
+			missing = append(missing, i)
+		}
+	}
+	if lost > 2 {
+		return nil, ErrArrayFailed
+	}
+
+	if err := r.recoverData(s, missing); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// countFailed returns the number of members that cannot be used for a strip
+func (r *RAID6) countFailed(stripNum int) int {
+	count := 0
+	for i := range r.disks {
+		if r.isFailed(i, stripNum) {
+			count++
+		}
+	}
+	return count
+}
+
+// recoverData fills in up to two missing data slots of a stripe from P and Q
+func (r *RAID6) recoverData(s *stripe, missing []int) error {
+	switch {
+	case len(missing) == 0:
+		return nil
+
+	case len(missing) == 1 && s.p != nil:
+		// Plain RAID5-style recovery: D_x = P ^ sum of the other data blocks
+		x := missing[0]
+		s.data[x] = append([]byte(nil), s.p...)
+		for slot, data := range s.data {
+			if slot != x {
+				xorInto(s.data[x], data)
+			}
+		}
+		return nil
+
+	case len(missing) == 1 && s.q != nil:
+		// P is gone too: g^x * D_x = Q ^ sum of g^k * D_k for the others
+		x := missing[0]
+		partial := append([]byte(nil), s.q...)
+		for slot, data := range s.data {
+			if slot != x {
+				gfMulInto(partial, data, gfPow(slot))
+			}
+		}
+		coef := gfPow(x)
+		for i := range partial {
+			partial[i] = gfDiv(partial[i], coef)
+		}
+		s.data[x] = partial
+		return nil
+
+	case len(missing) == 2 && s.p != nil && s.q != nil:
+		// Two data blocks gone. With Pxy = D_x ^ D_y and
+		// Qxy = g^x*D_x ^ g^y*D_y from the survivors,
+		// D_x = (Qxy ^ g^y*Pxy) / (g^x ^ g^y) and D_y = Pxy ^ D_x
+		x, y := missing[0], missing[1]
+		pxy := append([]byte(nil), s.p...)
+		qxy := append([]byte(nil), s.q...)
+		for slot, data := range s.data {
+			if slot != x && slot != y {
+				xorInto(pxy, data)
+				gfMulInto(qxy, data, gfPow(slot))
+			}
+		}
+		gx, gy := gfPow(x), gfPow(y)
+		denom := gx ^ gy
+		dx := make([]byte, r.blockSize)
+		dy := make([]byte, r.blockSize)
+		for i := range dx {
+			dx[i] = gfDiv(qxy[i]^gfMul(gy, pxy[i]), denom)
+			dy[i] = pxy[i] ^ dx[i]
+		}
+		s.data[x], s.data[y] = dx, dy
+		return nil
+	}
+
+	return ErrArrayFailed
+}
+
+// rebuildMember recomputes a member's block in a strip from the other members
+func (r *RAID6) rebuildMember(diskNum, stripNum int) ([]byte, error) {
+	s, err := r.readStripe(stripNum)
+	if err != nil {
+		return nil, err
+	}
+
+	pDisk, qDisk := r.getParityDisks(stripNum)
+	switch diskNum {
+	case pDisk, qDisk:
+		s.computeParity(r.blockSize)
+		if diskNum == pDisk {
+			return s.p, nil
+		}
+		return s.q, nil
+	}
+	for slot := range s.data {
+		if r.dataDisk(stripNum, slot) == diskNum {
+			return s.data[slot], nil
+		}
+	}
+	return nil, errors.New("disk is not a member of the strip")
+}
+
+func (r *RAID6) Write(blockNum int, data []byte) error {
+	if err := checkData(data, r.blockSize); err != nil {
+		return err
+	}
+	if err := checkBlock(blockNum, r.GetEffectiveCapacity()); err != nil {
+		return err
+	}
+
+	stripNum, _, slot := r.mapBlock(blockNum)
+	pDisk, qDisk := r.getParityDisks(stripNum)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// Read the whole strip, recovering anything on failed disks, then
+	// recompute both parities with the new data in place
+	s, err := r.readStripe(stripNum)
+	if err != nil {
+		return err
+	}
+	s.data[slot] = data
+	s.computeParity(r.blockSize)
+
+	// Write data, P and Q at once to whichever of them are still working
+	var writes []memberOp
+	for _, w := range []memberOp{
+		{diskNum: r.dataDisk(stripNum, slot), data: data},
+		{diskNum: pDisk, data: s.p},
+		{diskNum: qDisk, data: s.q},
+	} {
+		if !r.isFailed(w.diskNum, stripNum) {
+			writes = append(writes, w)
+		}
+	}
+	r.writeMembers(stripNum, writes)
+
+	if r.countFailed(stripNum) > 2 {
+		return ErrArrayFailed
+	}
+	return nil
+}
+
+// Discard frees count blocks from blockNum. Whole stripes are discarded on
+// every member, since P and Q of zero blocks are zero; blocks in partial
+// stripes are written as zeros.
+func (r *RAID6) Discard(blockNum, count int) error {
+	if err := checkExtent(blockNum, count, r.GetEffectiveCapacity()); err != nil {
+		return err
+	}
+	r.stripes.enter()
+	defer r.stripes.exit()
+	zeros := make([]byte, r.blockSize)
+	return r.discardBlocks(r.blockSize, r.dataDisks, r.chunkBlocks, blockNum, count,
+		func(blockNum int) error { return r.Write(blockNum, zeros) })
+}
+
+func (r *RAID6) Read(blockNum int) ([]byte, error) {
+	if err := checkBlock(blockNum, r.GetEffectiveCapacity()); err != nil {
+		return nil, err
+	}
+	stripNum, diskNum, slot := r.mapBlock(blockNum)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	data := make([]byte, r.blockSize)
+	if !r.isFailed(diskNum, stripNum) && r.read(diskNum, stripNum, data) == nil {
+		return data, nil
+	}
+
+	// The data disk has failed, so rebuild the block from the rest of the strip
+	s, err := r.readStripe(stripNum)
+	if err != nil {
+		return nil, err
+	}
+	return s.data[slot], nil
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+// TestGaloisField tests the GF(2^8) arithmetic used for Q parity
+func TestGaloisField(t *testing.T) {
+	for a := 1; a < 256; a++ {
+		for b := 1; b < 256; b++ {
+			product := gfMul(byte(a), byte(b))
+			if gfDiv(product, byte(b)) != byte(a) {
+				t.Fatalf("gfDiv(gfMul(%d, %d), %d) != %d", a, b, b, a)
+			}
+		}
+	}
+	if gfMul(0, 7) != 0 || gfMul(7, 0) != 0 {
+		t.Errorf("Multiplying by zero must give zero")
+	}
+	if gfMul(0x80, 2) != 0x1d {
+		t.Errorf("gfMul(0x80, 2) = %#x, expected 0x1d", gfMul(0x80, 2))
+	}
+}
+
+// TestRAID6 tests basic RAID6 functionality
+func TestRAID6(t *testing.T) {
+	raid := NewRAID6()
+	err := raid.Initialize()
+	if err != nil {
+		t.Fatalf("Failed to initialize RAID6: %v", err)
+	}
+	defer raid.CleanUp()
+
+	for blockNum := 0; blockNum < 20; blockNum++ {
+		err = raid.Write(blockNum, blockPattern(blockNum))
+		if err != nil {
+			t.Fatalf("Failed to write to RAID6 block %d: %v", blockNum, err)
+		}
+	}
+	for blockNum := 0; blockNum < 20; blockNum++ {
+		readData, err := raid.Read(blockNum)
+		if err != nil {
+			t.Fatalf("Failed to read from RAID6 block %d: %v", blockNum, err)
+		}
+		if !bytes.Equal(readData, blockPattern(blockNum)) {
+			t.Errorf("Data mismatch in RAID6 block %d", blockNum)
+		}
+	}
+}
+
+// TestRAID6ParityRotation tests that P and Q rotate and never share a disk
+// with data
+func TestRAID6ParityRotation(t *testing.T) {
+	raid := NewRAID6()
+
+	expectedP := []int{4, 3, 2, 1, 0, 4}
+	expectedQ := []int{0, 4, 3, 2, 1, 0}
+	for strip := range expectedP {
+		pDisk, qDisk := raid.getParityDisks(strip)
+		if pDisk != expectedP[strip] || qDisk != expectedQ[strip] {
+			t.Errorf("RAID6 parity rotation error for strip %d: got P=%d Q=%d, expected P=%d Q=%d",
+				strip, pDisk, qDisk, expectedP[strip], expectedQ[strip])
+		}
+
+		used := map[int]bool{pDisk: true, qDisk: true}
+		for slot := 0; slot < raid.dataDisks; slot++ {
+			diskNum := raid.dataDisk(strip, slot)
+			if used[diskNum] {
+				t.Errorf("RAID6 strip %d reuses disk %d for data slot %d", strip, diskNum, slot)
+			}
+			used[diskNum] = true
+		}
+	}
+}
+
+// TestRAID6DoubleFailure tests that every pair of failed disks can be
+// recovered, for reads of old data and for writes made while degraded
+func TestRAID6DoubleFailure(t *testing.T) {
+	for first := 0; first < NumDisks; first++ {
+		for second := first + 1; second < NumDisks; second++ {
+			raid := NewRAID6()
+			err := raid.Initialize()
+			if err != nil {
+				t.Fatalf("Failed to initialize RAID6: %v", err)
+			}
+
+			for blockNum := 0; blockNum < 15; blockNum++ {
+				if err := raid.Write(blockNum, blockPattern(blockNum)); err != nil {
+					t.Fatalf("Failed to write to RAID6 block %d: %v", blockNum, err)
+				}
+			}
+
+			raid.FailDisk(first)
+			raid.FailDisk(second)
+
+			for blockNum := 0; blockNum < 15; blockNum++ {
+				readData, err := raid.Read(blockNum)
+				if err != nil {
+					t.Fatalf("Failed to read RAID6 block %d with disks %d and %d failed: %v",
+						blockNum, first, second, err)
+				}
+				if !bytes.Equal(readData, blockPattern(blockNum)) {
+					t.Errorf("Data mismatch in RAID6 block %d with disks %d and %d failed",
+						blockNum, first, second)
+				}
+			}
+
+			for blockNum := 0; blockNum < 15; blockNum += 2 {
+				if err := raid.Write(blockNum, blockPattern(blockNum+50)); err != nil {
+					t.Fatalf("Failed degraded write to RAID6 block %d: %v", blockNum, err)
+				}
+				readData, err := raid.Read(blockNum)
+				if err != nil || !bytes.Equal(readData, blockPattern(blockNum+50)) {
+					t.Errorf("Degraded write to RAID6 block %d with disks %d and %d failed not readable: %v",
+						blockNum, first, second, err)
+				}
+			}
+
+			raid.CleanUp()
+		}
+	}
+}
+
+// TestRAID6TripleFailure tests that losing three disks fails the array
+func TestRAID6TripleFailure(t *testing.T) {
+	raid := NewRAID6()
+	err := raid.Initialize()
+	if err != nil {
+		t.Fatalf("Failed to initialize RAID6: %v", err)
+	}
+	defer raid.CleanUp()
+
+	raid.FailDisk(0)
+	raid.FailDisk(1)
+	raid.FailDisk(2)
+
+	if err := raid.Write(0, blockPattern(0)); err == nil {
+		t.Errorf("Expected write to fail with three failed disks")
+	}
+	if _, err := raid.Read(0); err == nil {
+		t.Errorf("Expected read to fail with three failed disks")
+	}
+}
+
+// TestRAID6RebuildTwoDisks tests rebuilding two failed members onto spares
+func TestRAID6RebuildTwoDisks(t *testing.T) {
+	raid, err := NewRAID6WithGeometry(rebuildGeometry())
+	if err != nil {
+		t.Fatalf("Failed to create RAID6: %v", err)
+	}
+	err = raid.Initialize()
+	if err != nil {
+		t.Fatalf("Failed to initialize RAID6: %v", err)
+	}
+	defer raid.CleanUp()
+
+	numBlocks := raid.GetEffectiveCapacity()
+	for blockNum := 0; blockNum < numBlocks; blockNum++ {
+		if err := raid.Write(blockNum, blockPattern(blockNum)); err != nil {
+			t.Fatalf("Failed to write to RAID6 block %d: %v", blockNum, err)
+		}
+	}
+
+	raid.FailDisk(1)
+	raid.FailDisk(3)
+	addTestSpare(t, &raid.memberSet, 0)
+	addTestSpare(t, &raid.memberSet, 1)
+	if err := raid.WaitRebuild(); err != nil {
+		t.Fatalf("RAID6 rebuild failed: %v", err)
+	}
+
+	// Fail the two disks that were not replaced, leaving the spares in use
+	raid.FailDisk(0)
+	raid.FailDisk(2)
+	for blockNum := 0; blockNum < numBlocks; blockNum++ {
+		readData, err := raid.Read(blockNum)
+		if err != nil {
+			t.Fatalf("Failed to read RAID6 block %d after rebuild: %v", blockNum, err)
+		}
+		if !bytes.Equal(readData, blockPattern(blockNum)) {
+			t.Errorf("Data mismatch in RAID6 block %d after rebuild", blockNum)
+		}
+	}
+}
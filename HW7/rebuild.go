@@ -0,0 +1,402 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// RebuildStatus reports the progress of rebuilding a member onto a spare
+type RebuildStatus struct {
+	Running bool
+	Disk    int // Member being rebuilt
+	Done    int // Blocks rebuilt so far
+	Skipped int // Blocks among Done that held no data, and were discarded instead
+	Total   int // Blocks on the member
+	Elapsed time.Duration
+	Err     error // Why the last rebuild stopped early, if it did
+}
+
+// memberSet tracks the member disks of a redundant array, which of them have
+// failed, the hot spares waiting to replace them and the progress of any
+// rebuild. RAID1, RAID4, RAID5 and RAID6 embed it.
+//
+// mu is held for the whole of every logical read and write, and by the
+// rebuild for one block at a time, so foreground I/O and rebuild interleave
+// without seeing half-rebuilt stripes. Arrays that set stripLocking instead
+// hold the strip's lock for the whole operation and release mu during member
+// disk I/O, so operations on different strips overlap.
+type memberSet struct {
+	ioCounter
+	identity
+	mu         sync.Mutex
+	disks      []BlockDevice
+	newDisk    diskFactory // Creates members on Initialize, nil for disk%d.dat files
+	dir        string      // Directory for disk%d.dat files
+	integrity  bool        // Members checksum every block
+	backend    Backend     // Kind of device created for each member
+	sync       SyncPolicy  // When file-backed members sync their writes
+	failed     []bool      // failed[i] is set once disk i stops responding
+	spares     []BlockDevice
+	retired    []BlockDevice // Failed disks that a spare has replaced
+	diskBlocks int           // Number of blocks on each member disk
+
+	// stripes holds the strip locks. Set by the owning RAID level,
+	// stripLocking makes strip operations release mu for member disk I/O.
+	stripes      stripeLocks
+	stripLocking bool
+
+	// geometry describes the array for its superblocks. Set by the owning
+	// RAID level.
+	geometry     func() Geometry
+	intent       *writeIntent // Write-intent bitmap, nil if not enabled
+	noSuperblock bool         // A view of another array's members, which owns the superblocks
+	reshaping    bool         // Data is moving to a new layout; rebuilds and scrubs wait
+
+	// written records which strips may hold data, so rebuild and scrub can
+	// skip the rest. nil when not known, as after Open or a reshape, in
+	// which case every strip counts as written.
+	written []bool
+
+	corruption IntegrityStats
+	healing    map[int]bool // Strips with a block that failed its checksum being rebuilt
+
+	// rebuildBlock returns the contents a member should hold for a block,
+	// computed from the other members. Set by the owning RAID level.
+	rebuildBlock func(diskNum, blockNum int) ([]byte, error)
+
+	// scrubStrip checks, and in repair mode fixes, the redundancy of one
+	// strip. Set by the owning RAID level.
+	scrubStrip func(stripNum int, repair bool) scrubResult
+
+	rebuilding   bool
+	rebuildGen   int // Bumped for every rebuild so a stale goroutine can tell
+	rebuildDisk  int
+	rebuildPos   int // Blocks below this on rebuildDisk have been rebuilt
+	rebuildSkip  int // Blocks passed over because they hold no data
+	rebuildStart time.Time
+	rebuildEnd   time.Time
+	rebuildErr   error
+	rebuildDelay time.Duration // Pause between rebuilt blocks, 0 for full speed
+	stopping     bool
+	rebuildDone  sync.WaitGroup
+
+	scrubbing   bool
+	scrubStop   bool
+	scrubStart  time.Time
+	scrubReport ScrubReport
+	scrubDone   sync.WaitGroup
+}
+
+// isFailed reports whether a member cannot be used for a block, because it
+// has failed, is missing, or is a spare that has not been rebuilt that far yet
+func (m *memberSet) isFailed(diskNum, blockNum int) bool {
+	if m.failed[diskNum] || m.disks[diskNum] == nil {
+		return true
+	}
+	return m.rebuilding && diskNum == m.rebuildDisk && blockNum >= m.rebuildPos
+}
+
+// markFailed records a member failure and starts a rebuild if a spare is free
+func (m *memberSet) markFailed(diskNum int) {
+	m.failed[diskNum] = true
+	if m.rebuilding && diskNum == m.rebuildDisk {
+		m.rebuilding = false
+	}
+	m.startRebuild()
+	m.updateSuperblocks()
+}
+
+// read reads a block from a member disk, marking the disk failed if the read
+// returns an error. A block that fails its checksum is healed instead.
+func (m *memberSet) read(diskNum, blockNum int, buffer []byte) error {
+	if m.isFailed(diskNum, blockNum) {
+		return ErrArrayFailed
+	}
+	m.countRead()
+	disk := m.disks[diskNum]
+	var err error
+	m.unlocked(func() { err = disk.Read(blockNum, buffer) })
+	if errors.Is(err, ErrChecksum) {
+		return m.heal(diskNum, blockNum, buffer)
+	}
+	if err != nil {
+		if m.disks[diskNum] == disk {
+			m.markFailed(diskNum)
+		}
+		return &ErrDiskFailed{Disk: diskNum, Err: err}
+	}
+	return nil
+}
+
+// write writes a block to a member disk, marking the disk failed if the write
+// returns an error
+func (m *memberSet) write(diskNum, blockNum int, data []byte) error {
+	if m.isFailed(diskNum, blockNum) {
+		return ErrArrayFailed
+	}
+	m.markDirty(blockNum)
+	m.markWritten(blockNum)
+	m.countWrite()
+	disk := m.disks[diskNum]
+	var err error
+	m.unlocked(func() { err = disk.Write(blockNum, data) })
+	if err != nil {
+		if m.disks[diskNum] == disk {
+			m.markFailed(diskNum)
+		}
+		return &ErrDiskFailed{Disk: diskNum, Err: err}
+	}
+	return nil
+}
+
+// FailDisk marks a member disk as failed. Reads and writes to it are served
+// from the remaining members, and a hot spare takes its place if one is
+// attached.
+func (m *memberSet) FailDisk(diskNum int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.markFailed(diskNum)
+}
+
+// AddSpare attaches a hot spare. If a member has already failed, rebuilding
+// onto the spare starts straight away.
+func (m *memberSet) AddSpare(disk BlockDevice) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.integrity {
+		disk = NewIntegrityDisk(disk, m.geometry().BlockSize)
+	}
+	m.spares = append(m.spares, disk)
+	gen := m.rebuildGen
+	m.startRebuild()
+	if m.rebuildGen != gen {
+		m.updateSuperblocks()
+	}
+}
+
+// SetRebuildRate limits rebuild speed to the given number of blocks per
+// second, leaving disk time for foreground I/O. Zero removes the limit.
+func (m *memberSet) SetRebuildRate(blocksPerSecond int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.rebuildDelay = 0
+	if blocksPerSecond > 0 {
+		m.rebuildDelay = time.Second / time.Duration(blocksPerSecond)
+	}
+}
+
+// RebuildStatus returns the progress of the current or most recent rebuild
+func (m *memberSet) RebuildStatus() RebuildStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	status := RebuildStatus{
+		Running: m.rebuilding,
+		Disk:    m.rebuildDisk,
+		Done:    m.rebuildPos,
+		Skipped: m.rebuildSkip,
+		Total:   m.diskBlocks,
+		Err:     m.rebuildErr,
+	}
+	if !m.rebuildStart.IsZero() {
+		end := m.rebuildEnd
+		if m.rebuilding {
+			end = time.Now()
+		}
+		status.Elapsed = end.Sub(m.rebuildStart)
+	}
+	return status
+}
+
+// WaitRebuild blocks until no rebuild is running and returns the error that
+// stopped the last one, if any
+func (m *memberSet) WaitRebuild() error {
+	m.rebuildDone.Wait()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.rebuildErr
+}
+
+// startRebuild swaps a spare in for the first failed member and rebuilds it
+// in the background. Must be called with mu held.
+func (m *memberSet) startRebuild() {
+	if m.rebuilding || m.stopping || m.reshaping || len(m.spares) == 0 || m.rebuildBlock == nil {
+		return
+	}
+
+	diskNum := -1
+	for i := range m.disks {
+		if m.failed[i] || m.disks[i] == nil {
+			diskNum = i
+			break
+		}
+	}
+	if diskNum == -1 {
+		return
+	}
+
+	if m.disks[diskNum] != nil {
+		m.retired = append(m.retired, m.disks[diskNum])
+	}
+	m.disks[diskNum] = m.spares[0]
+	m.spares = m.spares[1:]
+	m.failed[diskNum] = false
+
+	m.rebuilding = true
+	m.rebuildDisk = diskNum
+	m.rebuildPos = 0
+	m.rebuildSkip = 0
+	m.rebuildStart = time.Now()
+	m.rebuildErr = nil
+	m.rebuildGen++
+
+	m.rebuildDone.Add(1)
+	go m.rebuild(m.rebuildGen, diskNum)
+}
+
+// rebuild fills a replacement member block by block, taking the strip's lock
+// and mu for each block so foreground I/O can run in between. Runs of strips
+// that hold no data are discarded on the replacement rather than rebuilt,
+// under the locks of the whole run.
+func (m *memberSet) rebuild(gen, diskNum int) {
+	defer m.rebuildDone.Done()
+
+	for blockNum := 0; ; {
+		m.mu.Lock()
+		limit := discardRun
+		if m.rebuildDelay > 0 {
+			limit = 1 // Throttled rebuilds pace themselves block by block
+		}
+		run := max(1, m.unusedRun(blockNum, limit))
+		m.mu.Unlock()
+		m.lockStrips(blockNum, run)
+		m.mu.Lock()
+		if m.rebuildGen != gen {
+			// The replacement failed and another spare has taken over
+			m.mu.Unlock()
+			m.unlockStrips(blockNum, run)
+			return
+		}
+		if m.stopping || !m.rebuilding {
+			// Stopped, or the replacement itself failed
+			if m.rebuildErr == nil && !m.stopping {
+				m.rebuildErr = ErrArrayFailed
+			}
+			m.rebuildEnd = time.Now()
+			m.mu.Unlock()
+			m.unlockStrips(blockNum, run)
+			return
+		}
+		if m.rebuildPos >= m.diskBlocks {
+			m.rebuilding = false
+			m.rebuildEnd = time.Now()
+			// Move on to the next failed member if there is a spare for it
+			m.startRebuild()
+			m.updateSuperblocks()
+			m.mu.Unlock()
+			m.unlockStrips(blockNum, run)
+			return
+		}
+
+		// A write may have landed in the run while no lock was held
+		skip := m.unusedRun(blockNum, run)
+		var data []byte
+		var err error
+		if skip == 0 {
+			data, err = m.rebuildBlock(diskNum, blockNum)
+		}
+		switch {
+		case m.rebuildGen != gen || !m.rebuilding:
+			// The replacement failed while its peers were being read, which
+			// the next pass reports
+		case err != nil:
+			// Not enough members left to rebuild from, so the replacement
+			// can never be completed
+			m.rebuildErr = err
+			m.rebuilding = false
+			m.failed[diskNum] = true
+		case skip > 0:
+			// Nothing was written to these strips, or it was discarded, so
+			// the replacement only has to read zeros there
+			disk, blockSize := m.disks[diskNum], m.geometry().BlockSize
+			m.unlocked(func() { err = discardDevice(disk, blockNum, skip, blockSize) })
+			if err != nil && m.disks[diskNum] == disk {
+				m.rebuildErr = err
+				m.markFailed(diskNum)
+			}
+			if err == nil {
+				m.rebuildPos += skip
+				m.rebuildSkip += skip
+			}
+		default:
+			disk := m.disks[diskNum]
+			m.unlocked(func() { err = disk.Write(blockNum, data) })
+			if err != nil && m.disks[diskNum] == disk {
+				m.rebuildErr = err
+				m.markFailed(diskNum)
+			}
+			if err == nil {
+				m.rebuildPos++
+			}
+		}
+		delay, next := m.rebuildDelay, m.rebuildPos
+		m.mu.Unlock()
+		m.unlockStrips(blockNum, run)
+		blockNum = next
+
+		time.Sleep(delay)
+	}
+}
+
+// stopBackground stops any running rebuild or scrub and waits for them to
+// exit
+func (m *memberSet) stopBackground() {
+	m.mu.Lock()
+	m.stopping = true
+	m.mu.Unlock()
+	m.rebuildDone.Wait()
+	m.scrubDone.Wait()
+}
+
+// allDisks returns every device the array owns: members, spares and retired
+// members
+func (m *memberSet) allDisks() []BlockDevice {
+	all := make([]BlockDevice, 0, len(m.disks)+len(m.spares)+len(m.retired))
+	all = append(all, m.disks...)
+	all = append(all, m.spares...)
+	return append(all, m.retired...)
+}
+
+// reset prepares the set for a freshly initialized array of numDisks members
+func (m *memberSet) reset(numDisks int) {
+	m.disks = make([]BlockDevice, numDisks)
+	m.failed = make([]bool, numDisks)
+	m.spares = nil
+	m.retired = nil
+	m.rebuilding = false
+	m.rebuildPos = 0
+	m.rebuildStart = time.Time{}
+	m.rebuildErr = nil
+	m.stopping = false
+	m.reshaping = false
+	m.written = make([]bool, m.diskBlocks)
+	m.scrubReport = ScrubReport{}
+	m.corruption = IntegrityStats{}
+	m.resetIOStats()
+}
+
+// cleanUp stops any rebuild or scrub and deletes every device the array owns
+func (m *memberSet) cleanUp() error {
+	m.stopBackground()
+	for _, disk := range m.allDisks() {
+		if disk == nil {
+			continue
+		}
+		err := disk.Delete()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
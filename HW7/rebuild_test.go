@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// TestRebuildBlocks is the member size used by rebuild tests, so a full
+// rebuild stays quick
+const TestRebuildBlocks = 40
+
+// rebuildGeometry is the default geometry with TestRebuildBlocks per member
+func rebuildGeometry() Geometry {
+	g := DefaultGeometry()
+	g.DiskBlocks = TestRebuildBlocks
+	return g
+}
+
+// addTestSpare attaches a new file-backed hot spare to an array
+func addTestSpare(t *testing.T, m *memberSet, n int) {
+	spare, err := NewDisk(fmt.Sprintf("spare%d.dat", n))
+	if err != nil {
+		t.Fatalf("Failed to create spare disk: %v", err)
+	}
+	m.AddSpare(spare)
+}
+
+// TestRAID5HotSpareRebuild tests that a failed RAID5 member is rebuilt onto a
+// spare while writes continue, and that the rebuilt disk holds correct data
+func TestRAID5HotSpareRebuild(t *testing.T) {
+	raid, err := NewRAID5WithGeometry(rebuildGeometry())
+	if err != nil {
+		t.Fatalf("Failed to create RAID5: %v", err)
+	}
+	err = raid.Initialize()
+	if err != nil {
+		t.Fatalf("Failed to initialize RAID5: %v", err)
+	}
+	defer raid.CleanUp()
+
+	numBlocks := raid.GetEffectiveCapacity()
+	for blockNum := 0; blockNum < numBlocks; blockNum++ {
+		if err := raid.Write(blockNum, blockPattern(blockNum)); err != nil {
+			t.Fatalf("Failed to write to RAID5 block %d: %v", blockNum, err)
+		}
+	}
+
+	addTestSpare(t, &raid.memberSet, 0)
+	raid.SetRebuildRate(1000)
+	raid.FailDisk(2)
+
+	// Foreground writes run while the rebuild is in progress
+	for blockNum := 0; blockNum < numBlocks; blockNum += 3 {
+		if err := raid.Write(blockNum, blockPattern(blockNum+1000)); err != nil {
+			t.Fatalf("Failed to write to RAID5 block %d during rebuild: %v", blockNum, err)
+		}
+	}
+
+	if err := raid.WaitRebuild(); err != nil {
+		t.Fatalf("RAID5 rebuild failed: %v", err)
+	}
+	status := raid.RebuildStatus()
+	if status.Running || status.Disk != 2 || status.Done != status.Total {
+		t.Errorf("Unexpected rebuild status after completion: %+v", status)
+	}
+
+	// Lose a different disk, so every read of disk 2 relies on the spare
+	raid.FailDisk(0)
+	for blockNum := 0; blockNum < numBlocks; blockNum++ {
+		expected := blockPattern(blockNum)
+		if blockNum%3 == 0 {
+			expected = blockPattern(blockNum + 1000)
+		}
+		readData, err := raid.Read(blockNum)
+		if err != nil {
+			t.Fatalf("Failed to read RAID5 block %d after rebuild: %v", blockNum, err)
+		}
+		if !bytes.Equal(readData, expected) {
+			t.Errorf("Data mismatch in RAID5 block %d after rebuild", blockNum)
+		}
+	}
+}
+
+// TestRAID4ParityDiskRebuild tests rebuilding the dedicated parity disk
+func TestRAID4ParityDiskRebuild(t *testing.T) {
+	raid, err := NewRAID4WithGeometry(rebuildGeometry())
+	if err != nil {
+		t.Fatalf("Failed to create RAID4: %v", err)
+	}
+	err = raid.Initialize()
+	if err != nil {
+		t.Fatalf("Failed to initialize RAID4: %v", err)
+	}
+	defer raid.CleanUp()
+
+	for blockNum := 0; blockNum < 40; blockNum++ {
+		if err := raid.Write(blockNum, blockPattern(blockNum)); err != nil {
+			t.Fatalf("Failed to write to RAID4 block %d: %v", blockNum, err)
+		}
+	}
+
+	addTestSpare(t, &raid.memberSet, 0)
+	raid.FailDisk(raid.parityDisk)
+	if err := raid.WaitRebuild(); err != nil {
+		t.Fatalf("RAID4 rebuild failed: %v", err)
+	}
+
+	// Rebuilt parity must be able to recover a lost data disk
+	raid.FailDisk(1)
+	for blockNum := 0; blockNum < 40; blockNum++ {
+		readData, err := raid.Read(blockNum)
+		if err != nil {
+			t.Fatalf("Failed to read RAID4 block %d after rebuild: %v", blockNum, err)
+		}
+		if !bytes.Equal(readData, blockPattern(blockNum)) {
+			t.Errorf("Data mismatch in RAID4 block %d after parity rebuild", blockNum)
+		}
+	}
+}
+
+// TestRAID1HotSpareRebuild tests that a mirror that dies during reads is
+// replaced by a spare holding a full copy
+func TestRAID1HotSpareRebuild(t *testing.T) {
+	raid, err := NewRAID1WithGeometry(rebuildGeometry())
+	if err != nil {
+		t.Fatalf("Failed to create RAID1: %v", err)
+	}
+	err = raid.Initialize()
+	if err != nil {
+		t.Fatalf("Failed to initialize RAID1: %v", err)
+	}
+	defer raid.CleanUp()
+	faulty := injectFaults(raid.disks)
+
+	for blockNum := 0; blockNum < TestRebuildBlocks; blockNum++ {
+		if err := raid.Write(blockNum, blockPattern(blockNum)); err != nil {
+			t.Fatalf("Failed to write to RAID1 block %d: %v", blockNum, err)
+		}
+	}
+
+	addTestSpare(t, &raid.memberSet, 0)
+	faulty[0].Kill()
+
+	// The read notices the dead mirror, which starts the rebuild
+	if _, err := raid.Read(0); err != nil {
+		t.Fatalf("Failed to read RAID1 block 0 with a dead mirror: %v", err)
+	}
+	if err := raid.WaitRebuild(); err != nil {
+		t.Fatalf("RAID1 rebuild failed: %v", err)
+	}
+
+	// Only the rebuilt spare is left
+	for i := 1; i < raid.numDisks; i++ {
+		raid.FailDisk(i)
+	}
+	for blockNum := 0; blockNum < TestRebuildBlocks; blockNum++ {
+		readData, err := raid.Read(blockNum)
+		if err != nil {
+			t.Fatalf("Failed to read RAID1 block %d from the spare: %v", blockNum, err)
+		}
+		if !bytes.Equal(readData, blockPattern(blockNum)) {
+			t.Errorf("Data mismatch in RAID1 block %d on the spare", blockNum)
+		}
+	}
+}
+
+// TestRebuildThrottle tests that the rebuild rate limit slows the rebuild
+// and that progress is reported while it runs
+func TestRebuildThrottle(t *testing.T) {
+	raid, err := NewRAID1WithGeometry(rebuildGeometry())
+	if err != nil {
+		t.Fatalf("Failed to create RAID1: %v", err)
+	}
+	err = raid.Initialize()
+	if err != nil {
+		t.Fatalf("Failed to initialize RAID1: %v", err)
+	}
+	defer raid.CleanUp()
+
+	raid.SetRebuildRate(400)
+	addTestSpare(t, &raid.memberSet, 0)
+	raid.FailDisk(3)
+
+	time.Sleep(20 * time.Millisecond)
+	status := raid.RebuildStatus()
+	if !status.Running || status.Done >= status.Total {
+		t.Errorf("Expected throttled rebuild to still be running: %+v", status)
+	}
+
+	if err := raid.WaitRebuild(); err != nil {
+		t.Fatalf("RAID1 rebuild failed: %v", err)
+	}
+	// 40 blocks at 400 blocks per second is at least 100ms
+	if status := raid.RebuildStatus(); status.Elapsed < 90*time.Millisecond {
+		t.Errorf("Throttled rebuild finished too quickly: %v", status.Elapsed)
+	}
+}
@@ -0,0 +1,578 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+)
+
+// reshapeBackup is the file in the array's directory that holds a copy of a
+// stripe while it is written over its own old copy
+const reshapeBackup = "reshape.bak"
+
+// ReshapeCheckpoint is recorded in the superblocks while a reshape runs, so
+// an interrupted reshape can carry on when the array is opened again
+type ReshapeCheckpoint struct {
+	Level    int // Level of the old layout
+	NumDisks int // Members in the old layout, the first NumDisks of the array
+	Stripe   int // Stripes of the new layout known to be written
+}
+
+// ReshapeStatus reports the progress of the current or most recent reshape
+type ReshapeStatus struct {
+	Running bool
+	Done    int   // Stripes of the new layout written so far
+	Total   int   // Stripes in the new layout
+	Err     error // Why the reshape stopped early, if it did
+}
+
+// reshaper moves an array's data from its old layout to a new one over the
+// same disks, one stripe of the new layout at a time, in the background.
+// Blocks before the reshape position are in the new layout and go to the
+// array as usual; the rest are still read and written through old, a view of
+// the array as it was.
+//
+// A new stripe never lies further into the disks than the old copies of its
+// blocks, so moving stripes in order only ever overwrites old rows whose
+// blocks have been moved already. Two things keep this safe across a crash.
+// The position is committed to the superblocks before an old row is
+// overwritten while one of its blocks is in a stripe moved since the last
+// commit, so a resumed reshape never needs an overwritten block. A stripe
+// that overwrites old copies of its own blocks is saved to a backup file
+// first, since redoing it could not read them again.
+type reshaper struct {
+	old             RAID // View of the array in its old layout
+	from            ReshapeCheckpoint
+	blockSize       int
+	oldCapacity     int // Capacity of the old layout in blocks
+	oldStripeBlocks int // Logical blocks per stripe in the old layout
+	stripeBlocks    int // Logical blocks per stripe in the new layout
+	stripes         int // Stripes in the new layout
+	backup          string
+
+	pos         int  // Stripes of the new layout written
+	committed   int  // Stripes recorded in the superblocks
+	checkBackup bool // The next stripe may have been saved before an interruption
+
+	// Set by the owning array. lock is held while a stripe moves.
+	// writeStripe and commit are called with lock held; commit records a
+	// checkpoint, or nil once the reshape is done, in the superblocks.
+	lock        sync.Locker
+	writeStripe func(stripe int, data []byte) error
+	commit      func(cp *ReshapeCheckpoint) error
+
+	mu      sync.Mutex // Serializes commits, which writes may trigger
+	running bool
+	stop    bool
+	err     error
+	done    sync.WaitGroup
+}
+
+// newReshaper prepares to move the data of an array from the layout in from
+// to a layout with stripes of stripeBlocks logical blocks. disks are the
+// array's members, the first from.NumDisks of which hold the old layout.
+func newReshaper(from ReshapeCheckpoint, g Geometry, disks []BlockDevice, stripeBlocks int) (*reshaper, error) {
+	oldGeometry := g
+	oldGeometry.NumDisks = from.NumDisks
+	old, err := newView(from.Level, oldGeometry, disks[:from.NumDisks])
+	if err != nil {
+		return nil, fmt.Errorf("old layout: %w", err)
+	}
+
+	oldDataDisks := from.NumDisks
+	switch from.Level {
+	case 1:
+		oldDataDisks = 1
+	case 4, 5:
+		oldDataDisks = from.NumDisks - 1
+	}
+	return &reshaper{
+		old:             old,
+		from:            ReshapeCheckpoint{Level: from.Level, NumDisks: from.NumDisks},
+		blockSize:       g.BlockSize,
+		oldCapacity:     old.GetEffectiveCapacity(),
+		oldStripeBlocks: oldDataDisks * g.ChunkBlocks,
+		stripeBlocks:    stripeBlocks,
+		stripes:         g.DiskBlocks / g.ChunkBlocks,
+		backup:          filepath.Join(g.Dir, reshapeBackup),
+		pos:             from.Stripe,
+		committed:       from.Stripe,
+		checkBackup:     true,
+	}, nil
+}
+
+// newView returns an array of the given level over existing members, for
+// reaching the part of an array still in an old layout. The view leaves the
+// superblocks to the array that owns the disks.
+func newView(level int, g Geometry, disks []BlockDevice) (RAID, error) {
+	if level != 0 && level != 1 && level != 4 && level != 5 {
+		return nil, fmt.Errorf("cannot reshape from RAID%d", level)
+	}
+	g.Integrity = false // The disks are wrapped already
+	raid, err := newWithDevices(level, g, disks, true)
+	if err != nil {
+		return nil, err
+	}
+	return raid, raid.Initialize()
+}
+
+// active reports whether data is still moving, or stopped part way
+func (s *reshaper) active() bool {
+	return s != nil && s.pos < s.stripes
+}
+
+// pending reports whether a block is still in the old layout. Must be called
+// with the array's lock held.
+func (s *reshaper) pending(blockNum int) bool {
+	return s.active() && blockNum >= s.pos*s.stripeBlocks
+}
+
+// oldRead reads a block that is still in the old layout
+func (s *reshaper) oldRead(blockNum int) ([]byte, error) {
+	if blockNum >= s.oldCapacity {
+		return nil, fmt.Errorf("%w: block %d is beyond the array until the reshape finishes", ErrOutOfRange, blockNum)
+	}
+	return s.old.Read(blockNum)
+}
+
+// oldWrite writes a block that is still in the old layout
+func (s *reshaper) oldWrite(blockNum int, data []byte) error {
+	if blockNum >= s.oldCapacity {
+		return fmt.Errorf("%w: block %d is beyond the array until the reshape finishes", ErrOutOfRange, blockNum)
+	}
+	return s.old.Write(blockNum, data)
+}
+
+// commitWrite commits the reshape position before a write to a stripe moved
+// since the last commit. Otherwise a crash would redo the stripe from its old
+// copy and lose the write. Must be called with the array's lock held.
+func (s *reshaper) commitWrite(blockNum int) error {
+	if !s.active() {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if blockNum < s.committed*s.stripeBlocks || blockNum >= s.pos*s.stripeBlocks {
+		return nil
+	}
+	return s.commitTo(s.pos)
+}
+
+// commitTo records that the first stripe stripes are written. Must be called
+// with mu held.
+func (s *reshaper) commitTo(stripe int) error {
+	if stripe <= s.committed {
+		return nil
+	}
+	cp := s.from
+	cp.Stripe = stripe
+	if err := s.commit(&cp); err != nil {
+		return err
+	}
+	s.committed = stripe
+	return nil
+}
+
+// start moves the data in the background, recording the starting point
+// first. Must be called with the array's lock held.
+func (s *reshaper) start() error {
+	cp := s.from
+	cp.Stripe = s.pos
+	if err := s.commit(&cp); err != nil {
+		return err
+	}
+	s.running = true
+	s.done.Add(1)
+	go s.run()
+	return nil
+}
+
+// run moves stripes in order, taking the array's lock for one stripe at a
+// time so reads and writes carry on in between
+func (s *reshaper) run() {
+	defer s.done.Done()
+
+	for {
+		s.lock.Lock()
+		if s.stop {
+			s.running = false
+			s.lock.Unlock()
+			return
+		}
+		if s.pos >= s.stripes {
+			s.running = false
+			s.err = s.commit(nil)
+			s.lock.Unlock()
+			s.removeBackup()
+			return
+		}
+		if err := s.step(); err != nil {
+			s.err = err
+			s.running = false
+			s.lock.Unlock()
+			return
+		}
+		s.lock.Unlock()
+	}
+}
+
+// step moves the stripe at the reshape position. Must be called with the
+// array's lock held.
+func (s *reshaper) step() error {
+	stripe := s.pos
+	first := stripe * s.stripeBlocks
+	data := make([]byte, s.stripeBlocks*s.blockSize)
+	fromBackup := s.checkBackup && s.readBackup(stripe, data)
+	s.checkBackup = false
+	if !fromBackup {
+		for i := 0; i < s.stripeBlocks && first+i < s.oldCapacity; i++ {
+			block, err := s.old.Read(first + i)
+			if err != nil {
+				return err
+			}
+			copy(data[i*s.blockSize:], block)
+		}
+	}
+
+	// The new stripe covers the same rows as old stripe number stripe. The
+	// last block held there decides what must be safe before overwriting.
+	last := min((stripe+1)*s.oldStripeBlocks, s.oldCapacity) - 1
+	latest := last / s.stripeBlocks
+
+	s.mu.Lock()
+	var err error
+	if min(latest, stripe-1) >= s.committed {
+		err = s.commitTo(stripe)
+	}
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if latest >= stripe && !fromBackup {
+		if err := s.writeBackup(stripe, data); err != nil {
+			return err
+		}
+	}
+
+	if err := s.writeStripe(stripe, data); err != nil {
+		return err
+	}
+	s.pos++
+	return nil
+}
+
+// writeBackup saves a stripe's data, with its number and a checksum, to the
+// backup file
+func (s *reshaper) writeBackup(stripe int, data []byte) error {
+	var header [12]byte
+	binary.LittleEndian.PutUint64(header[0:], uint64(stripe))
+	binary.LittleEndian.PutUint32(header[8:], crc32.ChecksumIEEE(data))
+
+	file, err := os.Create(s.backup)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if _, err := file.Write(append(header[:], data...)); err != nil {
+		return err
+	}
+	return file.Sync()
+}
+
+// readBackup fills data from the backup file if it holds a complete copy of
+// the stripe
+func (s *reshaper) readBackup(stripe int, data []byte) bool {
+	saved, err := os.ReadFile(s.backup)
+	if err != nil || len(saved) != 12+len(data) {
+		return false
+	}
+	if binary.LittleEndian.Uint64(saved[0:]) != uint64(stripe) ||
+		binary.LittleEndian.Uint32(saved[8:]) != crc32.ChecksumIEEE(saved[12:]) {
+		return false
+	}
+	copy(data, saved[12:])
+	return true
+}
+
+// removeBackup deletes the backup file, if there is one
+func (s *reshaper) removeBackup() {
+	if s != nil {
+		os.Remove(s.backup)
+	}
+}
+
+// removeReshapeBackup deletes any backup file left in dir by an earlier
+// array, before a new reshape starts
+func removeReshapeBackup(dir string) {
+	os.Remove(filepath.Join(dir, reshapeBackup))
+}
+
+// halt stops the background reshape and commits the stripes it has written
+func (s *reshaper) halt() {
+	if s == nil {
+		return
+	}
+	s.lock.Lock()
+	s.stop = true
+	s.lock.Unlock()
+	s.done.Wait()
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.active() {
+		s.mu.Lock()
+		s.commitTo(s.pos)
+		s.mu.Unlock()
+	}
+}
+
+// status returns the reshape's progress. Must be called with the array's
+// lock held.
+func (s *reshaper) status() ReshapeStatus {
+	if s == nil {
+		return ReshapeStatus{}
+	}
+	return ReshapeStatus{Running: s.running, Done: s.pos, Total: s.stripes, Err: s.err}
+}
+
+// wait blocks until the reshape stops and returns why, if it stopped early
+func (s *reshaper) wait() error {
+	if s == nil {
+		return nil
+	}
+	s.done.Wait()
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.err == nil && s.active() {
+		return errors.New("reshape stopped before it finished")
+	}
+	return s.err
+}
+
+// resumeReshape carries on a reshape recorded in an assembled array's
+// superblocks
+func resumeReshape(raid RAID, cp ReshapeCheckpoint) error {
+	switch r := raid.(type) {
+	case *RAID0:
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		return r.beginReshape(cp)
+	case *RAID5:
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		return r.beginReshape(cp)
+	}
+	return fmt.Errorf("%s cannot be reshaped", raid.GetName())
+}
+
+// Grow adds a member disk and restripes the data over every member in the
+// background. Reads and writes carry on while data moves; the extra capacity
+// appears once the reshape finishes. Grow itself must not run alongside other
+// calls on the array.
+func (r *RAID0) Grow() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.reshape.active() {
+		return errors.New("array is already being reshaped")
+	}
+	if r.noSuperblock {
+		return errors.New("nested arrays cannot be grown")
+	}
+	disk, err := openMember(r.newDisk, r.Geometry(), r.numDisks)
+	if err != nil {
+		return err
+	}
+	from := ReshapeCheckpoint{Level: 0, NumDisks: r.numDisks}
+	r.disks = append(r.disks, disk)
+	r.numDisks++
+	removeReshapeBackup(r.dir)
+	return r.beginReshape(from)
+}
+
+// beginReshape starts moving data from the layout in from to the array's
+// current layout. Must be called with mu held.
+func (r *RAID0) beginReshape(from ReshapeCheckpoint) error {
+	s, err := newReshaper(from, r.Geometry(), r.disks, r.numDisks*r.chunkBlocks)
+	if err != nil {
+		return err
+	}
+	s.lock = &r.mu
+	s.writeStripe = func(stripe int, data []byte) error {
+		first := stripe * s.stripeBlocks
+		for i := 0; i < s.stripeBlocks; i++ {
+			_, diskNum, row := stripeLocation(first+i, r.numDisks, r.chunkBlocks)
+			r.countWrite()
+			if err := r.disks[diskNum].Write(row, data[i*r.blockSize:(i+1)*r.blockSize]); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	s.commit = func(cp *ReshapeCheckpoint) error {
+		r.checkpoint = cp
+		if r.noSuperblock {
+			return nil
+		}
+		return r.stamp(r.Geometry(), r.disks, func(int) MemberState { return MemberActive }, nil)
+	}
+	r.reshape = s
+	return s.start()
+}
+
+// ReshapeStatus returns the progress of the current or most recent reshape
+func (r *RAID0) ReshapeStatus() ReshapeStatus {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.reshape.status()
+}
+
+// WaitReshape blocks until the reshape stops and returns the error that
+// stopped it early, if any
+func (r *RAID0) WaitReshape() error {
+	r.mu.RLock()
+	s := r.reshape
+	r.mu.RUnlock()
+	return s.wait()
+}
+
+// Grow adds a member disk and restripes the data and parity over every
+// member in the background. Reads and writes carry on while data moves; the
+// extra capacity appears once the reshape finishes. Grow itself must not run
+// alongside other calls on the array.
+func (r *RAID5) Grow() error {
+	// Wait for operations in flight, which may have released mu for their
+	// disk I/O, before the layout changes under them
+	r.stripes.lockAll()
+	defer r.stripes.unlockAll()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := r.canReshape(); err != nil {
+		return err
+	}
+	g := r.Geometry()
+	disk, err := openMember(r.newDisk, g, r.numDisks)
+	if err != nil {
+		return err
+	}
+	from := ReshapeCheckpoint{Level: 5, NumDisks: r.numDisks}
+	r.disks = append(r.disks, disk)
+	r.failed = append(r.failed, false)
+	r.numDisks++
+	r.dataDisks++
+	removeReshapeBackup(r.dir)
+	return r.beginReshape(from)
+}
+
+// canReshape checks that every member is in place. Must be called with mu
+// held.
+func (r *RAID5) canReshape() error {
+	if r.reshape.active() {
+		return errors.New("array is already being reshaped")
+	}
+	if r.rebuilding || slices.Contains(r.failed, true) {
+		return fmt.Errorf("%w: every member must be working to reshape", ErrDegraded)
+	}
+	return nil
+}
+
+// beginReshape starts moving data from the layout in from to the array's
+// current layout. Rebuilds and scrubs wait until it is done, since strips
+// not yet moved have no single layout. Must be called with mu held.
+func (r *RAID5) beginReshape(from ReshapeCheckpoint) error {
+	s, err := newReshaper(from, r.Geometry(), r.disks, r.dataDisks*r.chunkBlocks)
+	if err != nil {
+		return err
+	}
+	s.lock = &r.mu
+	s.writeStripe = func(stripe int, data []byte) error {
+		return r.writeStripe(r.blockSize, r.dataDisks, r.chunkBlocks, stripe*s.stripeBlocks, data, r.mapBlock)
+	}
+	s.commit = func(cp *ReshapeCheckpoint) error {
+		r.checkpoint = cp
+		if cp == nil {
+			r.reshaping = false
+			r.startRebuild()
+		}
+		return r.updateSuperblocks()
+	}
+	r.reshape = s
+	r.reshaping = true
+	r.written = nil // Strips change places, so any of them may hold data
+	return s.start()
+}
+
+// ReshapeStatus returns the progress of the current or most recent reshape
+func (r *RAID5) ReshapeStatus() ReshapeStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.reshape.status()
+}
+
+// WaitReshape blocks until the reshape stops and returns the error that
+// stopped it early, if any
+func (r *RAID5) WaitReshape() error {
+	r.mu.Lock()
+	s := r.reshape
+	r.mu.Unlock()
+	return s.wait()
+}
+
+// MigrateToRAID5 converts a RAID1 or RAID4 array to a RAID5 of numDisks
+// members, at least as many as it has now. The data moves in the
+// background as for Grow, and the old array must not be used afterwards.
+func MigrateToRAID5(raid RAID, numDisks int) (*RAID5, error) {
+	var set *memberSet
+	var g Geometry
+	switch r := raid.(type) {
+	case *RAID1:
+		set, g = &r.memberSet, r.Geometry()
+	case *RAID4:
+		set, g = &r.memberSet, r.Geometry()
+	default:
+		return nil, fmt.Errorf("cannot migrate %s to RAID5", raid.GetName())
+	}
+	if numDisks < g.NumDisks {
+		return nil, fmt.Errorf("cannot migrate %d disks to a %d-disk RAID5", g.NumDisks, numDisks)
+	}
+
+	set.stopBackground()
+	set.mu.Lock()
+	defer set.mu.Unlock()
+	if set.rebuilding || slices.Contains(set.failed, true) {
+		return nil, fmt.Errorf("%w: every member must be working to migrate", ErrDegraded)
+	}
+
+	from := ReshapeCheckpoint{Level: set.level, NumDisks: g.NumDisks}
+	g.NumDisks = numDisks
+	r, err := NewRAID5WithGeometry(g)
+	if err != nil {
+		return nil, err
+	}
+	r.identity = set.identity
+	r.level = 5
+	r.newDisk = set.newDisk
+	r.setup()
+	r.intent = set.intent
+	r.bitmapRegion = set.bitmapRegion
+	copy(r.disks, set.disks)
+	for i := from.NumDisks; i < numDisks; i++ {
+		if r.disks[i], err = openMember(r.newDisk, g, i); err != nil {
+			return nil, err
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	removeReshapeBackup(r.dir)
+	if err := r.beginReshape(from); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+// rewriteBlocks writes new patterns over blocks first to last while a
+// reshape moves them, and returns the block numbers of the patterns written
+func rewriteBlocks(t *testing.T, raid RAID, first, last int) map[int]int {
+	t.Helper()
+	written := make(map[int]int)
+	for blockNum := first; blockNum < last; blockNum += 3 {
+		if err := raid.Write(blockNum, blockPattern(blockNum+1000)); err != nil {
+			t.Fatalf("Failed to write block %d during reshape: %v", blockNum, err)
+		}
+		written[blockNum] = blockNum + 1000
+	}
+	return written
+}
+
+// verifyRewritten checks the first numBlocks blocks, expecting the patterns
+// in written where there are any
+func verifyRewritten(t *testing.T, raid RAID, numBlocks int, written map[int]int) {
+	t.Helper()
+	for blockNum := 0; blockNum < numBlocks; blockNum++ {
+		pattern, ok := written[blockNum]
+		if !ok {
+			pattern = blockNum
+		}
+		data, err := raid.Read(blockNum)
+		if err != nil {
+			t.Fatalf("Failed to read %s block %d: %v", raid.GetName(), blockNum, err)
+		}
+		if !bytes.Equal(data, blockPattern(pattern)) {
+			t.Errorf("Data mismatch in %s block %d", raid.GetName(), blockNum)
+		}
+	}
+}
+
+// TestRAID5Grow tests growing a RAID5 from 3 to 4 disks while it is written
+// to, then opening the grown array
+func TestRAID5Grow(t *testing.T) {
+	raid, dir := createTestArray(t, 3)
+	writeAndVerify(t, raid, raid.GetEffectiveCapacity())
+
+	if err := raid.Grow(); err != nil {
+		t.Fatalf("Failed to grow RAID5: %v", err)
+	}
+	if raid.GetEffectiveCapacity() != 2*TestRebuildBlocks {
+		t.Errorf("Capacity changed to %d before the reshape finished", raid.GetEffectiveCapacity())
+	}
+	written := rewriteBlocks(t, raid, 0, 2*TestRebuildBlocks)
+	if err := raid.WaitReshape(); err != nil {
+		t.Fatalf("Reshape failed: %v", err)
+	}
+
+	status := raid.ReshapeStatus()
+	if status.Running || status.Done != status.Total || status.Total != TestRebuildBlocks/2 {
+		t.Errorf("Reshape status is %+v after it finished", status)
+	}
+	if raid.GetEffectiveCapacity() != 3*TestRebuildBlocks {
+		t.Errorf("Capacity is %d after growing, expected %d", raid.GetEffectiveCapacity(), 3*TestRebuildBlocks)
+	}
+	verifyRewritten(t, raid, 2*TestRebuildBlocks, written)
+	for stripNum := 0; stripNum < TestRebuildBlocks; stripNum++ {
+		checkParity(t, &raid.memberSet, stripNum)
+	}
+	if err := raid.Write(3*TestRebuildBlocks-1, blockPattern(1)); err != nil {
+		t.Errorf("Failed to write the last block of the grown array: %v", err)
+	}
+	raid.Close()
+
+	reopened := openTestArray(t, dir)
+	defer reopened.CleanUp()
+	if reopened.numDisks != 4 || reopened.checkpoint != nil {
+		t.Errorf("Reopened %d disks with checkpoint %v, expected 4 and none", reopened.numDisks, reopened.checkpoint)
+	}
+	verifyRewritten(t, reopened, 2*TestRebuildBlocks, written)
+}
+
+// TestRAID0Grow tests growing a RAID0 from 2 to 3 disks
+func TestRAID0Grow(t *testing.T) {
+	g := testGeometry(t, 2, 2)
+	g.DiskBlocks = TestRebuildBlocks
+	raid, err := NewRAID0WithGeometry(g)
+	if err != nil {
+		t.Fatalf("Failed to create RAID0: %v", err)
+	}
+	if err := raid.Initialize(); err != nil {
+		t.Fatalf("Failed to initialize RAID0: %v", err)
+	}
+	defer raid.CleanUp()
+	writeAndVerify(t, raid, 2*TestRebuildBlocks)
+
+	if err := raid.Grow(); err != nil {
+		t.Fatalf("Failed to grow RAID0: %v", err)
+	}
+	written := rewriteBlocks(t, raid, 1, 2*TestRebuildBlocks)
+	if err := raid.WaitReshape(); err != nil {
+		t.Fatalf("Reshape failed: %v", err)
+	}
+	if raid.GetEffectiveCapacity() != 3*TestRebuildBlocks {
+		t.Errorf("Capacity is %d after growing, expected %d", raid.GetEffectiveCapacity(), 3*TestRebuildBlocks)
+	}
+	verifyRewritten(t, raid, 2*TestRebuildBlocks, written)
+}
+
+// TestMigrateToRAID5 tests converting RAID1 and RAID4 arrays to RAID5
+func TestMigrateToRAID5(t *testing.T) {
+	tests := []struct {
+		name          string
+		create        func(g Geometry) (RAID, error)
+		from, to      int // Member disks before and after
+		before, after int // Capacity in disk sizes before and after
+	}{
+		{"RAID1", func(g Geometry) (RAID, error) { return NewRAID1WithGeometry(g) }, 3, 3, 1, 2},
+		{"RAID4", func(g Geometry) (RAID, error) { return NewRAID4WithGeometry(g) }, 3, 4, 2, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := testGeometry(t, tt.from, 1)
+			g.DiskBlocks = TestRebuildBlocks
+			raid, err := tt.create(g)
+			if err != nil {
+				t.Fatalf("Failed to create %s: %v", tt.name, err)
+			}
+			if err := raid.Initialize(); err != nil {
+				t.Fatalf("Failed to initialize %s: %v", tt.name, err)
+			}
+			writeAndVerify(t, raid, tt.before*TestRebuildBlocks)
+
+			raid5, err := MigrateToRAID5(raid, tt.to)
+			if err != nil {
+				t.Fatalf("Failed to migrate %s: %v", tt.name, err)
+			}
+			written := rewriteBlocks(t, raid5, 2, tt.before*TestRebuildBlocks)
+			if err := raid5.WaitReshape(); err != nil {
+				t.Fatalf("Migration failed: %v", err)
+			}
+			if raid5.GetEffectiveCapacity() != tt.after*TestRebuildBlocks {
+				t.Errorf("Capacity is %d after migrating, expected %d", raid5.GetEffectiveCapacity(), tt.after*TestRebuildBlocks)
+			}
+			verifyRewritten(t, raid5, tt.before*TestRebuildBlocks, written)
+			for stripNum := 0; stripNum < TestRebuildBlocks; stripNum++ {
+				checkParity(t, &raid5.memberSet, stripNum)
+			}
+			raid5.Close()
+
+			reopened := openTestArray(t, g.Dir)
+			defer reopened.CleanUp()
+			verifyRewritten(t, reopened, tt.before*TestRebuildBlocks, written)
+		})
+	}
+
+	raid, _ := createTestArray(t, 3)
+	defer raid.CleanUp()
+	if _, err := MigrateToRAID5(raid, 4); err == nil {
+		t.Errorf("Expected migrating a RAID5 to be refused")
+	}
+}
+
+// TestReshapeResume tests a reshape interrupted by a crash part way through,
+// after stripes were moved but before they were all committed, carrying on
+// when the array is opened again
+func TestReshapeResume(t *testing.T) {
+	raid, dir := createTestArray(t, 3)
+	writeAndVerify(t, raid, raid.GetEffectiveCapacity())
+	if err := raid.Grow(); err != nil {
+		t.Fatalf("Failed to grow RAID5: %v", err)
+	}
+
+	// Stop the background reshape, move a few more stripes by hand so some
+	// are uncommitted, then crash
+	raid.mu.Lock()
+	s := raid.reshape
+	s.stop = true
+	raid.mu.Unlock()
+	s.done.Wait()
+	raid.mu.Lock()
+	for target := min(s.pos+5, s.stripes-1); s.pos < target; {
+		if err := s.step(); err != nil {
+			t.Fatalf("Failed to move stripe %d: %v", s.pos, err)
+		}
+	}
+	t.Logf("Crashed at stripe %d with %d committed", s.pos, s.committed)
+	raid.mu.Unlock()
+	crashArray(&raid.memberSet)
+
+	reopened := openTestArray(t, dir)
+	defer reopened.CleanUp()
+	if err := reopened.WaitReshape(); err != nil {
+		t.Fatalf("Resumed reshape failed: %v", err)
+	}
+	if reopened.numDisks != 4 || reopened.GetEffectiveCapacity() != 3*TestRebuildBlocks {
+		t.Errorf("Resumed array has %d disks and capacity %d", reopened.numDisks, reopened.GetEffectiveCapacity())
+	}
+	verifyBlocks(t, reopened, 2*TestRebuildBlocks)
+	for stripNum := 0; stripNum < TestRebuildBlocks; stripNum++ {
+		checkParity(t, &reopened.memberSet, stripNum)
+	}
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// errScrubRunning is returned when a scrub is started while one is running
+var errScrubRunning = errors.New("a scrub is already running")
+
+// ScrubOptions selects the strips a scrub checks and what it does about
+// mismatches
+type ScrubOptions struct {
+	FirstStrip int  // First strip to check
+	LastStrip  int  // Last strip to check, or -1 for the end of the array
+	Repair     bool // Rewrite parity or mirror copies that do not match
+	Rate       int  // Strips per second, 0 for full speed
+
+	// SkipUnused passes over strips never written since Initialize, or
+	// discarded since. They are zeros on every member unless something
+	// outside the array has written to them.
+	SkipUnused bool
+}
+
+// ScrubReport summarizes the current or most recent scrub
+type ScrubReport struct {
+	Running    bool
+	Checked    int   // Strips checked so far
+	Skipped    int   // Strips that could not be checked because a member has failed
+	Unused     int   // Strips passed over with SkipUnused because they hold no data
+	Mismatches []int // Strips whose parity or mirror copies did not match
+	Repaired   int   // Mismatched strips that were rewritten
+	Elapsed    time.Duration
+}
+
+// scrubResult is the outcome of checking one strip
+type scrubResult int
+
+const (
+	scrubClean scrubResult = iota
+	scrubSkipped
+	scrubMismatch
+	scrubRepaired
+)
+
+// StartScrub starts checking strips in the background, taking the array lock
+// and the strip's lock for one strip at a time so normal reads and writes
+// carry on in between
+func (m *memberSet) StartScrub(opts ScrubOptions) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.scrubStrip == nil {
+		return errors.New("array is not initialized")
+	}
+	if m.scrubbing {
+		return errScrubRunning
+	}
+	if m.reshaping {
+		return errors.New("array is being reshaped")
+	}
+	last := opts.LastStrip
+	if last < 0 {
+		last = m.diskBlocks - 1
+	}
+	if opts.FirstStrip < 0 || opts.FirstStrip > last || last >= m.diskBlocks {
+		return fmt.Errorf("invalid scrub range %d-%d", opts.FirstStrip, opts.LastStrip)
+	}
+
+	var delay time.Duration
+	if opts.Rate > 0 {
+		delay = time.Second / time.Duration(opts.Rate)
+	}
+	m.scrubbing = true
+	m.scrubStop = false
+	m.scrubReport = ScrubReport{Running: true}
+	m.scrubStart = time.Now()
+	m.scrubDone.Add(1)
+	go m.scrub(opts.FirstStrip, last, opts.Repair, opts.SkipUnused, delay)
+	return nil
+}
+
+// scrub checks strips first to last, pausing for delay after each one
+func (m *memberSet) scrub(first, last int, repair, skipUnused bool, delay time.Duration) {
+	defer m.scrubDone.Done()
+
+	for stripNum := first; stripNum <= last; stripNum++ {
+		m.lockStrip(stripNum)
+		m.mu.Lock()
+		if m.stopping || m.scrubStop {
+			m.mu.Unlock()
+			m.unlockStrip(stripNum)
+			break
+		}
+		if skipUnused && !m.inUse(stripNum) {
+			m.scrubReport.Unused++
+		} else {
+			switch m.scrubStrip(stripNum, repair) {
+			case scrubSkipped:
+				m.scrubReport.Skipped++
+			case scrubMismatch:
+				m.scrubReport.Mismatches = append(m.scrubReport.Mismatches, stripNum)
+			case scrubRepaired:
+				m.scrubReport.Mismatches = append(m.scrubReport.Mismatches, stripNum)
+				m.scrubReport.Repaired++
+			}
+			m.scrubReport.Checked++
+		}
+		m.mu.Unlock()
+		m.unlockStrip(stripNum)
+
+		time.Sleep(delay)
+	}
+
+	m.mu.Lock()
+	m.scrubbing = false
+	m.scrubReport.Running = false
+	m.scrubReport.Elapsed = time.Since(m.scrubStart)
+	m.mu.Unlock()
+}
+
+// ScrubStatus returns the progress of the current or most recent scrub
+func (m *memberSet) ScrubStatus() ScrubReport {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	report := m.scrubReport
+	report.Mismatches = append([]int(nil), report.Mismatches...)
+	if m.scrubbing {
+		report.Elapsed = time.Since(m.scrubStart)
+	}
+	return report
+}
+
+// WaitScrub blocks until no scrub is running and returns its report
+func (m *memberSet) WaitScrub() ScrubReport {
+	m.scrubDone.Wait()
+	return m.ScrubStatus()
+}
+
+// StopScrub stops a running scrub and waits for it to exit
+func (m *memberSet) StopScrub() {
+	m.mu.Lock()
+	m.scrubStop = true
+	m.mu.Unlock()
+	m.scrubDone.Wait()
+}
+
+// Scrub checks strips and waits for the result
+func (m *memberSet) Scrub(opts ScrubOptions) (ScrubReport, error) {
+	if err := m.StartScrub(opts); err != nil {
+		return ScrubReport{}, err
+	}
+	return m.WaitScrub(), nil
+}
+
+// scrubParity checks that the blocks of a parity strip XOR to zero. In repair
+// mode a mismatch is fixed by recomputing the parity block from the data.
+func (m *memberSet) scrubParity(blockSize, stripNum, parityDisk int, repair bool) scrubResult {
+	if missing, err := m.failedDisk(stripNum); missing != -1 || err != nil {
+		return scrubSkipped
+	}
+	ops := m.otherMembers(blockSize)
+	if _, err := m.readMembers(stripNum, ops); err != nil {
+		return scrubSkipped
+	}
+
+	sum := make([]byte, blockSize)
+	for _, op := range ops {
+		xorInto(sum, op.data)
+	}
+	if bytes.Equal(sum, make([]byte, blockSize)) {
+		return scrubClean
+	}
+	if !repair {
+		return scrubMismatch
+	}
+
+	// The sum is the data XOR the old parity, so adding the old parity back
+	// leaves the parity the data needs
+	xorInto(sum, ops[parityDisk].data)
+	if err := m.write(parityDisk, stripNum, sum); err != nil {
+		return scrubMismatch
+	}
+	return scrubRepaired
+}
+
+// checkStrip checks the parity of one RAID4 strip
+func (r *RAID4) checkStrip(stripNum int, repair bool) scrubResult {
+	return r.scrubParity(r.blockSize, stripNum, r.parityDisk, repair)
+}
+
+// checkStrip checks the parity of one RAID5 strip
+func (r *RAID5) checkStrip(stripNum int, repair bool) scrubResult {
+	return r.scrubParity(r.blockSize, stripNum, r.getParityDisk(stripNum/r.chunkBlocks), repair)
+}
+
+// checkStrip compares every mirror's copy of a block with the first one. In
+// repair mode the copies that differ are overwritten with the first.
+func (r *RAID1) checkStrip(blockNum int, repair bool) scrubResult {
+	var ops []memberOp
+	for i := range r.disks {
+		if r.isFailed(i, blockNum) {
+			return scrubSkipped
+		}
+		ops = append(ops, memberOp{diskNum: i, data: make([]byte, r.blockSize)})
+	}
+	if _, err := r.readMembers(blockNum, ops); err != nil {
+		return scrubSkipped
+	}
+
+	var stale []memberOp
+	for _, op := range ops[1:] {
+		if !bytes.Equal(op.data, ops[0].data) {
+			stale = append(stale, memberOp{diskNum: op.diskNum, data: ops[0].data})
+		}
+	}
+	if len(stale) == 0 {
+		return scrubClean
+	}
+	if !repair {
+		return scrubMismatch
+	}
+	if _, err := r.writeMembers(blockNum, stale); err != nil {
+		return scrubMismatch
+	}
+	return scrubRepaired
+}
+
+// checkStrip checks both P and Q of one RAID6 strip against the data. In
+// repair mode both are rewritten if either is wrong.
+func (r *RAID6) checkStrip(stripNum int, repair bool) scrubResult {
+	if r.countFailed(stripNum) > 0 {
+		return scrubSkipped
+	}
+	s, err := r.readStripe(stripNum)
+	if err != nil || r.countFailed(stripNum) > 0 {
+		return scrubSkipped
+	}
+
+	want := &stripe{data: s.data}
+	want.computeParity(r.blockSize)
+	if bytes.Equal(want.p, s.p) && bytes.Equal(want.q, s.q) {
+		return scrubClean
+	}
+	if !repair {
+		return scrubMismatch
+	}
+
+	pDisk, qDisk := r.getParityDisks(stripNum)
+	_, err = r.writeMembers(stripNum, []memberOp{
+		{diskNum: pDisk, data: want.p},
+		{diskNum: qDisk, data: want.q},
+	})
+	if err != nil {
+		return scrubMismatch
+	}
+	return scrubRepaired
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"slices"
+	"testing"
+	"time"
+)
+
+// corruptBlock overwrites a block on one member directly, behind the array's
+// back
+func corruptBlock(t *testing.T, m *memberSet, diskNum, blockNum int) {
+	t.Helper()
+	if err := m.disks[diskNum].Write(blockNum, bytes.Repeat([]byte{0xee}, TestBlockSize)); err != nil {
+		t.Fatalf("Failed to corrupt disk %d block %d: %v", diskNum, blockNum, err)
+	}
+}
+
+// TestRAID5Scrub tests that a scrub finds strips with bad parity or bad data
+// and that repair mode makes every strip consistent again
+func TestRAID5Scrub(t *testing.T) {
+	raid, err := NewRAID5WithGeometry(rebuildGeometry())
+	if err != nil {
+		t.Fatalf("Failed to create RAID5: %v", err)
+	}
+	err = raid.Initialize()
+	if err != nil {
+		t.Fatalf("Failed to initialize RAID5: %v", err)
+	}
+	defer raid.CleanUp()
+	writeAndVerify(t, raid, 4*TestRebuildBlocks)
+
+	corruptBlock(t, &raid.memberSet, raid.getParityDisk(3), 3)
+	corruptBlock(t, &raid.memberSet, 0, 7)
+
+	report, err := raid.Scrub(ScrubOptions{LastStrip: -1})
+	if err != nil {
+		t.Fatalf("Failed to scrub RAID5: %v", err)
+	}
+	if report.Checked != TestRebuildBlocks || !slices.Equal(report.Mismatches, []int{3, 7}) || report.Repaired != 0 {
+		t.Errorf("Check-only scrub reported %+v, expected strips 3 and 7 to mismatch", report)
+	}
+
+	report, _ = raid.Scrub(ScrubOptions{LastStrip: -1, Repair: true})
+	if report.Repaired != 2 {
+		t.Errorf("Repair scrub reported %+v, expected 2 repairs", report)
+	}
+	for stripNum := 0; stripNum < TestRebuildBlocks; stripNum++ {
+		checkParity(t, &raid.memberSet, stripNum)
+	}
+
+	report, _ = raid.Scrub(ScrubOptions{LastStrip: -1})
+	if len(report.Mismatches) != 0 {
+		t.Errorf("Scrub after repair still found mismatches: %v", report.Mismatches)
+	}
+}
+
+// TestRAID4ScrubRange tests scrubbing only part of a RAID4 array
+func TestRAID4ScrubRange(t *testing.T) {
+	raid, err := NewRAID4WithGeometry(rebuildGeometry())
+	if err != nil {
+		t.Fatalf("Failed to create RAID4: %v", err)
+	}
+	err = raid.Initialize()
+	if err != nil {
+		t.Fatalf("Failed to initialize RAID4: %v", err)
+	}
+	defer raid.CleanUp()
+	writeAndVerify(t, raid, 40)
+
+	corruptBlock(t, &raid.memberSet, raid.parityDisk, 2)
+	corruptBlock(t, &raid.memberSet, raid.parityDisk, 20)
+
+	report, err := raid.Scrub(ScrubOptions{FirstStrip: 10, LastStrip: 29, Repair: true})
+	if err != nil {
+		t.Fatalf("Failed to scrub RAID4: %v", err)
+	}
+	if report.Checked != 20 || !slices.Equal(report.Mismatches, []int{20}) || report.Repaired != 1 {
+		t.Errorf("Range scrub reported %+v, expected only strip 20 in range", report)
+	}
+	if _, err := raid.Scrub(ScrubOptions{FirstStrip: 30, LastStrip: 10}); err == nil {
+		t.Errorf("Expected an empty scrub range to be rejected")
+	}
+}
+
+// TestRAID1Scrub tests comparing and repairing mirror copies
+func TestRAID1Scrub(t *testing.T) {
+	raid, err := NewRAID1WithGeometry(rebuildGeometry())
+	if err != nil {
+		t.Fatalf("Failed to create RAID1: %v", err)
+	}
+	err = raid.Initialize()
+	if err != nil {
+		t.Fatalf("Failed to initialize RAID1: %v", err)
+	}
+	defer raid.CleanUp()
+	writeAndVerify(t, raid, TestRebuildBlocks)
+
+	corruptBlock(t, &raid.memberSet, 3, 5)
+
+	report, _ := raid.Scrub(ScrubOptions{LastStrip: -1, Repair: true})
+	if !slices.Equal(report.Mismatches, []int{5}) || report.Repaired != 1 {
+		t.Errorf("RAID1 scrub reported %+v, expected block 5 to be repaired", report)
+	}
+	data := make([]byte, TestBlockSize)
+	raid.disks[3].Read(5, data)
+	if !bytes.Equal(data, blockPattern(5)) {
+		t.Errorf("Mirror 3 block 5 was not repaired")
+	}
+}
+
+// TestRAID6Scrub tests that a bad Q block is found and rewritten
+func TestRAID6Scrub(t *testing.T) {
+	raid, err := NewRAID6WithGeometry(rebuildGeometry())
+	if err != nil {
+		t.Fatalf("Failed to create RAID6: %v", err)
+	}
+	err = raid.Initialize()
+	if err != nil {
+		t.Fatalf("Failed to initialize RAID6: %v", err)
+	}
+	defer raid.CleanUp()
+	writeAndVerify(t, raid, 30)
+
+	_, qDisk := raid.getParityDisks(4)
+	corruptBlock(t, &raid.memberSet, qDisk, 4)
+
+	report, _ := raid.Scrub(ScrubOptions{LastStrip: -1, Repair: true})
+	if !slices.Equal(report.Mismatches, []int{4}) || report.Repaired != 1 {
+		t.Errorf("RAID6 scrub reported %+v, expected strip 4 to be repaired", report)
+	}
+	report, _ = raid.Scrub(ScrubOptions{LastStrip: -1})
+	if len(report.Mismatches) != 0 {
+		t.Errorf("Scrub after repair still found mismatches: %v", report.Mismatches)
+	}
+}
+
+// TestScrubInBackground tests a rate-limited scrub running alongside writes,
+// and that strips with a failed member are skipped
+func TestScrubInBackground(t *testing.T) {
+	raid, err := NewRAID5WithGeometry(rebuildGeometry())
+	if err != nil {
+		t.Fatalf("Failed to create RAID5: %v", err)
+	}
+	err = raid.Initialize()
+	if err != nil {
+		t.Fatalf("Failed to initialize RAID5: %v", err)
+	}
+	defer raid.CleanUp()
+
+	// 20 strips at 200 per second take about 100ms
+	err = raid.StartScrub(ScrubOptions{LastStrip: 19, Rate: 200})
+	if err != nil {
+		t.Fatalf("Failed to start scrub: %v", err)
+	}
+	if err := raid.StartScrub(ScrubOptions{LastStrip: -1}); err != errScrubRunning {
+		t.Errorf("Expected a second scrub to be refused, got %v", err)
+	}
+	if !raid.ScrubStatus().Running {
+		t.Errorf("Expected the scrub to be running")
+	}
+
+	// Writes keep every strip consistent, so the scrub finds nothing
+	writeAndVerify(t, raid, 80)
+	report := raid.WaitScrub()
+	if report.Running || report.Checked != 20 || len(report.Mismatches) != 0 {
+		t.Errorf("Background scrub reported %+v, expected 20 clean strips", report)
+	}
+	if report.Elapsed < 90*time.Millisecond {
+		t.Errorf("Scrub took %v, expected the rate limit to slow it down", report.Elapsed)
+	}
+
+	raid.FailDisk(2)
+	report, _ = raid.Scrub(ScrubOptions{LastStrip: 9})
+	if report.Skipped != 10 {
+		t.Errorf("Degraded scrub reported %+v, expected every strip to be skipped", report)
+	}
+}
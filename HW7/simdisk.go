@@ -0,0 +1,227 @@
+package main
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// DiskModel describes the mechanics of a simulated hard disk
+type DiskModel struct {
+	RPM          int           // Spindle speed
+	MinSeek      time.Duration // Seek to the next track
+	MaxSeek      time.Duration // Seek across every track
+	TransferRate int           // Bytes per second read or written under the head
+}
+
+// DefaultDiskModel is used by SimulatedBackend. Its seeks average about 7ms
+// and its rotational delay 3ms over random requests, with 50MB/s transfers,
+// as in the disk of the OSTEP RAID analysis.
+var DefaultDiskModel = DiskModel{
+	RPM:          10000,
+	MinSeek:      time.Millisecond,
+	MaxSeek:      12250 * time.Microsecond,
+	TransferRate: 50 * 1024 * 1024,
+}
+
+// seekTime returns the time to move the head distance tracks on a disk of
+// tracks tracks. Seek time grows with the square root of the distance, from
+// MinSeek for one track to MaxSeek for the whole disk.
+func (m DiskModel) seekTime(distance, tracks int) time.Duration {
+	if distance == 0 {
+		return 0
+	}
+	if tracks <= 2 {
+		return m.MinSeek
+	}
+	fraction := math.Sqrt(float64(distance-1) / float64(tracks-2))
+	return m.MinSeek + time.Duration(fraction*float64(m.MaxSeek-m.MinSeek))
+}
+
+// virtualTimer is implemented by devices and arrays that keep simulated time
+type virtualTimer interface {
+	// VirtualTime returns the simulated time at which the device, or the
+	// busiest member of the array, finishes its last request
+	VirtualTime() time.Duration
+	// AdvanceTo leaves the device, or every member, idle until time t if it
+	// would otherwise finish sooner
+	AdvanceTo(t time.Duration)
+}
+
+// virtualTime returns the latest virtual time among disks that keep one
+func virtualTime(disks []BlockDevice) time.Duration {
+	var latest time.Duration
+	for _, disk := range disks {
+		if timer, ok := disk.(virtualTimer); ok {
+			latest = max(latest, timer.VirtualTime())
+		}
+	}
+	return latest
+}
+
+// advanceTo advances every disk that keeps virtual time to time t
+func advanceTo(disks []BlockDevice, t time.Duration) {
+	for _, disk := range disks {
+		if timer, ok := disk.(virtualTimer); ok {
+			timer.AdvanceTo(t)
+		}
+	}
+}
+
+// SimulatedDisk wraps a BlockDevice that holds the data and charges virtual
+// time for each request instead of waiting: a seek to the block's track, the
+// rotational delay until the block comes under the head, and the transfer.
+// Requests are served back to back, so the disk's clock is the time it has
+// been busy, plus any idle time from AdvanceTo. Tracks are skewed so a
+// sequential run crossing to the next track only waits for the seek.
+type SimulatedDisk struct {
+	disk           BlockDevice
+	model          DiskModel
+	blockSize      int
+	blocksPerTrack int
+	tracks         int
+	skew           int           // Sectors each track is rotated from the one before
+	sectorTime     time.Duration // Time for one block to pass under the head
+	rotation       time.Duration // Time for one revolution
+
+	mu    sync.Mutex
+	clock time.Duration // Virtual time at which the last request finishes
+	track int           // Track the head is over
+}
+
+// NewSimulatedDisk wraps disk, which has diskBlocks blocks of blockSize
+// bytes, with the timing of model
+func NewSimulatedDisk(disk BlockDevice, model DiskModel, blockSize, diskBlocks int) *SimulatedDisk {
+	rotation := time.Minute / time.Duration(model.RPM)
+	blocksPerTrack := max(1, int(int64(rotation)*int64(model.TransferRate)/(int64(blockSize)*int64(time.Second))))
+	sectorTime := rotation / time.Duration(blocksPerTrack)
+	return &SimulatedDisk{
+		disk:           disk,
+		model:          model,
+		blockSize:      blockSize,
+		blocksPerTrack: blocksPerTrack,
+		tracks:         max(1, (diskBlocks+blocksPerTrack-1)/blocksPerTrack),
+		skew:           int((model.MinSeek + sectorTime - 1) / sectorTime),
+		sectorTime:     sectorTime,
+		rotation:       rotation,
+	}
+}
+
+// access charges the virtual time of a request for length bytes starting at
+// a block and moves the head to the end of it
+func (d *SimulatedDisk) access(blockNum, length int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	track := min(blockNum/d.blocksPerTrack, d.tracks-1)
+	d.clock += d.model.seekTime(abs(track-d.track), d.tracks)
+
+	sector := (blockNum%d.blocksPerTrack + track*d.skew) % d.blocksPerTrack
+	target := time.Duration(sector) * d.sectorTime
+	d.clock += (target - d.clock%d.rotation + d.rotation) % d.rotation
+
+	blocks := max(1, (length+d.blockSize-1)/d.blockSize)
+	d.clock += time.Duration(blocks) * d.sectorTime
+	d.track = min((blockNum+blocks-1)/d.blocksPerTrack, d.tracks-1)
+}
+
+// abs returns the absolute value of n
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+// Read reads from the wrapped disk and charges the time it would take
+func (d *SimulatedDisk) Read(blockNum int, buffer []byte) error {
+	d.access(blockNum, len(buffer))
+	return d.disk.Read(blockNum, buffer)
+}
+
+// Write writes to the wrapped disk and charges the time it would take
+func (d *SimulatedDisk) Write(blockNum int, data []byte) error {
+	d.access(blockNum, len(data))
+	return d.disk.Write(blockNum, data)
+}
+
+// Flush flushes the wrapped disk
+func (d *SimulatedDisk) Flush() error {
+	return flushDevice(d.disk)
+}
+
+// Discard discards blocks on the wrapped disk. Freeing blocks moves no head,
+// so it takes no time.
+func (d *SimulatedDisk) Discard(blockNum, count int) error {
+	return passDiscard(d.disk, blockNum, count)
+}
+
+// Close closes the wrapped disk
+func (d *SimulatedDisk) Close() error {
+	return d.disk.Close()
+}
+
+// Delete deletes the wrapped disk
+func (d *SimulatedDisk) Delete() error {
+	return d.disk.Delete()
+}
+
+// VirtualTime returns the virtual time at which the last request finishes
+func (d *SimulatedDisk) VirtualTime() time.Duration {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.clock
+}
+
+// AdvanceTo leaves the disk idle until time t, with the platter still
+// turning
+func (d *SimulatedDisk) AdvanceTo(t time.Duration) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.clock = max(d.clock, t)
+}
+
+// VirtualTime returns the virtual time at which the busiest simulated member
+// finishes its last request, or 0 if no member is simulated
+func (r *RAID0) VirtualTime() time.Duration {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return virtualTime(r.disks)
+}
+
+// AdvanceTo leaves every simulated member idle until time t
+func (r *RAID0) AdvanceTo(t time.Duration) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	advanceTo(r.disks, t)
+}
+
+// VirtualTime returns the virtual time at which the busiest simulated member
+// finishes its last request, or 0 if no member is simulated
+func (m *memberSet) VirtualTime() time.Duration {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return virtualTime(m.disks)
+}
+
+// AdvanceTo leaves every simulated member idle until time t
+func (m *memberSet) AdvanceTo(t time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	advanceTo(m.disks, t)
+}
+
+// VirtualTime returns the wrapped array's virtual time, if it keeps one
+func (d *RAIDDevice) VirtualTime() time.Duration {
+	if timer, ok := d.raid.(virtualTimer); ok {
+		return timer.VirtualTime()
+	}
+	return 0
+}
+
+// AdvanceTo advances the wrapped array's virtual time, if it keeps one
+func (d *RAIDDevice) AdvanceTo(t time.Duration) {
+	if timer, ok := d.raid.(virtualTimer); ok {
+		timer.AdvanceTo(t)
+	}
+}
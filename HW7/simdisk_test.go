@@ -0,0 +1,121 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// TestSeekCurve tests the ends of the seek curve and that it grows with
+// distance
+func TestSeekCurve(t *testing.T) {
+	m := DefaultDiskModel
+	if m.seekTime(0, 100) != 0 {
+		t.Errorf("Staying on a track took %v", m.seekTime(0, 100))
+	}
+	if m.seekTime(1, 100) != m.MinSeek || m.seekTime(99, 100) != m.MaxSeek {
+		t.Errorf("Seeks of 1 and 99 tracks took %v and %v, expected %v and %v",
+			m.seekTime(1, 100), m.seekTime(99, 100), m.MinSeek, m.MaxSeek)
+	}
+	if m.seekTime(10, 100) >= m.seekTime(50, 100) {
+		t.Errorf("A 10-track seek took no less than a 50-track seek")
+	}
+}
+
+// TestSimulatedDisk tests the virtual time charged for sequential and random
+// requests on one disk
+func TestSimulatedDisk(t *testing.T) {
+	disk := NewSimulatedDisk(NewMemoryDisk(TestBlockSize), DefaultDiskModel, TestBlockSize, 10000)
+	sector := disk.sectorTime
+
+	// A sequential run pays one rotational delay, then only transfers, even
+	// across a track boundary
+	data := blockPattern(0)
+	disk.Write(0, data)
+	start := disk.VirtualTime()
+	for blockNum := 1; blockNum <= 2*disk.blocksPerTrack; blockNum++ {
+		disk.Write(blockNum, data)
+	}
+	seek := DefaultDiskModel.MinSeek
+	sequential := disk.VirtualTime() - start
+	if limit := time.Duration(2*disk.blocksPerTrack)*sector + 2*seek + 2*sector; sequential > limit {
+		t.Errorf("Sequential run took %v, expected at most %v", sequential, limit)
+	}
+
+	// Rewriting the block just written waits a whole revolution
+	start = disk.VirtualTime()
+	disk.Write(2*disk.blocksPerTrack, data)
+	if elapsed := disk.VirtualTime() - start; elapsed != disk.rotation {
+		t.Errorf("Rewriting a block took %v, expected one revolution of %v", elapsed, disk.rotation)
+	}
+
+	// A long seek costs the full stroke, and the head ends on the last track
+	start = disk.VirtualTime()
+	disk.Read(9999, data)
+	if elapsed := disk.VirtualTime() - start; elapsed < DefaultDiskModel.MaxSeek-seek {
+		t.Errorf("Seeking across the disk took only %v", elapsed)
+	}
+	if disk.track != disk.tracks-1 {
+		t.Errorf("Head is on track %d, expected the last track %d", disk.track, disk.tracks-1)
+	}
+
+	disk.AdvanceTo(time.Hour)
+	if disk.VirtualTime() != time.Hour {
+		t.Errorf("Disk time is %v after advancing to an hour", disk.VirtualTime())
+	}
+}
+
+// benchmarkSimulated runs a benchmark on a simulated 5-disk array of each
+// level. With 5 disks, small parity writes read the old data and parity.
+func benchmarkSimulated(t *testing.T, opts BenchmarkOptions) map[string]BenchmarkStats {
+	t.Helper()
+	results := make(map[string]BenchmarkStats)
+	g := testGeometry(t, 5, 1)
+	g.Backend = SimulatedBackend
+	r0, _ := NewRAID0WithGeometry(g)
+	r4, _ := NewRAID4WithGeometry(g)
+	r5, _ := NewRAID5WithGeometry(g)
+	for _, raid := range []RAID{r0, r4, r5} {
+		stats, err := RunBenchmark(raid, 600, opts)
+		if err != nil {
+			t.Fatalf("Benchmark of %s failed: %v", raid.GetName(), err)
+		}
+		results[raid.GetName()] = stats
+	}
+	return results
+}
+
+// TestSimulatedBenchmark tests that virtual times are repeatable and follow
+// the textbook ordering of the levels
+func TestSimulatedBenchmark(t *testing.T) {
+	random := benchmarkSimulated(t, BenchmarkOptions{Random: true})
+	again := benchmarkSimulated(t, BenchmarkOptions{Random: true})
+	for name, stats := range random {
+		if stats.VirtualWriteTime == 0 || stats.VirtualReadTime == 0 {
+			t.Errorf("%s reported no virtual time: %+v", name, stats)
+		}
+		if again[name].VirtualWriteTime != stats.VirtualWriteTime || again[name].VirtualReadTime != stats.VirtualReadTime {
+			t.Errorf("%s virtual times differ between runs: %+v and %+v", name, stats, again[name])
+		}
+	}
+
+	// Random small writes: RAID4's parity disk takes two I/Os for every
+	// write, while RAID5 spreads them over every disk
+	if !(random["RAID0"].VirtualWriteTime < random["RAID5"].VirtualWriteTime &&
+		random["RAID5"].VirtualWriteTime < random["RAID4"].VirtualWriteTime) {
+		t.Errorf("Random write times are RAID0 %v, RAID5 %v, RAID4 %v, expected that order",
+			random["RAID0"].VirtualWriteTime, random["RAID5"].VirtualWriteTime, random["RAID4"].VirtualWriteTime)
+	}
+
+	// Sequential reads stream from every data disk at once
+	sequential := benchmarkSimulated(t, BenchmarkOptions{Sequential: true})
+	perDisk := DefaultDiskModel.TransferRate
+	for name, disks := range map[string]int{"RAID0": 5, "RAID4": 4, "RAID5": 4} {
+		speed := float64(600*TestBlockSize) / sequential[name].VirtualReadTime.Seconds()
+		if speed < 0.5*float64(disks*perDisk) || speed > 1.05*float64(disks*perDisk) {
+			t.Errorf("%s sequential reads ran at %.0f bytes/s, expected about %d", name, speed, disks*perDisk)
+		}
+		if sequential[name].VirtualReadTime >= random[name].VirtualReadTime {
+			t.Errorf("%s sequential reads were no faster than random reads", name)
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import "sync"
+
+// stripeLocks is a table of locks on the strips of an array, keyed by strip
+// number (the block number on the members). Operations on the same strip
+// take its lock in turn, so a parity update is never interleaved with another
+// one on the same strip, while operations on different strips run in
+// parallel. Locks are created on first use and dropped when nobody holds or
+// waits for them.
+//
+// Every strip operation also holds the table shared, from before it maps its
+// block to a strip until it is done. Changes to the whole array, such as
+// adding a member, hold it exclusively so the layout cannot move under an
+// operation in flight.
+type stripeLocks struct {
+	all   sync.RWMutex
+	mu    sync.Mutex // Guards strips
+	strip map[int]*stripLock
+}
+
+// stripLock is the lock on one strip, with the number of goroutines holding
+// or waiting for it
+type stripLock struct {
+	sync.RWMutex
+	refs int
+}
+
+// enter starts an operation on the array, waiting for any whole-array change
+// to finish
+func (l *stripeLocks) enter() {
+	l.all.RLock()
+}
+
+// exit ends an operation started with enter
+func (l *stripeLocks) exit() {
+	l.all.RUnlock()
+}
+
+// lock takes the lock on a strip. Must be called between enter and exit.
+func (l *stripeLocks) lock(stripNum int) {
+	l.get(stripNum).Lock()
+}
+
+// unlock releases the lock on a strip
+func (l *stripeLocks) unlock(stripNum int) {
+	l.put(stripNum).Unlock()
+}
+
+// rlock takes the lock on a strip shared with other readers, for operations
+// that only read the strip. Must be called between enter and exit.
+func (l *stripeLocks) rlock(stripNum int) {
+	l.get(stripNum).RLock()
+}
+
+// runlock releases a lock on a strip taken with rlock
+func (l *stripeLocks) runlock(stripNum int) {
+	l.put(stripNum).RUnlock()
+}
+
+// get returns the lock on a strip, counting the caller as holding it
+func (l *stripeLocks) get(stripNum int) *stripLock {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.strip == nil {
+		l.strip = make(map[int]*stripLock)
+	}
+	s := l.strip[stripNum]
+	if s == nil {
+		s = &stripLock{}
+		l.strip[stripNum] = s
+	}
+	s.refs++
+	return s
+}
+
+// put returns the lock on a strip for the caller to release, dropping it
+// from the table once nobody else holds or waits for it
+func (l *stripeLocks) put(stripNum int) *stripLock {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	s := l.strip[stripNum]
+	s.refs--
+	if s.refs == 0 {
+		delete(l.strip, stripNum)
+	}
+	return s
+}
+
+// lockAll waits for every operation in flight to finish and holds off new
+// ones until unlockAll
+func (l *stripeLocks) lockAll() {
+	l.all.Lock()
+}
+
+// unlockAll lets operations start again after lockAll
+func (l *stripeLocks) unlockAll() {
+	l.all.Unlock()
+}
+
+// lockStrip starts an operation on one strip of the array. Take it before
+// mu.
+func (m *memberSet) lockStrip(stripNum int) {
+	m.stripes.enter()
+	m.stripes.lock(stripNum)
+}
+
+// unlockStrip ends an operation started with lockStrip
+func (m *memberSet) unlockStrip(stripNum int) {
+	m.stripes.unlock(stripNum)
+	m.stripes.exit()
+}
+
+// lockStrips starts an operation on count consecutive strips from stripNum,
+// locking them in order. Take it before mu.
+func (m *memberSet) lockStrips(stripNum, count int) {
+	m.stripes.enter()
+	for i := 0; i < count; i++ {
+		m.stripes.lock(stripNum + i)
+	}
+}
+
+// unlockStrips ends an operation started with lockStrips
+func (m *memberSet) unlockStrips(stripNum, count int) {
+	for i := 0; i < count; i++ {
+		m.stripes.unlock(stripNum + i)
+	}
+	m.stripes.exit()
+}
+
+// unlocked runs member disk I/O for a strip operation. Arrays that lock
+// strips release mu for the I/O itself, so operations on other strips can
+// use the members meanwhile; the strip lock keeps this strip to the caller.
+// While a reshape is moving data the layout is in flux, so mu stays held.
+// Must be called with mu held.
+func (m *memberSet) unlocked(io func()) {
+	if !m.stripLocking || m.reshaping {
+		io()
+		return
+	}
+	m.mu.Unlock()
+	defer m.mu.Lock()
+	io()
+}
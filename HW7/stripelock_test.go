@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestStripeLocks tests that a strip's lock is held by one goroutine at a time
+// and that the table drops locks nobody holds
+func TestStripeLocks(t *testing.T) {
+	var locks stripeLocks
+	var wg sync.WaitGroup
+	counts := make([]int, 4)
+	for g := 0; g < 16; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				strip := (g + i) % len(counts)
+				locks.enter()
+				locks.lock(strip)
+				counts[strip]++ // Raced without the lock
+				locks.unlock(strip)
+				locks.exit()
+			}
+		}()
+	}
+	wg.Wait()
+
+	total := 0
+	for _, n := range counts {
+		total += n
+	}
+	if total != 16*1000 {
+		t.Errorf("Counted %d locked increments, expected %d", total, 16*1000)
+	}
+	if len(locks.strip) != 0 {
+		t.Errorf("Table still holds %d locks after every strip was unlocked", len(locks.strip))
+	}
+}
+
+// stressParity writes from many goroutines at once to the first few stripes
+// of an initialized array, each goroutine owning some blocks so that blocks
+// of one stripe are written concurrently, and returns what each block should
+// hold. Readers run alongside the writers.
+func stressParity(t *testing.T, raid RAID, blocks int) map[int][]byte {
+	t.Helper()
+	const writers = 16
+	final := make(map[int][]byte)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+
+	for g := 0; g < writers; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			random := rand.New(rand.NewSource(int64(g)))
+			for i := 0; i < 200; i++ {
+				blockNum := g + writers*random.Intn(blocks/writers)
+				data := blockPattern(blockNum + i)
+				if err := raid.Write(blockNum, data); err != nil {
+					t.Errorf("%s write of block %d failed: %v", raid.GetName(), blockNum, err)
+					return
+				}
+				mu.Lock()
+				final[blockNum] = data
+				mu.Unlock()
+			}
+		}()
+	}
+
+	var readers sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			for blockNum := 0; ; blockNum = (blockNum + 1) % blocks {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				if _, err := raid.Read(blockNum); err != nil {
+					t.Errorf("%s read of block %d failed: %v", raid.GetName(), blockNum, err)
+					return
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+	close(stop)
+	readers.Wait()
+	return final
+}
+
+// scrubArray is the part of RAID4 and RAID5 the stress test checks with
+type scrubArray interface {
+	RAID
+	FailDisk(diskNum int)
+	AddSpare(disk BlockDevice)
+	WaitRebuild() error
+	Scrub(opts ScrubOptions) (ScrubReport, error)
+}
+
+// TestConcurrentParityWrites tests that parity stays consistent under
+// concurrent writes to the same stripes, with and without a rebuild running
+// alongside them
+func TestConcurrentParityWrites(t *testing.T) {
+	const blocks = 64
+	g := testGeometry(t, 5, 1)
+	g.DiskBlocks = 256 // Keeps the rebuild short
+	g.Backend = MemoryBackend
+	for _, rebuild := range []bool{false, true} {
+		r4, _ := NewRAID4WithGeometry(g)
+		r5, _ := NewRAID5WithGeometry(g)
+		for _, raid := range []scrubArray{r4, r5} {
+			if err := raid.Initialize(); err != nil {
+				t.Fatalf("Failed to initialize %s: %v", raid.GetName(), err)
+			}
+			if rebuild {
+				raid.FailDisk(1)
+				raid.AddSpare(NewMemoryDisk(TestBlockSize))
+			}
+
+			final := stressParity(t, raid, blocks)
+			if err := raid.WaitRebuild(); err != nil {
+				t.Errorf("%s rebuild failed: %v", raid.GetName(), err)
+			}
+
+			report, err := raid.Scrub(ScrubOptions{LastStrip: blocks})
+			if err != nil {
+				t.Fatalf("%s scrub failed to start: %v", raid.GetName(), err)
+			}
+			if len(report.Mismatches) != 0 || report.Skipped != 0 {
+				t.Errorf("%s (rebuild %v) has bad parity after concurrent writes: %+v", raid.GetName(), rebuild, report)
+			}
+			for blockNum, want := range final {
+				data, err := raid.Read(blockNum)
+				if err != nil || !bytes.Equal(data, want) {
+					t.Errorf("%s block %d does not hold its last write, err %v", raid.GetName(), blockNum, err)
+				}
+			}
+			raid.CleanUp()
+		}
+	}
+}
+
+// TestStripeParallelism tests that small writes to different strips overlap
+// while writes to the same strip take turns
+func TestStripeParallelism(t *testing.T) {
+	raid := NewRAID5()
+	err := raid.Initialize()
+	if err != nil {
+		t.Fatalf("Failed to initialize RAID5: %v", err)
+	}
+	defer raid.CleanUp()
+	faulty := injectFaults(raid.disks)
+
+	// Each small write reads old data and parity, then writes both
+	const latency = 20 * time.Millisecond
+	for _, disk := range faulty {
+		disk.SetLatency(latency)
+	}
+	writeAll := func(blockNums []int) time.Duration {
+		start := time.Now()
+		var wg sync.WaitGroup
+		for _, blockNum := range blockNums {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if err := raid.Write(blockNum, blockPattern(blockNum)); err != nil {
+					t.Errorf("Failed to write block %d: %v", blockNum, err)
+				}
+			}()
+		}
+		wg.Wait()
+		return time.Since(start)
+	}
+
+	// Eight strips one after another would take 320ms
+	if elapsed := writeAll([]int{0, 4, 8, 12, 16, 20, 24, 28}); elapsed > 8*latency {
+		t.Errorf("Writes to 8 strips took %v, expected about %v", elapsed, 2*latency)
+	}
+	if elapsed := writeAll([]int{0, 1, 2, 3}); elapsed < 8*latency {
+		t.Errorf("Writes to one strip took %v, expected them to take turns for at least %v", elapsed, 8*latency)
+	}
+	verifyBlocks(t, raid, 4)
+}
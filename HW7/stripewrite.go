@@ -0,0 +1,132 @@
+package main
+
+// SequentialChunkBlocks is how many blocks the sequential benchmark hands to
+// each WriteBlocks call (1MB with 4KB blocks)
+const SequentialChunkBlocks = 256
+
+// BlocksWriter is implemented by arrays that can write a run of contiguous
+// blocks more cheaply than one block at a time
+type BlocksWriter interface {
+	WriteBlocks(blockNum int, data []byte) error
+}
+
+// WriteBlocks writes len(data)/blockSize contiguous blocks starting at
+// blockNum. Arrays that implement BlocksWriter handle the whole run at once;
+// others get one Write per block.
+func WriteBlocks(raid RAID, blockNum int, data []byte, blockSize int) error {
+	if writer, ok := raid.(BlocksWriter); ok {
+		return writer.WriteBlocks(blockNum, data)
+	}
+	if err := checkRun(blockNum, data, blockSize, raid.GetEffectiveCapacity()); err != nil {
+		return err
+	}
+	for offset := 0; offset < len(data); offset += blockSize {
+		err := raid.Write(blockNum, data[offset:offset+blockSize])
+		if err != nil {
+			return err
+		}
+		blockNum++
+	}
+	return nil
+}
+
+// writeBlocks writes a run of blocks to a parity array. Stripes the run covers
+// completely, dataDisks chunks of chunkBlocks each, get a full-stripe write
+// one strip at a time; blocks in partial stripes at either end fall back to
+// small writes. mapBlock gives the strip, data disk and parity disk of a
+// logical block. Each stripe is written under the locks of the strips it
+// covers. Must be called between stripes.enter and stripes.exit.
+func (m *memberSet) writeBlocks(blockSize, dataDisks, chunkBlocks, blockNum int, data []byte,
+	mapBlock func(blockNum int) (stripNum, diskNum, parityDisk int)) error {
+	if len(data)%blockSize != 0 {
+		return ErrBlockSize
+	}
+
+	stripeBlocks := dataDisks * chunkBlocks
+	for len(data) > 0 {
+		stripNum, diskNum, parityDisk := mapBlock(blockNum)
+
+		var err error
+		n := 1
+		if blockNum%stripeBlocks == 0 && len(data) >= stripeBlocks*blockSize {
+			// The run covers this whole stripe, which lies on chunkBlocks
+			// consecutive strips
+			n = stripeBlocks
+			for i := 0; i < chunkBlocks; i++ {
+				m.stripes.lock(stripNum + i)
+			}
+			m.mu.Lock()
+			err = m.writeStripe(blockSize, dataDisks, chunkBlocks, blockNum, data, mapBlock)
+			m.mu.Unlock()
+			for i := 0; i < chunkBlocks; i++ {
+				m.stripes.unlock(stripNum + i)
+			}
+		} else {
+			m.stripes.lock(stripNum)
+			m.mu.Lock()
+			err = m.writeParityBlock(blockSize, stripNum, diskNum, parityDisk, data[:blockSize])
+			m.mu.Unlock()
+			m.stripes.unlock(stripNum)
+		}
+		if err != nil {
+			return err
+		}
+
+		blockNum += n
+		data = data[n*blockSize:]
+	}
+	return nil
+}
+
+// writeStripe writes the whole stripe starting at blockNum, one strip at a
+// time. Block i of each chunk lands on the same strip of the members. Must be
+// called with mu held.
+func (m *memberSet) writeStripe(blockSize, dataDisks, chunkBlocks, blockNum int, data []byte,
+	mapBlock func(blockNum int) (stripNum, diskNum, parityDisk int)) error {
+	for i := 0; i < chunkBlocks; i++ {
+		stripNum, _, parityDisk := mapBlock(blockNum + i)
+		diskNums := make([]int, dataDisks)
+		blocks := make([][]byte, dataDisks)
+		for slot := 0; slot < dataDisks; slot++ {
+			offset := slot*chunkBlocks + i
+			_, diskNums[slot], _ = mapBlock(blockNum + offset)
+			blocks[slot] = data[offset*blockSize : (offset+1)*blockSize]
+		}
+		if err := m.writeFullStripe(blockSize, stripNum, parityDisk, diskNums, blocks); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeFullStripe writes every data block of a strip and the parity computed
+// from them in memory, so each member is written exactly once and nothing is
+// read back
+func (m *memberSet) writeFullStripe(blockSize, stripNum, parityDisk int, diskNums []int, blocks [][]byte) error {
+	if _, err := m.failedDisk(stripNum); err != nil {
+		return err
+	}
+
+	parity := make([]byte, blockSize)
+	for _, block := range blocks {
+		xorInto(parity, block)
+	}
+
+	// Write every member at once. Members that have already failed are
+	// skipped; their blocks can be rebuilt from the rest of the strip.
+	var writes []memberOp
+	for slot, diskNum := range diskNums {
+		if !m.isFailed(diskNum, stripNum) {
+			writes = append(writes, memberOp{diskNum: diskNum, data: blocks[slot]})
+		}
+	}
+	if !m.isFailed(parityDisk, stripNum) {
+		writes = append(writes, memberOp{diskNum: parityDisk, data: parity})
+	}
+	m.writeMembers(stripNum, writes)
+
+	if _, err := m.failedDisk(stripNum); err != nil {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+// patternRun returns the distinct patterns for count blocks from blockNum,
+// laid end to end
+func patternRun(blockNum, count int) []byte {
+	var data []byte
+	for i := 0; i < count; i++ {
+		data = append(data, blockPattern(blockNum+i)...)
+	}
+	return data
+}
+
+// TestFullStripeWrite tests that whole strips are written with one write per
+// member and no reads
+func TestFullStripeWrite(t *testing.T) {
+	raid := NewRAID5()
+	err := raid.Initialize()
+	if err != nil {
+		t.Fatalf("Failed to initialize RAID5: %v", err)
+	}
+	defer raid.CleanUp()
+
+	before := raid.IOStats()
+	if err := raid.WriteBlocks(0, patternRun(0, 8)); err != nil {
+		t.Fatalf("Failed to write blocks to RAID5: %v", err)
+	}
+	after := raid.IOStats()
+
+	// Two strips of 5 members each
+	if reads := after.Reads - before.Reads; reads != 0 {
+		t.Errorf("Full-stripe write issued %d reads, expected 0", reads)
+	}
+	if writes := after.Writes - before.Writes; writes != 10 {
+		t.Errorf("Full-stripe write issued %d writes, expected 10", writes)
+	}
+	checkParity(t, &raid.memberSet, 0)
+	checkParity(t, &raid.memberSet, 1)
+	verifyBlocks(t, raid, 8)
+}
+
+// TestPartialStripeWrite tests that a run starting and ending mid-strip uses
+// small writes at the edges and a full-stripe write in between
+func TestPartialStripeWrite(t *testing.T) {
+	raid := NewRAID4()
+	err := raid.Initialize()
+	if err != nil {
+		t.Fatalf("Failed to initialize RAID4: %v", err)
+	}
+	defer raid.CleanUp()
+
+	before := raid.IOStats()
+	if err := raid.WriteBlocks(2, patternRun(2, 8)); err != nil {
+		t.Fatalf("Failed to write blocks to RAID4: %v", err)
+	}
+	after := raid.IOStats()
+
+	// Blocks 2, 3, 8 and 9 are small writes (2 reads, 2 writes each) and
+	// blocks 4-7 are one full strip (5 writes)
+	if reads := after.Reads - before.Reads; reads != 8 {
+		t.Errorf("Partial-stripe write issued %d reads, expected 8", reads)
+	}
+	if writes := after.Writes - before.Writes; writes != 13 {
+		t.Errorf("Partial-stripe write issued %d writes, expected 13", writes)
+	}
+	for stripNum := 0; stripNum < 3; stripNum++ {
+		checkParity(t, &raid.memberSet, stripNum)
+	}
+	for blockNum := 2; blockNum < 10; blockNum++ {
+		readData, err := raid.Read(blockNum)
+		if err != nil || !bytes.Equal(readData, blockPattern(blockNum)) {
+			t.Errorf("Data mismatch in RAID4 block %d: %v", blockNum, err)
+		}
+	}
+}
+
+// TestDegradedFullStripeWrite tests full-stripe writes with a failed member
+func TestDegradedFullStripeWrite(t *testing.T) {
+	raid := NewRAID5()
+	err := raid.Initialize()
+	if err != nil {
+		t.Fatalf("Failed to initialize RAID5: %v", err)
+	}
+	defer raid.CleanUp()
+
+	raid.FailDisk(3)
+	if err := raid.WriteBlocks(0, patternRun(0, 20)); err != nil {
+		t.Fatalf("Failed to write blocks to degraded RAID5: %v", err)
+	}
+	verifyBlocks(t, raid, 20)
+}
+
+// TestWriteBlocksFallback tests that arrays without a full-stripe path still
+// accept multi-block writes one block at a time
+func TestWriteBlocksFallback(t *testing.T) {
+	raid := NewRAID1()
+	err := raid.Initialize()
+	if err != nil {
+		t.Fatalf("Failed to initialize RAID1: %v", err)
+	}
+	defer raid.CleanUp()
+
+	if err := WriteBlocks(raid, 0, patternRun(0, 6), TestBlockSize); err != nil {
+		t.Fatalf("Failed to write blocks to RAID1: %v", err)
+	}
+	verifyBlocks(t, raid, 6)
+
+	if err := WriteBlocks(raid, 0, make([]byte, TestBlockSize+1), TestBlockSize); err == nil {
+		t.Errorf("Expected an unaligned multi-block write to fail")
+	}
+}
@@ -0,0 +1,483 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+)
+
+// MemberState is the state a member disk records for itself in its superblock
+type MemberState uint32
+
+const (
+	MemberActive     MemberState = iota // In sync with the rest of the array
+	MemberFailed                        // Taken out of the array after a failure
+	MemberRebuilding                    // A replacement that has not finished rebuilding
+)
+
+// superblockMagic marks the start of a superblock ("RAID")
+const superblockMagic = 0x52414944
+
+// superblockVersion is the on-disk superblock format version
+const superblockVersion = 1
+
+// errNoSuperblock is returned for a disk that does not carry a valid superblock
+var errNoSuperblock = errors.New("no RAID superblock found")
+
+// Superblock is the metadata every member disk carries about its array. It
+// is stored in the block after the member's data blocks, at the very end of
+// that block, so it can be found from the end of the disk without knowing
+// the geometry first.
+type Superblock struct {
+	UUID     [16]byte // Shared by every member of one array
+	Level    int
+	Geometry Geometry // Dir is not stored
+	Index    int      // Member's position in the array
+	State    MemberState
+	Events   uint64 // Bumped whenever a member changes state
+
+	BitmapRegion int // Strips covered by each write-intent bitmap bit, 0 for no bitmap
+
+	Reshape *ReshapeCheckpoint // Progress of an unfinished reshape, nil if none
+}
+
+// superblockRecord is the fixed-size on-disk layout of a Superblock
+type superblockRecord struct {
+	Magic         uint32
+	Version       uint32
+	UUID          [16]byte
+	Level         uint32
+	NumDisks      uint32
+	BlockSize     uint32
+	DiskBlocks    uint64
+	ChunkBlocks   uint32
+	Index         uint32
+	State         uint32
+	Events        uint64
+	BitmapRegion  uint32
+	ReshapeLevel  uint32
+	ReshapeDisks  uint32
+	ReshapeStripe uint64
+	Flags         uint32
+	Checksum      uint32 // CRC32 of everything before it
+}
+
+const (
+	flagIntegrity = 1 << iota // Members checksum every block
+	flagReshape               // A reshape is in progress
+)
+
+// superblockSize is the number of bytes a superblock takes on disk
+var superblockSize = binary.Size(superblockRecord{})
+
+// encode returns a block of blockSize bytes with the superblock at its end
+// and the write-intent bitmap, if any, at its start
+func (sb Superblock) encode(blockSize int, bitmap []byte) []byte {
+	record := superblockRecord{
+		Magic:        superblockMagic,
+		Version:      superblockVersion,
+		UUID:         sb.UUID,
+		Level:        uint32(sb.Level),
+		NumDisks:     uint32(sb.Geometry.NumDisks),
+		BlockSize:    uint32(sb.Geometry.BlockSize),
+		DiskBlocks:   uint64(sb.Geometry.DiskBlocks),
+		ChunkBlocks:  uint32(sb.Geometry.ChunkBlocks),
+		Index:        uint32(sb.Index),
+		State:        uint32(sb.State),
+		Events:       sb.Events,
+		BitmapRegion: uint32(sb.BitmapRegion),
+	}
+	if sb.Geometry.Integrity {
+		record.Flags |= flagIntegrity
+	}
+	if sb.Reshape != nil {
+		record.Flags |= flagReshape
+		record.ReshapeLevel = uint32(sb.Reshape.Level)
+		record.ReshapeDisks = uint32(sb.Reshape.NumDisks)
+		record.ReshapeStripe = uint64(sb.Reshape.Stripe)
+	}
+
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, record)
+	encoded := buf.Bytes()
+	record.Checksum = crc32.ChecksumIEEE(encoded[:superblockSize-4])
+	binary.LittleEndian.PutUint32(encoded[superblockSize-4:], record.Checksum)
+
+	block := make([]byte, blockSize)
+	copy(block, bitmap)
+	copy(block[blockSize-superblockSize:], encoded)
+	return block
+}
+
+// decodeSuperblock parses a superblock from the last superblockSize bytes of
+// data
+func decodeSuperblock(data []byte) (Superblock, error) {
+	if len(data) < superblockSize {
+		return Superblock{}, errNoSuperblock
+	}
+	encoded := data[len(data)-superblockSize:]
+
+	var record superblockRecord
+	binary.Read(bytes.NewReader(encoded), binary.LittleEndian, &record)
+	if record.Magic != superblockMagic {
+		return Superblock{}, errNoSuperblock
+	}
+	if record.Checksum != crc32.ChecksumIEEE(encoded[:superblockSize-4]) {
+		return Superblock{}, errors.New("superblock checksum mismatch")
+	}
+	if record.Version != superblockVersion {
+		return Superblock{}, fmt.Errorf("unsupported superblock version %d", record.Version)
+	}
+
+	var reshape *ReshapeCheckpoint
+	if record.Flags&flagReshape != 0 {
+		reshape = &ReshapeCheckpoint{
+			Level:    int(record.ReshapeLevel),
+			NumDisks: int(record.ReshapeDisks),
+			Stripe:   int(record.ReshapeStripe),
+		}
+	}
+
+	return Superblock{
+		UUID:  record.UUID,
+		Level: int(record.Level),
+		Geometry: Geometry{
+			NumDisks:    int(record.NumDisks),
+			BlockSize:   int(record.BlockSize),
+			DiskBlocks:  int(record.DiskBlocks),
+			ChunkBlocks: int(record.ChunkBlocks),
+			Integrity:   record.Flags&flagIntegrity != 0,
+		},
+		Index:        int(record.Index),
+		State:        MemberState(record.State),
+		Events:       record.Events,
+		BitmapRegion: int(record.BitmapRegion),
+		Reshape:      reshape,
+	}, nil
+}
+
+// ReadSuperblock reads the superblock at the end of a member disk file
+func ReadSuperblock(path string) (Superblock, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return Superblock{}, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return Superblock{}, err
+	}
+	if info.Size() < int64(superblockSize) {
+		return Superblock{}, errNoSuperblock
+	}
+	data := make([]byte, superblockSize)
+	_, err = file.ReadAt(data, info.Size()-int64(superblockSize))
+	if err != nil {
+		return Superblock{}, err
+	}
+	return decodeSuperblock(data)
+}
+
+// identity is the array-wide part of the superblock, kept in memory by each
+// array and written out to every member when something changes
+type identity struct {
+	uuid         [16]byte
+	level        int
+	events       uint64
+	bitmapRegion int                // Strips per write-intent bitmap bit, 0 for no bitmap
+	checkpoint   *ReshapeCheckpoint // Reshape progress to record, nil if none
+}
+
+// stamp bumps the event counter and writes a superblock to every member, with
+// the state given by state. A new array gets its UUID here.
+func (id *identity) stamp(g Geometry, disks []BlockDevice, state func(i int) MemberState, bitmap []byte) error {
+	if id.uuid == ([16]byte{}) {
+		rand.Read(id.uuid[:])
+	}
+	id.events++
+	return id.record(g, disks, state, bitmap)
+}
+
+// record writes the current superblock and bitmap to every member without
+// bumping the event counter. Write errors on members that have failed are
+// ignored.
+func (id *identity) record(g Geometry, disks []BlockDevice, state func(i int) MemberState, bitmap []byte) error {
+	var first error
+	for i, disk := range disks {
+		if disk == nil {
+			continue
+		}
+		sb := Superblock{
+			UUID:         id.uuid,
+			Level:        id.level,
+			Geometry:     g,
+			Index:        i,
+			State:        state(i),
+			Events:       id.events,
+			BitmapRegion: id.bitmapRegion,
+			Reshape:      id.checkpoint,
+		}
+		err := disk.Write(g.DiskBlocks, sb.encode(g.BlockSize, bitmap))
+		if err != nil && sb.State != MemberFailed && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// memberState returns the state to record for member i
+func (m *memberSet) memberState(i int) MemberState {
+	switch {
+	case m.failed[i]:
+		return MemberFailed
+	case m.rebuilding && i == m.rebuildDisk:
+		return MemberRebuilding
+	}
+	return MemberActive
+}
+
+// updateSuperblocks records the current state of every member in its
+// superblock. Must be called with mu held.
+func (m *memberSet) updateSuperblocks() error {
+	if m.geometry == nil || m.noSuperblock {
+		return nil
+	}
+	return m.stamp(m.geometry(), m.disks, m.memberState, m.intent.encode())
+}
+
+// writeSuperblocks records the members of a freshly initialized array. If any
+// member already held data, such as a disk file left from before, there is
+// no telling which strips are in use, so all of them count as written.
+func (m *memberSet) writeSuperblocks() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, disk := range m.disks {
+		if !isBlank(disk) {
+			m.written = nil
+			break
+		}
+	}
+	return m.updateSuperblocks()
+}
+
+// Close stops any rebuild or scrub and closes every device the array owns,
+// leaving the disks and their superblocks in place so the array can be
+// opened again
+func (m *memberSet) Close() error {
+	m.stopBackground()
+	m.mu.Lock()
+	m.clearBitmap()
+	m.mu.Unlock()
+
+	var first error
+	for _, disk := range m.allDisks() {
+		if disk == nil {
+			continue
+		}
+		if err := disk.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// assembledMember is a member disk found while assembling an array
+type assembledMember struct {
+	path string
+	sb   Superblock
+}
+
+// Open assembles the array whose member disks are the .dat files in dir
+func Open(dir string) (RAID, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.dat"))
+	if err != nil {
+		return nil, err
+	}
+	return Assemble(paths)
+}
+
+// Assemble brings an array back up from member disk files given in any
+// order. Files without a superblock are ignored. Disks from another array or
+// with a different geometry are refused. Disks whose event counter is behind
+// the newest member, or that recorded themselves as failed or part-rebuilt,
+// are stale and left out. If members are missing the array comes up
+// degraded, as long as its redundancy covers them.
+func Assemble(paths []string) (RAID, error) {
+	var members []assembledMember
+	for _, path := range paths {
+		sb, err := ReadSuperblock(path)
+		if errors.Is(err, errNoSuperblock) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		members = append(members, assembledMember{path: path, sb: sb})
+	}
+	if len(members) == 0 {
+		return nil, errors.New("no array members found")
+	}
+
+	newest := members[0].sb
+	for _, member := range members {
+		if member.sb.Events > newest.Events {
+			newest = member.sb
+		}
+	}
+	for _, member := range members {
+		if member.sb.UUID != newest.UUID {
+			return nil, fmt.Errorf("%s belongs to a different array", member.path)
+		}
+		if member.sb.Level != newest.Level || member.sb.Geometry != newest.Geometry {
+			return nil, fmt.Errorf("%s does not match the array's level or geometry", member.path)
+		}
+	}
+
+	g := newest.Geometry
+	g.Dir = filepath.Dir(members[0].path)
+	memberPaths := make([]string, g.NumDisks)
+	for _, member := range members {
+		if member.sb.Events < newest.Events || member.sb.State != MemberActive {
+			continue
+		}
+		if member.sb.Index >= g.NumDisks {
+			return nil, fmt.Errorf("%s has member index %d in a %d-disk array", member.path, member.sb.Index, g.NumDisks)
+		}
+		if memberPaths[member.sb.Index] != "" {
+			return nil, fmt.Errorf("%s and %s both claim to be member %d",
+				memberPaths[member.sb.Index], member.path, member.sb.Index)
+		}
+		memberPaths[member.sb.Index] = member.path
+	}
+
+	var missing []int
+	for i, path := range memberPaths {
+		if path == "" {
+			missing = append(missing, i)
+		}
+	}
+	if len(missing) > maxMissing(newest.Level, g.NumDisks) {
+		return nil, fmt.Errorf("RAID%d cannot start with %d of %d members missing",
+			newest.Level, len(missing), g.NumDisks)
+	}
+
+	// Missing members open as nil devices, which count as failed. Members
+	// added later by a reshape are created alongside the others.
+	newDisk := func(i int) (BlockDevice, error) {
+		if i >= len(memberPaths) {
+			return NewDiskWithBlockSize(filepath.Join(g.Dir, fmt.Sprintf("disk%d.dat", i)), g.BlockSize)
+		}
+		if memberPaths[i] == "" {
+			return nil, nil
+		}
+		return NewDiskWithBlockSize(memberPaths[i], g.BlockSize)
+	}
+	id := identity{
+		uuid:         newest.UUID,
+		level:        newest.Level,
+		events:       newest.Events,
+		bitmapRegion: newest.BitmapRegion,
+		checkpoint:   newest.Reshape,
+	}
+
+	var raid RAID
+	var set *memberSet
+	var err error
+	switch newest.Level {
+	case 0:
+		var r *RAID0
+		if r, err = NewRAID0WithGeometry(g); err == nil {
+			r.identity = id
+			r.newDisk = newDisk
+			raid = r
+		}
+	case 1:
+		var r *RAID1
+		if r, err = NewRAID1WithGeometry(g); err == nil {
+			raid, set = r, &r.memberSet
+		}
+	case 4:
+		var r *RAID4
+		if r, err = NewRAID4WithGeometry(g); err == nil {
+			raid, set = r, &r.memberSet
+		}
+	case 5:
+		var r *RAID5
+		if r, err = NewRAID5WithGeometry(g); err == nil {
+			raid, set = r, &r.memberSet
+		}
+	case 6:
+		var r *RAID6
+		if r, err = NewRAID6WithGeometry(g); err == nil {
+			raid, set = r, &r.memberSet
+		}
+	default:
+		err = fmt.Errorf("unknown RAID level %d", newest.Level)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if set != nil {
+		set.identity = id
+		set.newDisk = newDisk
+		if newest.BitmapRegion > 0 {
+			// Strips that were dirty on any member may have been caught
+			// half-written
+			set.intent = newWriteIntent(bitmapRegions(g, newest.BitmapRegion))
+			dirty := make([]byte, (len(set.intent.dirty)+7)/8)
+			for _, path := range memberPaths {
+				if path == "" {
+					continue
+				}
+				bitmap, err := readBitmap(path, newest)
+				if err != nil {
+					return nil, fmt.Errorf("%s: %w", path, err)
+				}
+				for i := range dirty {
+					dirty[i] |= bitmap[i]
+				}
+			}
+			set.intent.loadBitmap(dirty)
+		}
+	}
+
+	if err := raid.Initialize(); err != nil {
+		return nil, err
+	}
+	if set != nil {
+		// There is no record of which strips were written before
+		set.written = nil
+	}
+	for _, i := range missing {
+		set.FailDisk(i)
+	}
+	if newest.Reshape != nil {
+		// Carry on moving data from where the reshape was interrupted
+		if err := resumeReshape(raid, *newest.Reshape); err != nil {
+			return nil, err
+		}
+	}
+	if set != nil && set.intent != nil {
+		set.resync()
+	}
+	return raid, nil
+}
+
+// maxMissing returns how many members an array can lose and keep running
+func maxMissing(level, numDisks int) int {
+	switch level {
+	case 1:
+		return numDisks - 1
+	case 4, 5:
+		return 1
+	case 6:
+		return 2
+	}
+	return 0
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestSuperblockEncoding tests that a superblock survives encoding and that
+// damage to it is detected
+func TestSuperblockEncoding(t *testing.T) {
+	sb := Superblock{
+		UUID:     [16]byte{1, 2, 3},
+		Level:    5,
+		Geometry: Geometry{NumDisks: 4, BlockSize: 512, DiskBlocks: 100, ChunkBlocks: 4},
+		Index:    2,
+		State:    MemberRebuilding,
+		Events:   42,
+	}
+	block := sb.encode(512, nil)
+	got, err := decodeSuperblock(block)
+	if err != nil {
+		t.Fatalf("Failed to decode superblock: %v", err)
+	}
+	if got != sb {
+		t.Errorf("Decoded superblock %+v, expected %+v", got, sb)
+	}
+
+	block[len(block)-10] ^= 0xff
+	if _, err := decodeSuperblock(block); err == nil {
+		t.Errorf("Expected a damaged superblock to be rejected")
+	}
+	if _, err := decodeSuperblock(make([]byte, 512)); err != errNoSuperblock {
+		t.Errorf("Expected errNoSuperblock for a blank block, got %v", err)
+	}
+}
+
+// createTestArray builds a RAID5 array in a temporary directory and fills
+// its first blocks with distinct patterns
+func createTestArray(t *testing.T, numDisks int) (*RAID5, string) {
+	t.Helper()
+	g := testGeometry(t, numDisks, 2)
+	g.DiskBlocks = TestRebuildBlocks
+	raid, err := NewRAID5WithGeometry(g)
+	if err != nil {
+		t.Fatalf("Failed to create RAID5: %v", err)
+	}
+	err = raid.Initialize()
+	if err != nil {
+		t.Fatalf("Failed to initialize RAID5: %v", err)
+	}
+	writeAndVerify(t, raid, 30)
+	return raid, g.Dir
+}
+
+// openTestArray opens the array in dir and checks that it is a RAID5
+func openTestArray(t *testing.T, dir string) *RAID5 {
+	t.Helper()
+	raid, err := Open(dir)
+	if err != nil {
+		t.Fatalf("Failed to open array: %v", err)
+	}
+	raid5, ok := raid.(*RAID5)
+	if !ok {
+		t.Fatalf("Opened a %s, expected RAID5", raid.GetName())
+	}
+	return raid5
+}
+
+// TestOpenReassembles tests closing an array and opening it again with its
+// disk files renamed, so members are found by superblock and not by name
+func TestOpenReassembles(t *testing.T) {
+	raid, dir := createTestArray(t, 4)
+	if err := raid.Close(); err != nil {
+		t.Fatalf("Failed to close RAID5: %v", err)
+	}
+
+	for i, name := range []string{"d.dat", "c.dat", "b.dat", "a.dat"} {
+		err := os.Rename(filepath.Join(dir, fmt.Sprintf("disk%d.dat", i)), filepath.Join(dir, name))
+		if err != nil {
+			t.Fatalf("Failed to rename disk %d: %v", i, err)
+		}
+	}
+
+	reopened := openTestArray(t, dir)
+	defer reopened.CleanUp()
+	if reopened.Geometry().ChunkBlocks != 2 {
+		t.Errorf("Reopened array has chunk size %d, expected 2", reopened.Geometry().ChunkBlocks)
+	}
+	if missing, err := reopened.failedDisk(0); missing != -1 || err != nil {
+		t.Errorf("Reopened array is degraded: missing %d, %v", missing, err)
+	}
+	verifyBlocks(t, reopened, 30)
+}
+
+// TestOpenDegraded tests bringing an array up with a member missing, and
+// refusing to when too many are gone
+func TestOpenDegraded(t *testing.T) {
+	raid, dir := createTestArray(t, 4)
+	raid.Close()
+
+	os.Remove(filepath.Join(dir, "disk2.dat"))
+	reopened := openTestArray(t, dir)
+	if missing, _ := reopened.failedDisk(0); missing != 2 {
+		t.Errorf("Expected member 2 to be missing, got %d", missing)
+	}
+	verifyBlocks(t, reopened, 30)
+	reopened.Close()
+
+	os.Remove(filepath.Join(dir, "disk1.dat"))
+	if _, err := Open(dir); err == nil {
+		t.Errorf("Expected RAID5 with two members missing to be refused")
+	}
+}
+
+// copyFile copies a disk file, to keep an old copy of a member
+func copyFile(t *testing.T, from, to string) {
+	t.Helper()
+	src, err := os.Open(from)
+	if err != nil {
+		t.Fatalf("Failed to open %s: %v", from, err)
+	}
+	defer src.Close()
+	dst, err := os.Create(to)
+	if err != nil {
+		t.Fatalf("Failed to create %s: %v", to, err)
+	}
+	defer dst.Close()
+	if _, err := io.Copy(dst, src); err != nil {
+		t.Fatalf("Failed to copy %s: %v", from, err)
+	}
+}
+
+// TestOpenRefusesStale tests that a member that missed writes while the
+// array ran without it is left out rather than trusted
+func TestOpenRefusesStale(t *testing.T) {
+	raid, dir := createTestArray(t, 4)
+	stale := filepath.Join(t.TempDir(), "stale.dat")
+	copyFile(t, filepath.Join(dir, "disk1.dat"), stale)
+
+	// The array carries on without disk 1 and every block changes
+	raid.FailDisk(1)
+	for blockNum := 0; blockNum < 30; blockNum++ {
+		if err := raid.Write(blockNum, blockPattern(blockNum+100)); err != nil {
+			t.Fatalf("Failed to write to RAID5 block %d: %v", blockNum, err)
+		}
+	}
+	raid.Close()
+
+	// Put the old copy of disk 1 back, as if it had come back online
+	copyFile(t, stale, filepath.Join(dir, "disk1.dat"))
+	sb, err := ReadSuperblock(filepath.Join(dir, "disk1.dat"))
+	if err != nil || sb.State != MemberActive {
+		t.Fatalf("Expected the stale copy to claim to be active: %+v, %v", sb, err)
+	}
+
+	reopened := openTestArray(t, dir)
+	defer reopened.CleanUp()
+	if missing, _ := reopened.failedDisk(0); missing != 1 {
+		t.Errorf("Expected stale member 1 to be left out, got %d", missing)
+	}
+	for blockNum := 0; blockNum < 30; blockNum++ {
+		readData, err := reopened.Read(blockNum)
+		if err != nil || !bytes.Equal(readData, blockPattern(blockNum+100)) {
+			t.Errorf("Stale data returned for RAID5 block %d: %v", blockNum, err)
+		}
+	}
+}
+
+// TestOpenRefusesMismatched tests that a disk from another array stops the
+// array from being assembled
+func TestOpenRefusesMismatched(t *testing.T) {
+	raid, dir := createTestArray(t, 4)
+	raid.Close()
+	other, otherDir := createTestArray(t, 4)
+	other.Close()
+
+	copyFile(t, filepath.Join(otherDir, "disk0.dat"), filepath.Join(dir, "foreign.dat"))
+	if _, err := Open(dir); err == nil {
+		t.Errorf("Expected a disk from another array to be refused")
+	}
+}
+
+// TestOpenAfterRebuild tests that a spare rebuilt into the array is found in
+// place of the member it replaced
+func TestOpenAfterRebuild(t *testing.T) {
+	raid, dir := createTestArray(t, 3)
+	spare, err := NewDiskWithBlockSize(filepath.Join(dir, "spare0.dat"), TestBlockSize)
+	if err != nil {
+		t.Fatalf("Failed to create spare: %v", err)
+	}
+	raid.AddSpare(spare)
+	raid.FailDisk(0)
+	if err := raid.WaitRebuild(); err != nil {
+		t.Fatalf("Rebuild failed: %v", err)
+	}
+	raid.Close()
+
+	sb, err := ReadSuperblock(filepath.Join(dir, "spare0.dat"))
+	if err != nil || sb.Index != 0 || sb.State != MemberActive {
+		t.Errorf("Expected the spare to be active member 0: %+v, %v", sb, err)
+	}
+
+	reopened := openTestArray(t, dir)
+	defer reopened.CleanUp()
+	if missing, err := reopened.failedDisk(0); missing != -1 || err != nil {
+		t.Errorf("Reopened array is degraded: missing %d, %v", missing, err)
+	}
+	verifyBlocks(t, reopened, 30)
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// errVolumeFull is returned by writes that run past the end of a volume
+var errVolumeFull = errors.New("write past end of volume")
+
+// geometer is implemented by arrays that report their geometry
+type geometer interface {
+	Geometry() Geometry
+}
+
+// Volume is a byte-addressable view of a RAID array. It implements
+// io.ReaderAt, io.WriterAt and io.ReadWriteSeeker, so standard library code
+// can use an array like a file. Partial blocks are written with
+// read-modify-write. The volume follows the array's capacity, so it grows
+// when the array does.
+type Volume struct {
+	raid      RAID
+	blockSize int
+	mu        sync.Mutex // Serializes writes, which may share a block, and the offset
+	offset    int64      // Position for Read, Write and Seek
+}
+
+// NewVolume wraps an initialized array as a volume
+func NewVolume(raid RAID) *Volume {
+	blockSize := BlockSize
+	if g, ok := raid.(geometer); ok {
+		blockSize = g.Geometry().BlockSize
+	}
+	return &Volume{
+		raid:      raid,
+		blockSize: blockSize,
+	}
+}
+
+// Size returns the size of the volume in bytes
+func (v *Volume) Size() int64 {
+	return int64(v.raid.GetEffectiveCapacity()) * int64(v.blockSize)
+}
+
+// ReadAt reads len(p) bytes starting at byte offset off. Reads that run past
+// the end of the volume return the bytes before it and io.EOF.
+func (v *Volume) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("%w: negative offset %d", ErrOutOfRange, off)
+	}
+	size := v.Size()
+	if off >= size {
+		return 0, io.EOF
+	}
+	want := len(p)
+	if int64(want) > size-off {
+		p = p[:size-off]
+	}
+
+	n := 0
+	for n < len(p) {
+		blockNum, start := v.locate(off + int64(n))
+		data, err := v.raid.Read(blockNum)
+		if err != nil {
+			return n, err
+		}
+		n += copy(p[n:], data[start:])
+	}
+	if n < want {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// WriteAt writes p starting at byte offset off. Whole blocks are written
+// directly; the blocks at either end are read first if p covers them only
+// in part.
+func (v *Volume) WriteAt(p []byte, off int64) (int, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.writeAt(p, off)
+}
+
+// writeAt does the work of WriteAt. Must be called with mu held.
+func (v *Volume) writeAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("%w: negative offset %d", ErrOutOfRange, off)
+	}
+	var err error
+	size := v.Size()
+	if off >= size {
+		return 0, errVolumeFull
+	}
+	if int64(len(p)) > size-off {
+		p = p[:size-off]
+		err = errVolumeFull
+	}
+
+	n := 0
+	for n < len(p) {
+		blockNum, start := v.locate(off + int64(n))
+		if start == 0 && len(p)-n >= v.blockSize {
+			// Whole blocks go straight through, as full stripes if the array
+			// supports them
+			run := (len(p) - n) / v.blockSize * v.blockSize
+			if werr := WriteBlocks(v.raid, blockNum, p[n:n+run], v.blockSize); werr != nil {
+				return n, werr
+			}
+			n += run
+			continue
+		}
+
+		data, rerr := v.raid.Read(blockNum)
+		if rerr != nil {
+			return n, rerr
+		}
+		copied := copy(data[start:], p[n:])
+		if werr := v.raid.Write(blockNum, data); werr != nil {
+			return n, werr
+		}
+		n += copied
+	}
+	return n, err
+}
+
+// locate returns the block holding a byte offset and the offset within it
+func (v *Volume) locate(off int64) (blockNum, start int) {
+	return int(off / int64(v.blockSize)), int(off % int64(v.blockSize))
+}
+
+// Read reads from the current offset and advances it
+func (v *Volume) Read(p []byte) (int, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	n, err := v.ReadAt(p, v.offset)
+	v.offset += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+// Write writes at the current offset and advances it
+func (v *Volume) Write(p []byte) (int, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	n, err := v.writeAt(p, v.offset)
+	v.offset += int64(n)
+	return n, err
+}
+
+// Seek sets the offset for the next Read or Write. Seeking past the end is
+// allowed, but reads there return io.EOF and writes fail.
+func (v *Volume) Seek(offset int64, whence int) (int64, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += v.offset
+	case io.SeekEnd:
+		offset += v.Size()
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("%w: negative offset %d", ErrOutOfRange, offset)
+	}
+	v.offset = offset
+	return offset, nil
+}
+
+// Sync flushes the array, so every write that has returned is durable, like
+// os.File.Sync
+func (v *Volume) Sync() error {
+	return v.raid.Flush()
+}
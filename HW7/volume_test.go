@@ -0,0 +1,172 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+// newTestVolume returns a volume over a small initialized RAID5
+func newTestVolume(t *testing.T) *Volume {
+	t.Helper()
+	g := testGeometry(t, 3, 2)
+	g.DiskBlocks = TestRebuildBlocks
+	raid, err := NewRAID5WithGeometry(g)
+	if err != nil {
+		t.Fatalf("Failed to create RAID5: %v", err)
+	}
+	err = raid.Initialize()
+	if err != nil {
+		t.Fatalf("Failed to initialize RAID5: %v", err)
+	}
+	t.Cleanup(func() { raid.CleanUp() })
+	return NewVolume(raid)
+}
+
+// TestVolumeUnaligned tests writes that start and end inside blocks against
+// a plain byte slice holding what the volume should contain
+func TestVolumeUnaligned(t *testing.T) {
+	volume := newTestVolume(t)
+	if volume.Size() != 2*TestRebuildBlocks*TestBlockSize {
+		t.Fatalf("Volume size is %d, expected %d", volume.Size(), 2*TestRebuildBlocks*TestBlockSize)
+	}
+
+	expected := make([]byte, volume.Size())
+	rng := rand.New(rand.NewSource(1))
+	writes := []struct{ off, length int }{
+		{0, 10},
+		{TestBlockSize - 3, 7}, // Across one block boundary
+		{5*TestBlockSize + 100, 3 * TestBlockSize}, // Partial, whole, whole, partial
+		{8 * TestBlockSize, 4 * TestBlockSize},     // A full stripe, aligned
+		{int(volume.Size()) - 50, 50},              // The very end
+	}
+	for _, w := range writes {
+		data := make([]byte, w.length)
+		rng.Read(data)
+		n, err := volume.WriteAt(data, int64(w.off))
+		if err != nil || n != w.length {
+			t.Fatalf("WriteAt(%d, %d) wrote %d: %v", w.off, w.length, n, err)
+		}
+		copy(expected[w.off:], data)
+	}
+
+	for _, w := range writes {
+		data := make([]byte, w.length+20)
+		start := max(w.off-10, 0)
+		n, err := volume.ReadAt(data, int64(start))
+		if err != nil && err != io.EOF {
+			t.Fatalf("ReadAt(%d) failed: %v", start, err)
+		}
+		if !bytes.Equal(data[:n], expected[start:start+n]) {
+			t.Errorf("ReadAt(%d) returned the wrong bytes", start)
+		}
+	}
+}
+
+// TestVolumeBounds tests reads and writes at and past the end of a volume
+func TestVolumeBounds(t *testing.T) {
+	volume := newTestVolume(t)
+	size := volume.Size()
+
+	data := make([]byte, 100)
+	if n, err := volume.ReadAt(data, size-40); n != 40 || err != io.EOF {
+		t.Errorf("Read across the end returned %d, %v, expected 40, io.EOF", n, err)
+	}
+	if n, err := volume.ReadAt(data, size); n != 0 || err != io.EOF {
+		t.Errorf("Read at the end returned %d, %v, expected 0, io.EOF", n, err)
+	}
+	if n, err := volume.WriteAt(data, size-40); n != 40 || !errors.Is(err, errVolumeFull) {
+		t.Errorf("Write across the end returned %d, %v, expected 40, errVolumeFull", n, err)
+	}
+	if _, err := volume.ReadAt(data, -1); err == nil {
+		t.Errorf("Expected a negative offset to be rejected")
+	}
+
+	if pos, err := volume.Seek(-10, io.SeekEnd); pos != size-10 || err != nil {
+		t.Errorf("Seek from end returned %d, %v", pos, err)
+	}
+	if pos, err := volume.Seek(5, io.SeekCurrent); pos != size-5 || err != nil {
+		t.Errorf("Seek from current returned %d, %v", pos, err)
+	}
+	if _, err := volume.Seek(-1, io.SeekStart); err == nil {
+		t.Errorf("Expected seeking before the start to be rejected")
+	}
+}
+
+// TestVolumeGrow tests that a volume takes in the capacity a reshape adds
+func TestVolumeGrow(t *testing.T) {
+	volume := newTestVolume(t)
+	raid := volume.raid.(*RAID5)
+	oldSize := volume.Size()
+
+	if err := raid.Grow(); err != nil {
+		t.Fatalf("Failed to grow RAID5: %v", err)
+	}
+	if err := raid.WaitReshape(); err != nil {
+		t.Fatalf("Reshape failed: %v", err)
+	}
+	if volume.Size() != 3*TestRebuildBlocks*TestBlockSize {
+		t.Fatalf("Volume size is %d after growing, expected %d", volume.Size(), 3*TestRebuildBlocks*TestBlockSize)
+	}
+
+	data := bytes.Repeat([]byte{0x5a}, 100)
+	if n, err := volume.WriteAt(data, oldSize-50); n != len(data) || err != nil {
+		t.Errorf("Write across the old end returned %d, %v", n, err)
+	}
+	read := make([]byte, len(data))
+	if n, err := volume.ReadAt(read, oldSize-50); n != len(data) || err != nil || !bytes.Equal(read, data) {
+		t.Errorf("Read across the old end returned %d, %v", n, err)
+	}
+	if pos, err := volume.Seek(0, io.SeekEnd); pos != volume.Size() || err != nil {
+		t.Errorf("Seek to the end returned %d, %v, expected %d", pos, err, volume.Size())
+	}
+}
+
+// TestVolumeTar tests writing a tar archive onto a volume with io.Copy and
+// reading it back with archive/tar
+func TestVolumeTar(t *testing.T) {
+	volume := newTestVolume(t)
+
+	files := map[string][]byte{
+		"small.txt": []byte("hello, array"),
+		"large.bin": bytes.Repeat([]byte("0123456789abcdef"), 3000),
+	}
+	var archive bytes.Buffer
+	tw := tar.NewWriter(&archive)
+	for _, name := range []string{"small.txt", "large.bin"} {
+		tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(files[name]))})
+		tw.Write(files[name])
+	}
+	tw.Close()
+
+	if _, err := io.Copy(volume, &archive); err != nil {
+		t.Fatalf("Failed to copy archive onto volume: %v", err)
+	}
+	volume.Seek(0, io.SeekStart)
+
+	tr := tar.NewReader(volume)
+	found := 0
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Failed to read archive from volume: %v", err)
+		}
+		contents, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatalf("Failed to read %s: %v", header.Name, err)
+		}
+		if !bytes.Equal(contents, files[header.Name]) {
+			t.Errorf("%s did not survive the round trip", header.Name)
+		}
+		found++
+	}
+	if found != len(files) {
+		t.Errorf("Found %d files in the archive, expected %d", found, len(files))
+	}
+}